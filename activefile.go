@@ -2,10 +2,9 @@ package beecask
 
 import (
 	"encoding/binary"
+	"fmt"
 	"hash/crc32"
-	"os"
-
-	"github.com/yplusplus/ylog"
+	"io"
 )
 
 type ActiveFile struct {
@@ -13,79 +12,97 @@ type ActiveFile struct {
 	fileId uint64
 }
 
-func NewActiveFile(path string, fileId uint64, wbufSize int) (*ActiveFile, error) {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+func NewActiveFile(fs FS, path string, fileId uint64, wbufSize int) (*ActiveFile, error) {
+	// FileWithBuffer writes at explicit offsets, so records can be patched
+	// or truncated after a failed write
+	f, err := fs.Create(path)
 	if err != nil {
-		ylog.Error(err)
 		return nil, err
 	}
-	stat, err := f.Stat()
+	size, err := f.Size()
 	if err != nil {
-		ylog.Error(err)
 		f.Close()
 		return nil, err
 	}
-	ylog.Tracef("New activefile[%d] succ", fileId)
 	return &ActiveFile{
-		FileWithBuffer: NewFileWithBuffer(f, stat.Size(), wbufSize),
+		FileWithBuffer: NewFileWithBuffer(f, size, wbufSize),
 		fileId:         fileId,
 	}, nil
 }
 
 // ReadRecordAt reads a record from specific offset
 func (af *ActiveFile) ReadRecordAt(offset int64) (*Record, error) {
+	r := &Record{}
+	if err := af.ReadRecordInto(offset, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ReadRecordInto reads a record from specific offset into r
+func (af *ActiveFile) ReadRecordInto(offset int64, r *Record) error {
 	data, err := af.ReadAt(offset, DATA_ITEM_HEADER_SIZE)
 	if err != nil {
 		// may return io.EOF
-		return nil, err
+		return err
 	}
 
-	r := Record{
-		crc:        binary.LittleEndian.Uint32(data[0:4]),
-		flag:       binary.LittleEndian.Uint32(data[4:8]),
-		expiration: int64(binary.LittleEndian.Uint64(data[8:16])),
-		keySize:    binary.LittleEndian.Uint32(data[16:20]),
-		valueSize:  binary.LittleEndian.Uint32(data[20:24]),
-		key:        nil,
-		value:      nil,
-	}
+	r.decodeHeader(data)
+	crc := crc32.ChecksumIEEE(data[4:])
 
 	offset += DATA_ITEM_HEADER_SIZE
+	if (r.flag & RECORD_FLAG_BIT_SEQ) > 0 {
+		seq, err := af.ReadAt(offset, RECORD_SEQ_SIZE)
+		if err != nil {
+			// may return io.EOF
+			return err
+		}
+		r.seq = binary.LittleEndian.Uint64(seq)
+		crc = crc32.Update(crc, crc32.IEEETable, seq)
+		offset += RECORD_SEQ_SIZE
+	}
+
 	r.key, err = af.ReadAt(offset, int64(r.keySize))
 	if err != nil {
 		// may return io.EOF
-		return nil, err
+		return err
 	}
 
 	offset += int64(r.keySize)
 	r.value, err = af.ReadAt(offset, int64(r.valueSize))
 	if err != nil {
 		// may return io.EOF
-		return nil, err
+		return err
 	}
 
 	// check crc
-	crc := crc32.ChecksumIEEE(data[4:])
 	crc = crc32.Update(crc, crc32.IEEETable, r.key)
 	crc = crc32.Update(crc, crc32.IEEETable, r.value)
 	if crc != r.crc {
-		return nil, ErrDataCorruption
+		return ErrDataCorruption
 	}
 
-	return &r, nil
+	return nil
+}
+
+// ReadKeyAt reads the key of the record at offset without checking crc
+func (af *ActiveFile) ReadKeyAt(offset int64) ([]byte, error) {
+	data, err := af.ReadAt(offset, DATA_ITEM_HEADER_SIZE)
+	if err != nil {
+		// may return io.EOF
+		return nil, err
+	}
+	var r Record
+	r.decodeHeader(data)
+	return af.ReadAt(offset+r.HeaderSize(), int64(r.keySize))
 }
 
 func (af *ActiveFile) WriteRecord(r *Record) (int64, error) {
 	if r.keySize != uint32(len(r.key)) || r.valueSize != uint32(len(r.value)) {
-		ylog.Errorf("r.keySize[%d] len(r.key)[%d] r.valueSize[%d] len(r.value)[%d]", r.keySize, len(r.key), r.valueSize, len(r.value))
 		return -1, ErrInvalid
 	}
 
-	header := make([]byte, DATA_ITEM_HEADER_SIZE)
-	binary.LittleEndian.PutUint32(header[4:8], r.flag)
-	binary.LittleEndian.PutUint64(header[8:16], uint64(r.expiration))
-	binary.LittleEndian.PutUint32(header[16:20], r.keySize)
-	binary.LittleEndian.PutUint32(header[20:24], r.valueSize)
+	header := r.encodeHeader()
 
 	// calculate crc32
 	r.crc = crc32.ChecksumIEEE(header[4:])
@@ -94,18 +111,65 @@ func (af *ActiveFile) WriteRecord(r *Record) (int64, error) {
 
 	binary.LittleEndian.PutUint32(header[0:4], r.crc)
 
-	var err error
 	offset := af.Size()
-	if _, err = af.Write(header); err != nil {
-		return -1, err
+	_, err := af.Write(header)
+	if err == nil {
+		_, err = af.Write(r.key)
+	}
+	if err == nil {
+		_, err = af.Write(r.value)
+	}
+	if err != nil {
+		return -1, af.truncateAfterFailure(offset, err)
+	}
+	return offset, nil
+}
+
+// WriteRecordFrom writes a record whose value is streamed from reader,
+// r.valueSize bytes are read from reader and r.value is ignored.
+// Nothing is left in the file if it fails.
+func (af *ActiveFile) WriteRecordFrom(r *Record, reader io.Reader) (int64, error) {
+	if r.keySize != uint32(len(r.key)) {
+		return -1, ErrInvalid
+	}
+
+	header := r.encodeHeader()
+
+	// crc is unknown until the whole value is written,
+	// write header first and fill crc at last
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(r.key)
+
+	offset := af.Size()
+	_, err := af.Write(header)
+	if err == nil {
+		_, err = af.Write(r.key)
+	}
+	if err == nil {
+		_, err = io.CopyN(io.MultiWriter(af.FileWithBuffer, crc), reader, int64(r.valueSize))
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 	}
-	if _, err = af.Write(r.key); err != nil {
-		return -1, err
+	if err == nil {
+		r.crc = crc.Sum32()
+		binary.LittleEndian.PutUint32(header[0:4], r.crc)
+		err = af.WriteAt(header[0:4], offset)
 	}
-	if _, err = af.Write(r.value); err != nil {
-		return -1, err
+	if err != nil {
+		return -1, af.truncateAfterFailure(offset, err)
+	}
+	return offset, nil
+}
+
+// truncateAfterFailure drops a partially written record at offset,
+// err is returned as is unless truncate fails as well
+func (af *ActiveFile) truncateAfterFailure(offset int64, err error) error {
+	if terr := af.Truncate(offset); terr != nil {
+		return fmt.Errorf("%w, truncate activefile[%d] to %d failed: %v", err, af.fileId, offset, terr)
 	}
-	return offset, err
+	return err
 }
 
 func (af *ActiveFile) FileId() uint64 {
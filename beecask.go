@@ -1,109 +1,391 @@
 package beecask
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
-
-	"github.com/yplusplus/ylog"
 )
 
 var (
-	ErrInvalid        = fmt.Errorf("Operation is invalid")
-	ErrDataCorruption = fmt.Errorf("Data corruption")
-	ErrDataNotExist   = fmt.Errorf("Data not exist")
+	ErrInvalid         = fmt.Errorf("Operation is invalid")
+	ErrDataCorruption  = fmt.Errorf("Data corruption")
+	ErrDataNotExist    = fmt.Errorf("Data not exist")
+	ErrDataExist       = fmt.Errorf("Data exist")
+	ErrVersionMismatch = fmt.Errorf("Version mismatch")
 )
 
+// NoExpiration is returned by TTL for records which never expire
+const NoExpiration time.Duration = -1
+
 type Beecask struct {
-	options       *options
-	dirPath       string
-	minDataFileId uint64
-	maxDataFileId uint64
-	keydir        *KeyDir
-	activeKeydir  *KeyDir // active-file key dir, use to generate hint-file
-	activeFile    *ActiveFile
-	wg            sync.WaitGroup
-	rwMutex       sync.RWMutex // RWMutex for keydir and activeFile
-	dataFileCache *DataFileCache
-	isMerging     int32 // atomic
+	options        *options
+	logger         Logger
+	fs             FS
+	fileAccess     fileAccess
+	lock           io.Closer // lock of dirPath, released by Close
+	dirPath        string
+	placement      *placement // dirs of data files
+	minDataFileId  uint64     // advanced by merge with hookMutex and rwMutex held
+	maxDataFileId  uint64
+	keydir         *rangedIndex
+	activeKeydir   *KeyDir           // active-file key dir, use to generate hint-file
+	activeRanges   []*rangeTombstone // active-file range tombstones, use to generate hint-file
+	restoredRanges []*rangeTombstone // range tombstones found by restore
+	expireIndex    *ExpireIndex
+	activeFile     *ActiveFile
+	wg             sync.WaitGroup
+	rwMutex        sync.RWMutex // RWMutex for keydir and activeFile
+	hookMutex      sync.Mutex   // prevents merge removing files while expire hooks pending, hint files installed or files offloaded
+	dataFileCache  *DataFileCache
+	valueCache     *ValueCache // nil if disabled
+	isMerging      int32       // atomic
+	tier           *blobTier   // nil if tiering is disabled
+	isOffloading   int32       // atomic
+	offloadEnd     uint64      // atomic, last data file to be offloaded
+	minVlogId      uint64
+	maxVlogId      uint64
+	vlogFile       *ActiveFile // active value log, nil if key-value separation never used
+	vlogCache      *DataFileCache
+	isVlogGC       int32  // atomic
+	streamId       uint64 // atomic, last id of files values of SetReader are streamed into
+	seq            uint64 // last sequence number, requires rwMutex held
+	metrics        *metrics
+	degraded       error // cause of read-only state, requires rwMutex held
+	buckets        map[string]*Bucket
+	bucketIds      map[uint64]*Bucket
+	maxBucketId    uint64
+	sweepStop      chan struct{}
+	sweepDone      chan struct{}
+	checkpointStop chan struct{}
+	checkpointDone chan struct{}
 }
 
 func NewBeecask(options options, dirPath string) (*Beecask, error) {
 	bc := &Beecask{
 		options:       &options,
 		dirPath:       dirPath,
-		keydir:        NewKeyDir(),
+		keydir:        newRangedIndex(NewKeyDir()),
+		expireIndex:   NewExpireIndex(),
+		buckets:       make(map[string]*Bucket),
+		metrics:       newMetrics(),
+		bucketIds:     make(map[uint64]*Bucket),
 		minDataFileId: 0,
 		maxDataFileId: 0,
 		activeFile:    nil,
-		dataFileCache: NewDataFileCache(options.MaxOpenFiles),
 		isMerging:     0,
 	}
+	bc.logger = options.Logger
+	if bc.logger == nil {
+		bc.logger = YlogLogger{}
+	}
+	bc.fs = options.FS
+	if bc.fs == nil {
+		bc.fs = OSFS{}
+	}
+	bc.placement = newPlacement(bc.fs, dirPath, options.DataDirs, options.Placement, bc.logger)
+	bc.fileAccess = fileAccess{mode: options.FileAccess, readahead: options.ReadaheadSize}
+	bc.dataFileCache = NewDataFileCache(options.MaxOpenFiles, bc.fs, bc.fileAccess, bc.dataFilePath, bc.logger)
+	bc.vlogCache = NewDataFileCache(options.MaxOpenFiles, bc.fs, bc.fileAccess, bc.valueLogPath, bc.logger)
+	if options.ValueCacheSize > 0 {
+		bc.valueCache = NewValueCache(options.ValueCacheSize)
+	}
+	if options.BlobStore != nil {
+		bc.tier = newBlobTier(options.BlobStore, bc.fs, bc.fileAccess, options.BlobCacheLocal, bc.dataFilePath, bc.logger)
+		bc.dataFileCache.tier = bc.tier
+	}
 
 	err := bc.scan()
 	if err != nil {
-		ylog.Error(err)
+		bc.logger.Errorf("%s", err)
+		if hi, ok := bc.keydir.index.(*HashIndex); ok {
+			hi.Close(nil)
+		}
+		if bc.lock != nil {
+			bc.lock.Close()
+		}
 		return nil, err
 	}
 
+	// catch up with files left local by last run
+	bc.rwMutex.Lock()
+	bc.maybeOffload()
+	bc.rwMutex.Unlock()
+
+	if options.ExpireSweepInterval > 0 {
+		bc.sweepStop = make(chan struct{})
+		bc.sweepDone = make(chan struct{})
+		go bc.sweepExpired(options.ExpireSweepInterval, options.ExpireSweepLimit)
+	}
+	if options.CheckpointInterval > 0 && options.IndexMode != INDEX_MODE_HASH {
+		bc.checkpointStop = make(chan struct{})
+		bc.checkpointDone = make(chan struct{})
+		go bc.checkpointPeriodically(options.CheckpointInterval)
+	}
+
 	return bc, nil
 }
 
 func (bc *Beecask) Get(key string) ([]byte, error) {
+	return bc.GetBytes([]byte(key))
+}
+
+// GetBytes returns a copy of the value of key
+func (bc *Beecask) GetBytes(key []byte) ([]byte, error) {
+	return bc.GetInto(key, nil)
+}
+
+// GetInto appends the value of key to dst and returns the extended buffer
+func (bc *Beecask) GetInto(key []byte, dst []byte) ([]byte, error) {
+	err := bc.ViewValue(key, func(value []byte) error {
+		dst = append(dst, value...)
+		return nil
+	})
+	return dst, err
+}
+
+// GetWithOptions returns a copy of the value of key read by ro
+func (bc *Beecask) GetWithOptions(key string, ro ReadOptions) ([]byte, error) {
+	var dst []byte
+	err := bc.ViewValueWithOptions([]byte(key), ro, func(value []byte) error {
+		dst = append(dst, value...)
+		return nil
+	})
+	return dst, err
+}
+
+// ViewValue calls fn with the value of key. The value may refer to the mmaped
+// region of a data file or to value cache directly, so it is only valid
+// during fn and must not be modified. fn must not call write methods of bc.
+func (bc *Beecask) ViewValue(key []byte, fn func(value []byte) error) error {
+	return bc.ViewValueWithOptions(key, ReadOptions{}, fn)
+}
+
+// ViewValueWithOptions is ViewValue reading by ro
+func (bc *Beecask) ViewValueWithOptions(key []byte, ro ReadOptions, fn func(value []byte) error) (err error) {
+	defer bc.metrics.observe(OP_GET, time.Now(), &err)
+	for {
+		_, err = bc.view(key, ro, fn)
+		if err != errValueLogGone {
+			return err
+		}
+		// value has been moved by value log gc, read pointer again
+	}
+}
+
+// view calls fn with the value of key, and returns the version of key
+func (bc *Beecask) view(key []byte, ro ReadOptions, fn func(value []byte) error) (uint64, error) {
 	bc.rwMutex.RLock()
-	kdItem := bc.keydir.Get(key)
-	if kdItem == nil || (kdItem.flag&RECORD_FLAG_BIT_DELETE) > 0 {
-		// Record not exist or has been deleted
+	kdItem, ok := bc.keydir.Lookup(key)
+	if !ok || (kdItem.flag&RECORD_FLAG_BIT_DELETE) > 0 || kdItem.isExpired(time.Now().Unix()) {
+		// Record not exist, has been deleted or expired
 		bc.rwMutex.RUnlock()
-		return nil, ErrDataNotExist
+		return 0, ErrDataNotExist
 	}
 
-	var reader interface {
-		ReadRecordAt(int64) (*Record, error)
+	if kdItem.hasOperands() {
+		value, err := bc.fold(key, &kdItem)
+		bc.rwMutex.RUnlock()
+		if err != nil {
+			return 0, err
+		}
+		return kdItem.seq, fn(value)
 	}
+
+	// value is cached by location of the record, a rewrite of key moves it
+	fill := fn
+	if bc.valueCache != nil && !ro.NoCache {
+		if value, ok := bc.valueCache.Get(kdItem.fileId, kdItem.valuePos); ok {
+			bc.rwMutex.RUnlock()
+			return kdItem.seq, fn(value)
+		}
+		fill = func(value []byte) error {
+			bc.valueCache.Set(kdItem.fileId, kdItem.valuePos, value)
+			return fn(value)
+		}
+	}
+
+	var r Record
+	var err error
 	if kdItem.fileId == bc.activeFile.fileId {
-		ylog.Debug("data on active file.")
-		// Data on active file
-		reader = bc.activeFile
-		defer bc.rwMutex.RUnlock()
+		// Data on active file, record is read into a new buffer
+		err = bc.activeFile.ReadRecordInto(int64(kdItem.valuePos), &r)
+		bc.rwMutex.RUnlock()
 	} else {
-		ylog.Debug("data on data file.")
-		// Data on data file
-		path := getDataFilePath(bc.dirPath, kdItem.fileId)
-		entry, err := bc.dataFileCache.Ref(path, kdItem.fileId)
+		// Data on data file, hold a reference until fn returns
+		var entry *CacheEntry
+		entry, err = bc.dataFileCache.Ref(kdItem.fileId)
 		bc.rwMutex.RUnlock()
 		if err != nil {
-			ylog.Errorf("Ref datafile[%d] failed, err=%s", kdItem.fileId, err)
-			return nil, err
+			bc.logger.Errorf("Ref datafile[%d] failed, err=%s", kdItem.fileId, err)
+			return 0, err
 		}
 		defer bc.dataFileCache.Unref(entry)
-		reader = entry.df
+		err = entry.df.ReadRecordInto(int64(kdItem.valuePos), &r)
 	}
-
-	r, err := reader.ReadRecordAt(int64(kdItem.valuePos))
 	if err != nil {
-		ylog.Errorf("Read record at datafile[%d] @ [%d] failed, err=%s", kdItem.fileId, kdItem.valuePos, err)
-		return nil, err
+		bc.logger.Errorf("Read record at datafile[%d] @ [%d] failed, err=%s", kdItem.fileId, kdItem.valuePos, err)
+		return 0, err
 	}
 
 	// check data valid
-	if string(r.key) != key {
-		ylog.Errorf("Record[%s] is not expected %s in datafile[%d] @ [%d]",
-			string(r.key), key, kdItem.fileId, kdItem.valuePos)
-		return nil, ErrDataCorruption
+	if !bytes.Equal(r.key, key) {
+		bc.logger.Errorf("Record[%s] is not expected %s in datafile[%d] @ [%d]",
+			string(r.key), string(key), kdItem.fileId, kdItem.valuePos)
+		return 0, ErrDataCorruption
+	}
+
+	if (r.flag & RECORD_FLAG_BIT_VALUE_POINTER) > 0 {
+		ptr, err := decodeValuePointer(r.value)
+		if err != nil {
+			return 0, err
+		}
+		return kdItem.seq, bc.viewValueLog(key, ptr, fill)
 	}
+	return kdItem.seq, fill(r.value)
+}
 
-	// check data expiration
-	ylog.Debugf("Record[%s] expiration[%d]", key, r.expiration)
-	if r.expiration > 0 && r.expiration <= time.Now().Unix() {
-		return nil, ErrDataNotExist
+// GetWithVersion returns a copy of the value of key and its version
+func (bc *Beecask) GetWithVersion(key string) (value []byte, version uint64, err error) {
+	defer bc.metrics.observe(OP_GET, time.Now(), &err)
+	for {
+		value = nil
+		version, err = bc.view([]byte(key), ReadOptions{}, func(v []byte) error {
+			value = append(value, v...)
+			return nil
+		})
+		if err != errValueLogGone {
+			return value, version, err
+		}
 	}
+}
 
-	return r.value, nil
+// GetReader returns a reader streaming the value of key and the value size.
+// The data file is kept open until the reader is closed, and crc is verified
+// when the whole value has been read.
+func (bc *Beecask) GetReader(key string) (rc io.ReadCloser, size int64, err error) {
+	defer bc.metrics.observe(OP_GET, time.Now(), &err)
+	for {
+		rc, size, err = bc.getReader(key)
+		if err == nil {
+			if vr, ok := rc.(*valueReader); ok && (vr.flag&RECORD_FLAG_BIT_VALUE_POINTER) > 0 {
+				// value is in value log
+				buff, err := io.ReadAll(vr)
+				vr.Close()
+				if err != nil {
+					return nil, 0, err
+				}
+				ptr, err := decodeValuePointer(buff)
+				if err != nil {
+					return nil, 0, err
+				}
+				rc, size, err = bc.getValueLogReader(key, ptr)
+			}
+		}
+		if err != errValueLogGone {
+			return rc, size, err
+		}
+	}
+}
+
+func (bc *Beecask) getReader(key string) (io.ReadCloser, int64, error) {
+	bc.rwMutex.RLock()
+	kdItem, ok := bc.keydir.Lookup([]byte(key))
+	if !ok || (kdItem.flag&RECORD_FLAG_BIT_DELETE) > 0 || kdItem.isExpired(time.Now().Unix()) {
+		bc.rwMutex.RUnlock()
+		return nil, 0, ErrDataNotExist
+	}
+
+	if kdItem.hasOperands() {
+		defer bc.rwMutex.RUnlock()
+		return bc.foldedReader(key, &kdItem)
+	}
+
+	if kdItem.fileId == bc.activeFile.fileId {
+		bc.rwMutex.RUnlock()
+		return bc.getActiveFileReader(key)
+	}
+
+	entry, err := bc.dataFileCache.Ref(kdItem.fileId)
+	bc.rwMutex.RUnlock()
+	if err != nil {
+		bc.logger.Errorf("Ref datafile[%d] failed, err=%s", kdItem.fileId, err)
+		return nil, 0, err
+	}
+	return bc.newDataFileReader(entry, key, &kdItem)
+}
+
+// newDataFileReader streams the value of key from a referenced data file,
+// the reference is released when the reader is closed
+func (bc *Beecask) newDataFileReader(entry *CacheEntry, key string, kdItem *KDItem) (io.ReadCloser, int64, error) {
+	vr, size, err := newValueReader(randomAccessReader{entry.df.file}, int64(kdItem.valuePos), []byte(key), func() error {
+		bc.dataFileCache.Unref(entry)
+		return nil
+	})
+	if err != nil {
+		bc.logger.Errorf("Read record at datafile[%d] @ [%d] failed, err=%s", kdItem.fileId, kdItem.valuePos, err)
+		bc.dataFileCache.Unref(entry)
+		return nil, 0, err
+	}
+	return vr, size, nil
+}
+
+// foldedReader returns a reader of the folded value of key.
+// foldedReader requires bc.rwMutex held
+func (bc *Beecask) foldedReader(key string, kdItem *KDItem) (io.ReadCloser, int64, error) {
+	value, err := bc.fold([]byte(key), kdItem)
+	if err != nil {
+		return nil, 0, err
+	}
+	return io.NopCloser(bytes.NewReader(value)), int64(len(value)), nil
+}
+
+// getActiveFileReader streams the value of key on active file through
+// another file descriptor, so that writes are not blocked
+func (bc *Beecask) getActiveFileReader(key string) (io.ReadCloser, int64, error) {
+	bc.rwMutex.Lock()
+	defer bc.rwMutex.Unlock()
+
+	// active file may have been rotated, check again
+	kdItem, ok := bc.keydir.Lookup([]byte(key))
+	if !ok || (kdItem.flag&RECORD_FLAG_BIT_DELETE) > 0 || kdItem.isExpired(time.Now().Unix()) {
+		return nil, 0, ErrDataNotExist
+	}
+	if kdItem.hasOperands() {
+		return bc.foldedReader(key, &kdItem)
+	}
+
+	var f File
+	var err error
+	if kdItem.fileId == bc.activeFile.fileId {
+		if err = bc.activeFile.Flush(); err == nil {
+			f, err = bc.fs.Open(bc.dataFilePath(kdItem.fileId))
+		}
+	} else {
+		var entry *CacheEntry
+		if entry, err = bc.dataFileCache.Ref(kdItem.fileId); err == nil {
+			return bc.newDataFileReader(entry, key, &kdItem)
+		}
+	}
+	if err != nil {
+		bc.logger.Errorf("Open datafile[%d] failed, err=%s", kdItem.fileId, err)
+		return nil, 0, err
+	}
+	vr, size, err := newValueReader(f, int64(kdItem.valuePos), []byte(key), f.Close)
+	if err != nil {
+		bc.logger.Errorf("Read record at datafile[%d] @ [%d] failed, err=%s", kdItem.fileId, kdItem.valuePos, err)
+		f.Close()
+		return nil, 0, err
+	}
+	return vr, size, nil
 }
 
 // Set sets a record(key, value) without expiration
@@ -113,17 +395,213 @@ func (bc *Beecask) Set(key string, value []byte) error {
 
 // SetWithExpiration sets a record(key, value) with expiration
 func (bc *Beecask) SetWithExpiration(key string, value []byte, expiration int64) error {
-	return bc.set(key, value, false, expiration)
+	return bc.set([]byte(key), value, false, expiration)
+}
+
+// SetBytes sets a record(key, value) without expiration
+func (bc *Beecask) SetBytes(key []byte, value []byte) error {
+	return bc.set(key, value, false, 0)
+}
+
+// SetWithTTL sets a record(key, value) which expires after ttl,
+// a non-positive ttl means no expiration
+func (bc *Beecask) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	return bc.SetWithExpiration(key, value, expirationAfter(ttl))
+}
+
+// CompareAndSwap sets value of key only if the current version of key equals
+// version, zero version means key must not exist. The expiration of key is
+// kept. It returns the new version, or ErrVersionMismatch if key has been changed.
+func (bc *Beecask) CompareAndSwap(key string, version uint64, value []byte) (uint64, error) {
+	return bc.setIfVersion([]byte(key), value, false, version)
+}
+
+// SetIfAbsent sets value of key only if key does not exist,
+// it returns the new version or ErrDataExist
+func (bc *Beecask) SetIfAbsent(key string, value []byte) (uint64, error) {
+	version, err := bc.setIfVersion([]byte(key), value, false, 0)
+	if err == ErrVersionMismatch {
+		return 0, ErrDataExist
+	}
+	return version, err
+}
+
+// DeleteIfVersion deletes key only if the current version of key equals version
+func (bc *Beecask) DeleteIfVersion(key string, version uint64) error {
+	if version == 0 {
+		return ErrInvalid
+	}
+	_, err := bc.setIfVersion([]byte(key), nil, true, version)
+	return err
+}
+
+// Append writes delta as an operand of key, operands are folded by
+// MergeOperator on read and compacted into a full value by merge.
+// A full value is written if key does not exist.
+func (bc *Beecask) Append(key string, delta []byte) (err error) {
+	defer bc.metrics.observe(OP_APPEND, time.Now(), &err)
+	if bc.options.MergeOperator == nil {
+		return ErrInvalid
+	}
+
+	bc.rwMutex.Lock()
+	defer bc.rwMutex.Unlock()
+
+	kdItem, ok := bc.keydir.Lookup([]byte(key))
+	if !ok || (kdItem.flag&RECORD_FLAG_BIT_DELETE) > 0 || kdItem.isExpired(time.Now().Unix()) {
+		value, err := bc.options.MergeOperator.Merge([]byte(key), nil, [][]byte{delta})
+		if err != nil {
+			return err
+		}
+		return bc.setRecord(newRecord([]byte(key), value, false, 0))
+	}
+
+	// operand keeps expiration of key
+	r := newRecord([]byte(key), delta, false, kdItem.expiration)
+	r.flag |= RECORD_FLAG_BIT_OPERAND
+	return bc.setRecord(r)
+}
+
+// Incr adds delta to the int64 value of key atomically and returns the
+// new value, key which does not exist is treated as zero
+func (bc *Beecask) Incr(key string, delta int64) (n int64, err error) {
+	defer bc.metrics.observe(OP_INCR, time.Now(), &err)
+	bc.rwMutex.Lock()
+	defer bc.rwMutex.Unlock()
+
+	var value []byte
+	var expiration int64
+	kdItem, ok := bc.keydir.Lookup([]byte(key))
+	if ok && (kdItem.flag&RECORD_FLAG_BIT_DELETE) == 0 && !kdItem.isExpired(time.Now().Unix()) {
+		if value, err = bc.valueOf([]byte(key), &kdItem); err != nil {
+			return 0, err
+		}
+		expiration = kdItem.expiration
+	}
+
+	if n, err = decodeInt64(value); err != nil {
+		return 0, err
+	}
+	n += delta
+	if err = bc.setRecord(newRecord([]byte(key), encodeInt64(n), false, expiration)); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Decr subtracts delta from the int64 value of key atomically
+func (bc *Beecask) Decr(key string, delta int64) (int64, error) {
+	return bc.Incr(key, -delta)
+}
+
+// SetReader sets a record(key, value) without expiration, size bytes of
+// value are read from r without holding the lock. A value larger than write
+// buffer is streamed into a value log file of its own.
+func (bc *Beecask) SetReader(key string, r io.Reader, size int64) (err error) {
+	defer bc.metrics.observe(OP_SET, time.Now(), &err)
+	if size < 0 || size > math.MaxUint32 {
+		return ErrInvalid
+	}
+
+	if size <= int64(bc.options.WriteBufferSize) {
+		value := make([]byte, size)
+		if _, err = io.ReadFull(r, value); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		bc.rwMutex.Lock()
+		defer bc.rwMutex.Unlock()
+		return bc.setRecord(newRecord([]byte(key), value, false, 0))
+	}
+
+	tmpPath, err := bc.streamValue(key, r, size)
+	if err != nil {
+		return err
+	}
+	bc.rwMutex.Lock()
+	defer bc.rwMutex.Unlock()
+	if err = bc.setStreamedValue(key, tmpPath, size); err != nil {
+		bc.fs.Remove(tmpPath)
+	}
+	return err
 }
 
 func (bc *Beecask) Delete(key string) error {
-	return bc.set(key, nil, true, 0)
+	return bc.set([]byte(key), nil, true, 0)
 }
 
+// TTL returns the remaining time to live of key, or NoExpiration
+// if the record never expires
+func (bc *Beecask) TTL(key string) (time.Duration, error) {
+	bc.rwMutex.RLock()
+	defer bc.rwMutex.RUnlock()
+
+	now := time.Now()
+	kdItem := bc.keydir.Get(key)
+	if kdItem == nil || (kdItem.flag&RECORD_FLAG_BIT_DELETE) > 0 || kdItem.isExpired(now.Unix()) {
+		return 0, ErrDataNotExist
+	}
+	if kdItem.expiration == 0 {
+		return NoExpiration, nil
+	}
+	return time.Unix(kdItem.expiration, 0).Sub(now), nil
+}
+
+// Expire sets key to expire after ttl
+func (bc *Beecask) Expire(key string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalid
+	}
+	return bc.Touch(key, expirationAfter(ttl))
+}
+
+// Persist removes the expiration of key
+func (bc *Beecask) Persist(key string) error {
+	return bc.Touch(key, 0)
+}
+
+// Touch updates the expiration of key without rewriting its value,
+// only a small touch record is appended to the active file
+func (bc *Beecask) Touch(key string, expiration int64) error {
+	bc.rwMutex.Lock()
+	defer bc.rwMutex.Unlock()
+
+	kdItem := bc.keydir.Get(key)
+	if kdItem == nil || (kdItem.flag&RECORD_FLAG_BIT_DELETE) > 0 || kdItem.isExpired(time.Now().Unix()) {
+		return ErrDataNotExist
+	}
+
+	return bc.setRecord(&Record{
+		flag:       RECORD_FLAG_BIT_TOUCH,
+		expiration: expiration,
+		keySize:    uint32(len(key)),
+		key:        []byte(key),
+	})
+}
+
+// Keys returns all keys which are neither deleted nor expired
 func (bc *Beecask) Keys() []string {
 	bc.rwMutex.RLock()
 	defer bc.rwMutex.RUnlock()
-	return bc.keydir.Keys()
+	return bc.keydir.Keys(time.Now().Unix())
+}
+
+// Count returns number of keys which are neither deleted nor expired
+func (bc *Beecask) Count() int {
+	bc.rwMutex.RLock()
+	defer bc.rwMutex.RUnlock()
+	return bc.keydir.Len() - bc.countExpired(time.Now().Unix())
+}
+
+// countExpired returns number of expired keys out of buckets which are
+// counted by key dir.
+// countExpired requires bc.rwMutex held
+func (bc *Beecask) countExpired(now int64) int {
+	return bc.expireIndex.CountExpired(now, func(key string) bool {
+		return isDefaultKey(key) && bc.keydir.visible(key)
+	})
 }
 
 func (bc *Beecask) Merge() {
@@ -133,49 +611,252 @@ func (bc *Beecask) Merge() {
 func (bc *Beecask) Sync() error {
 	bc.rwMutex.Lock()
 	defer bc.rwMutex.Unlock()
-	return bc.activeFile.Sync()
+	return bc.sync()
+}
+
+// sync makes records written so far durable.
+// sync requires bc.rwMutex held
+func (bc *Beecask) sync() error {
+	// values must be durable before pointers to them
+	if err := bc.syncValueLog(); err != nil {
+		bc.degrade(err)
+		return err
+	}
+	if err := bc.activeFile.Sync(); err != nil {
+		bc.degrade(err)
+		return err
+	}
+	return nil
 }
 
 func (bc *Beecask) Close() {
+	// stop sweeper and checkpointer before holding lock, they may be
+	// waiting for the lock
+	if bc.sweepStop != nil {
+		close(bc.sweepStop)
+		<-bc.sweepDone
+	}
+	if bc.checkpointStop != nil {
+		close(bc.checkpointStop)
+		<-bc.checkpointDone
+	}
+
 	bc.rwMutex.Lock()
 	defer bc.rwMutex.Unlock()
 
+	err := bc.sync()
+	if err != nil {
+		bc.logger.Errorf("Sync on close failed, err=%s", err)
+	} else if bc.degraded == nil {
+		bc.writeCheckpoint()
+	}
+	if hi, ok := bc.keydir.index.(*HashIndex); ok {
+		// records must be durable before the index is saved clean
+		var cp *hashIndexCheckpoint
+		if bc.degraded == nil {
+			bc.applyRanges()
+			cp = &hashIndexCheckpoint{
+				seq:          bc.seq,
+				maxBucketId:  bc.maxBucketId,
+				lastFileId:   bc.activeFile.fileId,
+				lastFileSize: bc.activeFile.Size(),
+			}
+		}
+		if err := hi.Close(cp); err != nil {
+			bc.logger.Errorf("Close hash index failed, err=%s", err)
+		}
+	}
+	if bc.vlogFile != nil {
+		bc.vlogFile.Close()
+	}
 	bc.activeFile.Close()
 	bc.dataFileCache.Close()
+	bc.vlogCache.Close()
+	// stop offload after the file being offloaded
+	atomic.StoreUint64(&bc.offloadEnd, 0)
 	bc.wg.Wait()
+	bc.lock.Close()
 }
 
 func (bc *Beecask) scan() error {
-	err := os.MkdirAll(bc.dirPath, 0755)
+	err := bc.fs.MkdirAll(bc.dirPath, 0755)
+	if err != nil {
+		bc.logger.Errorf("%s", err)
+		return err
+	}
+
+	bc.lock, err = bc.fs.Lock(getLockFilePath(bc.dirPath))
+	if err != nil {
+		bc.logger.Errorf("Lock %s failed, err=%s", bc.dirPath, err)
+		return err
+	}
+
+	dirs, err := bc.placement.load()
+	if err != nil {
+		bc.logger.Errorf("Load placement failed, err=%s", err)
+		return err
+	}
+	var dataFileIds []uint64
+	for _, dir := range dirs {
+		if dataFileIds, err = bc.scanDir(dir, dataFileIds); err != nil {
+			bc.logger.Errorf("%s", err)
+			return err
+		}
+	}
+	if err = bc.placement.commit(); err != nil {
+		return err
+	}
+
+	// restore data files in order, a touch record must be applied
+	// after the record it touches
+	sort.Slice(dataFileIds, func(i, j int) bool { return dataFileIds[i] < dataFileIds[j] })
+	// a data file is found twice if it is found in two dirs or beside its stub
+	n := 0
+	for i, fileId := range dataFileIds {
+		if i > 0 && fileId == dataFileIds[i-1] {
+			bc.dropLocalCopy(fileId)
+			continue
+		}
+		dataFileIds[n] = fileId
+		n++
+	}
+	dataFileIds = dataFileIds[:n]
+
+	restored, err := bc.openIndex()
 	if err != nil {
-		ylog.Error(err)
+		bc.logger.Errorf("Open index failed, err=%s", err)
 		return err
 	}
+	if !restored {
+		if err = bc.restoreAll(dataFileIds); err != nil {
+			return err
+		}
+	}
+
+	// open active file
+	if bc.maxDataFileId == 0 {
+		bc.minDataFileId++
+		bc.maxDataFileId++
+	} else if fi, err := bc.fs.Stat(bc.dataFilePath(bc.maxDataFileId)); err == nil && fi.Size() > 0 {
+		// records of last data file are not in active key dir, hint file
+		// generated by appending to it would miss them
+		bc.maxDataFileId++
+	} else if !bc.placement.configured(bc.maxDataFileId) {
+		// an empty one on a dir dropped from options would never be merged
+		bc.maxDataFileId++
+	}
+	fileId := bc.maxDataFileId
+
+	// Evict datafile from cache if exist to prevent opening active-file twice
+	bc.dataFileCache.Evict(fileId)
 
-	filenames, err := ReadDir(bc.dirPath)
+	bc.activeFile, err = bc.newActiveFile(fileId)
 	if err != nil {
-		ylog.Error(err)
+		bc.logger.Errorf("%s", err)
 		return err
 	}
+	// buffered records may reach the disk at any write, a pointer among
+	// them must not get there before the value it points to
+	bc.activeFile.beforeWrite = bc.syncValueLog
+	bc.activeKeydir = NewKeyDir()
+
+	// open value log if key-value separation is enabled or has been used
+	if bc.options.ValueThreshold > 0 || bc.maxVlogId > 0 {
+		// a crash may leave a torn record at the end of last value log,
+		// value log gc would never see values appended after it
+		if fi, err := bc.fs.Stat(bc.valueLogPath(bc.maxVlogId)); err == nil && fi.Size() > 0 {
+			bc.maxVlogId++
+		}
+		if err = bc.openValueLog(); err != nil {
+			bc.logger.Errorf("%s", err)
+			return err
+		}
+	}
+
+	bc.restoreRanges()
+	if err = bc.restoreBuckets(); err != nil {
+		bc.logger.Errorf("%s", err)
+		return err
+	}
+
+	// build expiration index
+	bc.keydir.ForEach(func(item *KDItem) bool {
+		return (item.expiration > 0 && (item.flag&RECORD_FLAG_BIT_DELETE) == 0) || item.seq == 0
+	}, func(key string, item *KDItem) bool {
+		if (item.flag & RECORD_FLAG_BIT_DELETE) == 0 {
+			bc.expireIndex.Set(key, item.expiration)
+		}
+		// records written before sequence numbers were introduced
+		if item.seq == 0 {
+			bc.seq++
+			item.seq = bc.seq
+			bc.keydir.Set(key, item)
+		}
+		return true
+	})
+	return nil
+}
+
+// scanDir finds data files in dir and appends their ids to dataFileIds,
+// value logs are only looked for in the database dir
+func (bc *Beecask) scanDir(dir string, dataFileIds []uint64) ([]uint64, error) {
+	filenames, err := bc.fs.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) && dir != bc.dirPath {
+			// a dir dropped from options whose files are all merged
+			return dataFileIds, nil
+		}
+		return nil, err
+	}
+
+	for _, name := range filenames {
+		// left by a crash while streaming a value or writing hint file
+		if strings.HasSuffix(name, TEMP_FILE_SUFFIX) {
+			bc.fs.Remove(path.Join(dir, name))
+			continue
+		}
+
+		// value log files are only needed to be found out
+		if strings.HasSuffix(name, ".vlog") && dir == bc.dirPath {
+			intFileId, err := strconv.Atoi(strings.TrimSuffix(name, ".vlog"))
+			if err != nil {
+				return nil, err
+			}
+			fileId := uint64(intFileId)
+			if bc.minVlogId == 0 || bc.minVlogId > fileId {
+				bc.minVlogId = fileId
+			}
+			if bc.maxVlogId < fileId {
+				bc.maxVlogId = fileId
+			}
+			continue
+		}
 
-	for _, name := range filenames {
-		// only scan data file
-		if !strings.HasSuffix(name, ".data") {
+		// only scan data file and stub of offloaded one
+		suffix := path.Ext(name)
+		if suffix != ".data" && suffix != ".blob" {
 			continue
 		}
 
-		intFileId, err := strconv.Atoi(strings.TrimSuffix(name, ".data"))
+		intFileId, err := strconv.Atoi(strings.TrimSuffix(name, suffix))
 		if err != nil {
-			ylog.Error(err)
-			return err
+			return nil, err
 		}
 		fileId := uint64(intFileId)
-
-		err = bc.restore(fileId)
-		if err != nil {
-			ylog.Error(err)
-			return err
+		if suffix == ".blob" {
+			if bc.tier == nil {
+				return nil, fmt.Errorf("Datafile[%d] is offloaded but no blob store is given", fileId)
+			}
+			size, err := readBlobStub(bc.fs, path.Join(dir, name))
+			if err != nil {
+				return nil, err
+			}
+			bc.tier.add(fileId, size)
+		}
+		if err = bc.placement.found(fileId, dir); err != nil {
+			return nil, err
 		}
+		dataFileIds = append(dataFileIds, fileId)
 
 		if bc.minDataFileId == 0 || bc.minDataFileId > fileId {
 			bc.minDataFileId = fileId
@@ -184,271 +865,918 @@ func (bc *Beecask) scan() error {
 			bc.maxDataFileId = fileId
 		}
 	}
+	return dataFileIds, nil
+}
 
-	// open active file
-	if bc.maxDataFileId == 0 {
-		bc.minDataFileId++
-		bc.maxDataFileId++
+// openIndex opens the hash index if it is enabled, it reports whether the
+// index is restored by its checkpoint, data files need not be restored then
+func (bc *Beecask) openIndex() (bool, error) {
+	indexPath := getIndexFilePath(bc.dirPath)
+	if bc.options.IndexMode != INDEX_MODE_HASH {
+		// an index left by hash mode would be stale at next open
+		if err := bc.fs.Remove(indexPath); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		return false, nil
+	}
+	// so would a checkpoint left by memory mode
+	if err := bc.removeCheckpoint(); err != nil {
+		return false, err
 	}
-	fileId := bc.maxDataFileId
 
-	// Evict datafile from cache if exist to prevent opening active-file twice
-	bc.dataFileCache.Evict(fileId)
+	hi, cp, err := openHashIndex(bc.fs, indexPath, bc.readKey, bc.logger)
+	if err != nil {
+		return false, err
+	}
+	bc.keydir.index = hi
+	if cp == nil {
+		return false, nil
+	}
+	if cp.lastFileId == bc.maxDataFileId {
+		fi, err := bc.fs.Stat(bc.dataFilePath(cp.lastFileId))
+		if err == nil && fi.Size() == cp.lastFileSize {
+			bc.seq = cp.seq
+			bc.maxBucketId = cp.maxBucketId
+			bc.logger.Infof("restore from hash index succ.")
+			return true, nil
+		}
+	}
+	bc.logger.Infof("Rebuild hash index, data files changed since it was saved")
+	return false, hi.Reset()
+}
 
-	path := getDataFilePath(bc.dirPath, fileId)
-	bc.activeFile, err = NewActiveFile(path, fileId, bc.options.WriteBufferSize)
+// readKey reads the key of the record at valuePos of data file fileId,
+// HashIndex keeps no keys
+func (bc *Beecask) readKey(fileId uint64, valuePos uint32) (string, error) {
+	if bc.activeFile != nil && fileId == bc.activeFile.fileId {
+		key, err := bc.activeFile.ReadKeyAt(int64(valuePos))
+		return string(key), err
+	}
+	entry, err := bc.dataFileCache.Ref(fileId)
 	if err != nil {
-		ylog.Error(err)
-		return err
+		return "", err
+	}
+	defer bc.dataFileCache.Unref(entry)
+	// key may refer to the mmaped region, copy it before Unref
+	key, err := entry.df.ReadKeyAt(int64(valuePos))
+	return string(key), err
+}
+
+// restoreAll restores data files after the position of checkpoint if it is
+// valid, otherwise all of them
+func (bc *Beecask) restoreAll(dataFileIds []uint64) error {
+	var cp *keydirCheckpoint
+	if bc.options.IndexMode != INDEX_MODE_HASH {
+		cp = bc.loadCheckpoint(dataFileIds)
+	}
+	for _, fileId := range dataFileIds {
+		var err error
+		switch {
+		case cp == nil || fileId > cp.fileId:
+			err = bc.restore(fileId)
+		case fileId == cp.fileId && cp.fileSize > cp.offset:
+			// records appended after checkpoint was written
+			err = bc.restoreFromDataFile(fileId, cp.offset)
+		}
+		if err != nil {
+			bc.logger.Errorf("%s", err)
+			return err
+		}
 	}
-	bc.activeKeydir = NewKeyDir()
 	return nil
 }
 
 func (bc *Beecask) restore(fileId uint64) (err error) {
 	// try to restore data from hint file
-	hintfilename := getHintFilePath(bc.dirPath, fileId)
-	_, err = os.Stat(hintfilename)
+	hintfilename := bc.hintFilePath(fileId)
+	_, err = bc.fs.Stat(hintfilename)
 	if err == nil || os.IsExist(err) {
 		// restore from hint file
 		err = bc.restoreFromHintFile(fileId)
 		if err == nil {
-			ylog.Infof("restore from hintfile[%d] succ.", fileId)
+			bc.logger.Infof("restore from hintfile[%d] succ.", fileId)
 			return
 		}
-		ylog.Errorf("restore from hintfile[%d] failed, err=%s.", fileId, err)
+		bc.logger.Errorf("restore from hintfile[%d] failed, err=%s.", fileId, err)
 	}
 
 	// restore from data file
-	err = bc.restoreFromDataFile(fileId)
+	err = bc.restoreFromDataFile(fileId, 0)
 	if err != nil {
-		ylog.Errorf("restore from datafile[%d] failed, err=%s.", fileId, err)
+		bc.logger.Errorf("restore from datafile[%d] failed, err=%s.", fileId, err)
 		return
 	}
-	ylog.Infof("restore from datafile[%d] succ.", fileId)
+	bc.logger.Infof("restore from datafile[%d] succ.", fileId)
 	return
 }
 
 func (bc *Beecask) restoreFromHintFile(fileId uint64) error {
-	path := getHintFilePath(bc.dirPath, fileId)
-	rhf, err := NewReadableHintFile(path)
+	path := bc.hintFilePath(fileId)
+	rhf, err := NewReadableHintFile(bc.fs, path, bc.fileAccess)
 	if err != nil {
 		return err
 	}
 	defer rhf.Close()
 	item := &KDItem{}
 	err = rhf.ForEachItem(func(hitem *HintItem) error {
+		if hitem.seq > bc.seq {
+			bc.seq = hitem.seq
+		}
 		key := string(hitem.key)
 		kdItem := bc.keydir.Get(key)
 
+		if (hitem.flag & RECORD_FLAG_BIT_TOUCH) > 0 {
+			// hint file keeps a touch item only if the touched record
+			// lives in an older data file
+			if kdItem != nil && kdItem.fileId < fileId && (kdItem.flag&RECORD_FLAG_BIT_DELETE) == 0 {
+				kdItem.expiration = hitem.expiration
+				kdItem.seq = hitem.seq
+				bc.keydir.Set(key, kdItem)
+			}
+			return nil
+		}
+
+		if (hitem.flag & RECORD_FLAG_BIT_OPERAND) > 0 {
+			bc.restoreOperand(key, kdItem, fileId, hitem.valuePos, hitem.expiration, hitem.seq)
+			return nil
+		}
+
+		if (hitem.flag & RECORD_FLAG_BIT_RANGE_DELETE) > 0 {
+			// end of range is only kept in data file
+			t, err := bc.readRangeTombstone(fileId, hitem.valuePos)
+			if err != nil {
+				return err
+			}
+			bc.restoreRange(t)
+			return nil
+		}
+
 		// fileter old data
 		//if kdItem == nil || absInt64(kdItem.version) < absInt64(hitem.version) {
 		if kdItem == nil || fileId > kdItem.fileId || (fileId == kdItem.fileId && hitem.valuePos > kdItem.valuePos) {
 			item.fileId = fileId
 			item.valueSize = hitem.valueSize
 			item.valuePos = hitem.valuePos
+			item.flag = hitem.flag
+			item.expiration = hitem.expiration
+			item.seq = hitem.seq
 			bc.keydir.Set(key, item)
 		}
 		return nil
 	})
 	if err != nil {
-		ylog.Error(err)
+		bc.logger.Errorf("%s", err)
 	}
 	return err
 }
 
-func (bc *Beecask) restoreFromDataFile(fileId uint64) error {
-	path := getDataFilePath(bc.dirPath, fileId)
-	entry, err := bc.dataFileCache.Ref(path, fileId)
+// restoreFromDataFile restores records of data file fileId from offset
+func (bc *Beecask) restoreFromDataFile(fileId uint64, offset int64) error {
+	entry, err := bc.dataFileCache.Ref(fileId)
 	if err != nil {
-		ylog.Errorf("Ref datafile[%d] failed, err=%s.", fileId, err)
+		bc.logger.Errorf("Ref datafile[%d] failed, err=%s.", fileId, err)
 		return err
 	}
 	defer bc.dataFileCache.Unref(entry)
 	item := &KDItem{}
-	err = entry.df.ForEachRecord(func(r *Record, fileId uint64, offset int64) error {
+	err = entry.df.ForEachRecordFrom(offset, func(r *Record, fileId uint64, offset int64) error {
+		if r.seq > bc.seq {
+			bc.seq = r.seq
+		}
 		key := string(r.key)
 		kdItem := bc.keydir.Get(key)
 
+		if (r.flag & RECORD_FLAG_BIT_TOUCH) > 0 {
+			if kdItem != nil && (kdItem.flag&RECORD_FLAG_BIT_DELETE) == 0 &&
+				(fileId > kdItem.fileId || (fileId == kdItem.fileId && uint32(offset) > kdItem.valuePos)) {
+				kdItem.expiration = r.expiration
+				kdItem.seq = r.seq
+				bc.keydir.Set(key, kdItem)
+			}
+			return nil
+		}
+
+		if (r.flag & RECORD_FLAG_BIT_OPERAND) > 0 {
+			bc.restoreOperand(key, kdItem, fileId, uint32(offset), r.expiration, r.seq)
+			return nil
+		}
+
+		if (r.flag & RECORD_FLAG_BIT_RANGE_DELETE) > 0 {
+			bc.restoreRange(&rangeTombstone{
+				fileId:   fileId,
+				valuePos: uint32(offset),
+				flag:     r.flag,
+				seq:      r.seq,
+				start:    append([]byte(nil), r.key...),
+				end:      append([]byte(nil), r.value...),
+			})
+			return nil
+		}
+
 		// filter old data
 		if kdItem == nil || fileId > kdItem.fileId || (fileId == kdItem.fileId && uint32(offset) > kdItem.valuePos) {
 			item.fileId = entry.df.fileId
 			item.valuePos = uint32(offset)
 			item.valueSize = r.valueSize
 			item.flag = r.flag
+			item.expiration = r.expiration
+			item.seq = r.seq
 			bc.keydir.Set(key, item)
 		}
 		return nil
 	})
 	if err != nil {
-		ylog.Error(err)
+		bc.logger.Errorf("%s", err)
 	}
 	return err
 }
 
-func (bc *Beecask) set(key string, value []byte, delete bool, expiration int64) error {
+// restoreOperand appends an operand record to kdItem if it is newer than
+// all records of kdItem. Operands are only written for existing keys.
+func (bc *Beecask) restoreOperand(key string, kdItem *KDItem, fileId uint64, valuePos uint32, expiration int64, seq uint64) {
+	if kdItem == nil || (kdItem.flag&RECORD_FLAG_BIT_DELETE) > 0 {
+		return
+	}
+	last := operandRef{fileId: kdItem.fileId, valuePos: kdItem.valuePos}
+	if kdItem.hasOperands() {
+		last = kdItem.operands[len(kdItem.operands)-1]
+	}
+	if fileId > last.fileId || (fileId == last.fileId && valuePos > last.valuePos) {
+		kdItem.appendOperand(fileId, valuePos)
+		kdItem.expiration = expiration
+		kdItem.seq = seq
+		bc.keydir.Set(key, kdItem)
+	}
+}
+
+func (bc *Beecask) set(key []byte, value []byte, delete bool, expiration int64) (err error) {
+	defer bc.metrics.observe(writeOp(delete), time.Now(), &err)
 	// TODO: Check key and value size
 	bc.rwMutex.Lock()
 	defer bc.rwMutex.Unlock()
 
-	item := &Record{
-		crc:        0,
-		flag:       0,
-		expiration: expiration,
-		keySize:    uint32(len(key)),
-		valueSize:  uint32(len(value)),
-		key:        []byte(key),
-		value:      value,
-	}
+	return bc.setRecord(newRecord(key, value, delete, expiration))
+}
+
+// setIfVersion sets a record only if current version of key equals version
+// and returns the new version
+func (bc *Beecask) setIfVersion(key []byte, value []byte, delete bool, version uint64) (seq uint64, err error) {
+	defer bc.metrics.observe(writeOp(delete), time.Now(), &err)
+	bc.rwMutex.Lock()
+	defer bc.rwMutex.Unlock()
 
-	if delete {
-		item.flag |= RECORD_FLAG_BIT_DELETE
+	if bc.versionOf(key) != version {
+		return 0, ErrVersionMismatch
+	}
+	// new value keeps expiration of key as Incr does
+	var expiration int64
+	if version != 0 && !delete {
+		kdItem, _ := bc.keydir.Lookup(key)
+		expiration = kdItem.expiration
+	}
+	r := newRecord(key, value, delete, expiration)
+	if err = bc.setRecord(r); err != nil {
+		return 0, err
 	}
+	return r.seq, nil
+}
 
-	return bc.setRecord(item)
+// versionOf returns version of key, zero if key does not exist.
+// versionOf requires bc.rwMutex held
+func (bc *Beecask) versionOf(key []byte) uint64 {
+	kdItem, ok := bc.keydir.Lookup(key)
+	if !ok || (kdItem.flag&RECORD_FLAG_BIT_DELETE) > 0 || kdItem.isExpired(time.Now().Unix()) {
+		return 0
+	}
+	return kdItem.seq
 }
 
 // setRecord requires bc.rwMutex held
 func (bc *Beecask) setRecord(r *Record) (err error) {
+	if err = bc.prepareRecord(r); err != nil {
+		return err
+	}
+
 	// rotate active file
 	if bc.activeFile.Size()+r.Size() >= bc.options.MaxFileSize {
-		bc.rotateActiveFile()
+		if err = bc.rotateActiveFile(); err != nil {
+			bc.degrade(err)
+			return err
+		}
 	}
 
 	// write record to active file
-	offset, err := bc.activeFile.WriteRecord(r)
+	var offset int64
+	offset, err = bc.activeFile.WriteRecord(r)
 	if err != nil {
-		ylog.Fatalf("Write record to activefile failed, err=%s", err)
+		bc.logger.Errorf("Write record to activefile failed, err=%s", err)
+		bc.degrade(err)
+		return err
+	}
+
+	bc.updateKeyDir(r, offset)
+	return nil
+}
+
+// prepareRecord assigns sequence number to r and moves its value to value log
+// if needed, it must be called before r is written to active file.
+// prepareRecord requires bc.rwMutex held
+func (bc *Beecask) prepareRecord(r *Record) error {
+	if bc.degraded != nil {
+		return ErrDegraded
+	}
+	if err := bc.checkBucket(r); err != nil {
+		return err
+	}
+
+	// records rewritten by merge keep their sequence number
+	if r.seq == 0 {
+		bc.seq++
+		r.seq = bc.seq
+	}
+	r.flag |= RECORD_FLAG_BIT_SEQ
+
+	// key-value separation
+	if bc.shouldSeparate(r) {
+		return bc.separateValue(r)
 	}
+	return nil
+}
 
-	// update key dir
+// updateKeyDir updates key dirs after r is written at offset of active file.
+// updateKeyDir requires bc.rwMutex held
+func (bc *Beecask) updateKeyDir(r *Record, offset int64) {
 	kdItem := &KDItem{
-		fileId:    bc.activeFile.FileId(),
-		valuePos:  uint32(offset),
-		valueSize: r.valueSize,
-		flag:      r.flag,
+		fileId:     bc.activeFile.FileId(),
+		valuePos:   uint32(offset),
+		valueSize:  r.valueSize,
+		flag:       r.flag,
+		expiration: r.expiration,
+		seq:        r.seq,
 	}
 
 	key := string(r.key)
+	if (r.flag & RECORD_FLAG_BIT_TOUCH) > 0 {
+		bc.touchKeyDir(key, kdItem)
+		return
+	}
+	if (r.flag & RECORD_FLAG_BIT_OPERAND) > 0 {
+		bc.operandKeyDir(key, kdItem)
+		return
+	}
+	if (r.flag & RECORD_FLAG_BIT_RANGE_DELETE) > 0 {
+		bc.rangeKeyDir(&rangeTombstone{
+			fileId:   kdItem.fileId,
+			valuePos: kdItem.valuePos,
+			flag:     r.flag,
+			seq:      r.seq,
+			start:    r.key,
+			end:      r.value,
+		})
+		return
+	}
 	bc.keydir.Set(key, kdItem)
 	bc.activeKeydir.Set(key, kdItem)
+	bc.expireIndex.Set(key, kdItem.expiration)
+}
+
+// writeBatch writes records atomically, they are wrapped in one batch record
+// so that a torn batch fails the crc check as a whole.
+// writeBatch requires bc.rwMutex held
+func (bc *Beecask) writeBatch(records []*Record) (err error) {
+	for _, r := range records {
+		if err = bc.prepareRecord(r); err != nil {
+			return err
+		}
+	}
+
+	var value []byte
+	for _, r := range records {
+		value = append(value, r.Encode()...)
+	}
+	batch := &Record{
+		flag:      RECORD_FLAG_BIT_BATCH,
+		valueSize: uint32(len(value)),
+		value:     value,
+	}
+
+	// rotate active file
+	if bc.activeFile.Size()+batch.Size() >= bc.options.MaxFileSize {
+		if err = bc.rotateActiveFile(); err != nil {
+			bc.degrade(err)
+			return err
+		}
+	}
+
+	offset, err := bc.activeFile.WriteRecord(batch)
+	if err != nil {
+		bc.logger.Errorf("Write batch to activefile failed, err=%s", err)
+		bc.degrade(err)
+		return err
+	}
 
+	offset += batch.HeaderSize()
+	for _, r := range records {
+		bc.updateKeyDir(r, offset)
+		offset += r.Size()
+	}
 	return nil
 }
 
+// touchKeyDir applies a touch record to key dirs, the touched record
+// stays where it is and only its expiration changes.
+// touchKeyDir requires bc.rwMutex held
+func (bc *Beecask) touchKeyDir(key string, touch *KDItem) {
+	if item := bc.keydir.Get(key); item != nil {
+		item.expiration = touch.expiration
+		item.seq = touch.seq
+		bc.keydir.Set(key, item)
+		bc.expireIndex.Set(key, item.expiration)
+	}
+
+	// keep the value location if the touched record is in active file,
+	// otherwise remember the touch itself for hint file
+	if item := bc.activeKeydir.Get(key); item != nil && (item.flag&RECORD_FLAG_BIT_TOUCH) == 0 {
+		item.expiration = touch.expiration
+		item.seq = touch.seq
+		touch = item
+	}
+	bc.activeKeydir.Set(key, touch)
+}
+
+// operandKeyDir appends an operand record to key dirs.
+// operandKeyDir requires bc.rwMutex held
+func (bc *Beecask) operandKeyDir(key string, op *KDItem) {
+	if item := bc.keydir.Get(key); item != nil {
+		item.appendOperand(op.fileId, op.valuePos)
+		item.seq = op.seq
+		bc.keydir.Set(key, item)
+	}
+
+	// hint file keeps the operands in active file only,
+	// the first of them is kept as an item with operand flag
+	if item := bc.activeKeydir.Get(key); item != nil && (item.flag&RECORD_FLAG_BIT_TOUCH) == 0 {
+		item.appendOperand(op.fileId, op.valuePos)
+		item.seq = op.seq
+		op = item
+	}
+	bc.activeKeydir.Set(key, op)
+}
+
+// rotateActiveFile opens a new active file before sealing the current one,
+// the current one stays active if it fails.
 // rotateActiveFile requires bc.rwMutex held
-func (bc *Beecask) rotateActiveFile() {
+func (bc *Beecask) rotateActiveFile() error {
+	// a sealed file is never synced by Sync
+	if err := bc.sync(); err != nil {
+		return err
+	}
+
+	fileId := bc.maxDataFileId + 1
+	activeFile, err := bc.newActiveFile(fileId)
+	if err != nil {
+		bc.logger.Errorf("New activefile[%d] failed, err=%s", fileId, err)
+		return err
+	}
+	activeFile.beforeWrite = bc.syncValueLog
+
 	bc.wg.Add(1)
 
 	// generate hint file in another goroutine
-	go bc.generateHintFile(bc.activeKeydir, bc.activeFile.FileId())
+	go bc.generateHintFile(bc.activeKeydir, bc.activeRanges, bc.activeFile.FileId())
 
 	bc.activeFile.Close()
-	bc.activeFile = nil
+	bc.activeFile = activeFile
+	bc.maxDataFileId = fileId
+	bc.activeKeydir = NewKeyDir()
+	bc.activeRanges = nil
 
-	bc.maxDataFileId++
-	fileId := bc.maxDataFileId
+	bc.logger.Infof("Rotato to new activefile[%d]", fileId)
+	bc.maybeOffload()
+	return nil
+}
 
-	bc.activeKeydir = NewKeyDir()
-	path := getDataFilePath(bc.dirPath, fileId)
-	var err error
-	bc.activeFile, err = NewActiveFile(path, fileId, bc.options.WriteBufferSize)
+// newActiveFile places data file fileId on a data dir unless it is there
+// already, and opens it
+func (bc *Beecask) newActiveFile(fileId uint64) (*ActiveFile, error) {
+	if err := bc.placement.place(fileId); err != nil {
+		return nil, err
+	}
+	activeFile, err := NewActiveFile(bc.fs, bc.dataFilePath(fileId), fileId, bc.options.WriteBufferSize)
 	if err != nil {
-		ylog.Fatalf("New activefile[%d] failed, err=%s", fileId, err)
+		bc.placement.remove(fileId)
+		return nil, err
 	}
-
-	ylog.Infof("Rotato to new activefile[%d]", fileId)
+	return activeFile, nil
 }
 
-func (bc *Beecask) generateHintFile(keydir *KeyDir, fileId uint64) {
+func (bc *Beecask) generateHintFile(keydir *KeyDir, ranges []*rangeTombstone, fileId uint64) {
 	defer bc.wg.Done()
 
-	path := getHintFilePath(bc.dirPath, fileId)
-	whf, err := NewWritableHintFile(path)
-	if err != nil {
-		ylog.Errorf("New writable hint-file[%d] failed, err=%s", fileId, err)
+	// hint file is written to a temporary file and renamed after synced,
+	// so that a crash never leaves a partial one
+	hintPath := bc.hintFilePath(fileId)
+	tmpPath := hintPath + TEMP_FILE_SUFFIX
+	if err := writeHintFile(bc.fs, bc.logger, tmpPath, keydir, ranges, fileId); err != nil {
+		bc.fs.Remove(tmpPath)
+		return
+	}
+
+	bc.hookMutex.Lock()
+	defer bc.hookMutex.Unlock()
+	// data file may have been removed by merge meanwhile
+	if !bc.dataFileExists(fileId) {
+		bc.fs.Remove(tmpPath)
 		return
 	}
+	if err := bc.fs.Rename(tmpPath, hintPath); err != nil {
+		bc.logger.Errorf("Rename hintfile[%d] failed, err=%s", fileId, err)
+		bc.fs.Remove(tmpPath)
+	}
+}
+
+// writeHintFile writes items of keydir and ranges of data file fileId to a
+// hint file at path
+func writeHintFile(fs FS, logger Logger, path string, keydir *KeyDir, ranges []*rangeTombstone, fileId uint64) error {
+	whf, err := NewWritableHintFile(fs, path)
+	if err != nil {
+		logger.Errorf("New writable hint-file[%d] failed, err=%s", fileId, err)
+		return err
+	}
 	defer whf.Close()
 
 	// TODO more effient
 	item := &HintItem{}
 	for k, v := range keydir.dict {
 		item.flag = v.flag
+		item.expiration = v.expiration
+		item.seq = v.seq
 		item.keySize = uint32(len(k))
 		item.valueSize = v.valueSize
 		item.valuePos = v.valuePos
 		item.key = []byte(k)
 		buff := item.Encode()
 		if err = whf.Append(buff); err != nil {
-			ylog.Errorf("Append data to hintfile[%d] failed, err = %s", fileId, err)
+			logger.Errorf("Append data to hintfile[%d] failed, err = %s", fileId, err)
+			return err
+		}
+
+		// operands follow the item in write order
+		for _, ref := range v.operands {
+			item.flag = RECORD_FLAG_BIT_OPERAND | RECORD_FLAG_BIT_SEQ
+			item.valueSize = 0
+			item.valuePos = ref.valuePos
+			if err = whf.Append(item.Encode()); err != nil {
+				logger.Errorf("Append data to hintfile[%d] failed, err = %s", fileId, err)
+				return err
+			}
+		}
+	}
+
+	for _, t := range ranges {
+		item.flag = t.flag
+		item.expiration = 0
+		item.seq = t.seq
+		item.keySize = uint32(len(t.start))
+		item.valueSize = uint32(len(t.end))
+		item.valuePos = t.valuePos
+		item.key = t.start
+		if err = whf.Append(item.Encode()); err != nil {
+			logger.Errorf("Append data to hintfile[%d] failed, err = %s", fileId, err)
+			return err
+		}
+	}
+
+	if err = whf.Sync(); err != nil {
+		logger.Errorf("Sync hintfile[%d] failed, err = %s", fileId, err)
+		return err
+	}
+	return nil
+}
+
+// readRecord reads the record at valuePos of data file into a new buffer.
+// readRecord requires bc.rwMutex held
+func (bc *Beecask) readRecord(fileId uint64, valuePos uint32) (*Record, error) {
+	// active file is not opened yet during restore
+	if bc.activeFile != nil && fileId == bc.activeFile.FileId() {
+		return bc.activeFile.ReadRecordAt(int64(valuePos))
+	}
+	entry, err := bc.dataFileCache.Ref(fileId)
+	if err != nil {
+		bc.logger.Errorf("Ref datafile[%d] failed, err=%s", fileId, err)
+		return nil, err
+	}
+	defer bc.dataFileCache.Unref(entry)
+	r, err := entry.df.ReadRecordAt(int64(valuePos))
+	if err != nil {
+		return nil, err
+	}
+	// record refers to mmaped region, which may be unmapped after Unref
+	r.key = append([]byte(nil), r.key...)
+	r.value = append([]byte(nil), r.value...)
+	return r, nil
+}
+
+// readRangeTombstone reads the range tombstone at valuePos of data file
+func (bc *Beecask) readRangeTombstone(fileId uint64, valuePos uint32) (*rangeTombstone, error) {
+	r, err := bc.readRecord(fileId, valuePos)
+	if err != nil {
+		return nil, err
+	}
+	if (r.flag & RECORD_FLAG_BIT_RANGE_DELETE) == 0 {
+		return nil, ErrDataCorruption
+	}
+	return &rangeTombstone{
+		fileId:   fileId,
+		valuePos: valuePos,
+		flag:     r.flag,
+		seq:      r.seq,
+		start:    r.key,
+		end:      r.value,
+	}, nil
+}
+
+func (bc *Beecask) dataFilePath(fileId uint64) string {
+	return getDataFilePath(bc.placement.dir(fileId), fileId)
+}
+
+func (bc *Beecask) hintFilePath(fileId uint64) string {
+	return getHintFilePath(bc.placement.dir(fileId), fileId)
+}
+
+// sweepExpired drops expired keys from key dir periodically until Close.
+// Record of dropped key will be reclaimed by merge.
+func (bc *Beecask) sweepExpired(interval time.Duration, limit int) {
+	defer close(bc.sweepDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bc.sweepStop:
+			return
+		case <-ticker.C:
+			n := bc.expireKeys(time.Now().Unix(), limit)
+			if n > 0 {
+				bc.logger.Tracef("Sweep %d expired keys", n)
+			}
+		}
+	}
+}
+
+type expiredRecord struct {
+	key    string
+	bucket string // bucket and key passed to hook
+	relKey string
+	kdItem *KDItem
+	record *Record     // set if record is on active file
+	entry  *CacheEntry // set if record is on data file
+	value  []byte      // set if value is folded from operands
+}
+
+// expireKeys drops at most limit keys expired at now from key dir,
+// and calls OnExpire hook on them
+func (bc *Beecask) expireKeys(now int64, limit int) int {
+	hook := bc.options.OnExpire
+	if hook == nil {
+		bc.rwMutex.Lock()
+		defer bc.rwMutex.Unlock()
+		return bc.expireIndex.PopExpired(now, limit, func(key string, expiration int64) {
+			bc.keydir.Delete(key)
+		})
+	}
+
+	// Merge must not remove data files until hooks are called,
+	// otherwise expired records would be lost if crash happens.
+	bc.hookMutex.Lock()
+	defer bc.hookMutex.Unlock()
+
+	var records []expiredRecord
+	bc.rwMutex.Lock()
+	bc.expireIndex.PopExpired(now, limit, func(key string, expiration int64) {
+		er := expiredRecord{key: key, kdItem: bc.keydir.Get(key)}
+		bc.keydir.Delete(key)
+		var ok bool
+		if er.kdItem == nil {
+			// deleted by a range tombstone
+			return
+		}
+		if er.bucket, er.relKey, ok = bc.splitKey(key); !ok {
+			return
+		}
+		var err error
+		if er.kdItem.hasOperands() {
+			if er.value, err = bc.fold([]byte(key), er.kdItem); err != nil {
+				bc.logger.Errorf("Fold expired record[%s] failed, err=%s", key, err)
+				return
+			}
+		} else if er.kdItem.fileId == bc.activeFile.FileId() {
+			er.record, err = bc.activeFile.ReadRecordAt(int64(er.kdItem.valuePos))
+		} else {
+			er.entry, err = bc.dataFileCache.Ref(er.kdItem.fileId)
+		}
+		if err != nil {
+			bc.logger.Errorf("Read expired record[%s] failed, err=%s", key, err)
 			return
 		}
+		records = append(records, er)
+	})
+	bc.rwMutex.Unlock()
+
+	for _, er := range records {
+		var err error
+		if er.entry != nil {
+			er.record, err = er.entry.df.ReadRecordAt(int64(er.kdItem.valuePos))
+		}
+		value := er.value
+		if err == nil && er.record != nil {
+			value, err = bc.resolveValue(er.record)
+		}
+		if err != nil {
+			bc.logger.Errorf("Read expired record[%s] failed, err=%s", er.key, err)
+		} else {
+			hook(er.bucket, er.relKey, value)
+		}
+		if er.entry != nil {
+			bc.dataFileCache.Unref(er.entry)
+		}
 	}
+	return len(records)
 }
 
 func (bc *Beecask) merge() {
 	// make sure only one merge running
 	if !atomic.CompareAndSwapInt32(&bc.isMerging, 0, 1) {
-		ylog.Info("There is a merge process running.")
+		bc.logger.Infof("There is a merge process running.")
 		return
 	}
 	defer atomic.CompareAndSwapInt32(&bc.isMerging, 1, 0)
-	ylog.Trace("Involke to merge()")
+	bc.logger.Tracef("Involke to merge()")
 
 	bc.rwMutex.Lock()
-	end := bc.activeFile.fileId
+	begin, end := bc.minDataFileId, bc.activeFile.fileId
 	bc.rwMutex.Unlock()
 
-	for begin := &bc.minDataFileId; *begin < end; *begin++ {
-		err := bc.mergeDataFile(*begin)
+	ms := MergeStats{Start: time.Now()}
+	defer func() {
+		ms.Duration = time.Since(ms.Start)
+		bc.metrics.addMerge(ms)
+	}()
+
+	for fileId := begin; fileId < end; fileId++ {
+		err := bc.mergeDataFile(fileId)
 		if err != nil {
-			ylog.Errorf("Merge datafile[%d] failed, err=%s", *begin, err)
-			return
+			bc.logger.Errorf("Merge datafile[%d] failed, err=%s", fileId, err)
+			ms.Err = err.Error()
+			break
 		}
+		bc.hookMutex.Lock()
+		bc.rwMutex.Lock()
+		bc.minDataFileId = fileId + 1
+		bc.rwMutex.Unlock()
+		bc.hookMutex.Unlock()
+		ms.Files++
+	}
+	// checkpoint refers to the merged files, replace it so that restore
+	// still uses it
+	if ms.Files > 0 {
+		bc.checkpoint()
 	}
 }
 
+// writeSeqMark writes a record which takes a new sequence number and is never
+// dropped by merge, so that sequence numbers of dropped records are not handed
+// out again after restart. A version read before must not match a key which is
+// deleted and set again.
+// writeSeqMark requires bc.rwMutex held
+func (bc *Beecask) writeSeqMark() error {
+	r := newRecord([]byte(SEQ_MARK_KEY), nil, false, 0)
+	r.flag |= RECORD_FLAG_BIT_BUCKET
+	return bc.setRecord(r)
+}
+
 // mergeDataFile requires bc.rwMutex held
 func (bc *Beecask) mergeDataFile(fileId uint64) error {
-	path := getDataFilePath(bc.dirPath, fileId)
-	entry, err := bc.dataFileCache.Ref(path, fileId)
+	path := bc.dataFilePath(fileId)
+	entry, err := bc.dataFileCache.Ref(fileId)
 	if err != nil {
-		ylog.Errorf("Ref datafile[%d] failed, err=%s", fileId, err)
+		bc.logger.Errorf("Ref datafile[%d] failed, err=%s", fileId, err)
 		return err
 	}
 	defer bc.dataFileCache.Unref(entry)
 
 	begin := time.Now()
+	dropped := false
 	err = entry.df.ForEachRecord(func(r *Record, fileId uint64, offset int64) error {
-		bc.rwMutex.Lock()
-		defer bc.rwMutex.Unlock()
 		key := string(r.key)
+		deleted, expired, hooked := false, false, false
+		var bucket, relKey string
+		var folded, value []byte
+		var err, ferr error
+
+		bc.rwMutex.Lock()
 		kdItem := bc.keydir.Get(key)
-		var err error
-		if kdItem != nil && fileId == kdItem.fileId && uint32(offset) == kdItem.valuePos {
-			// deleted or expired
-			if (r.flag&RECORD_FLAG_BIT_DELETE) > 0 || (r.expiration > 0 && r.expiration <= begin.Unix()) {
+		if (r.flag & RECORD_FLAG_BIT_RANGE_DELETE) > 0 {
+			// records it covers were in data files merged before
+			bc.keydir.dropRange(fileId, uint32(offset))
+			dropped = true
+		} else if kdItem == nil {
+			// an item covered by range tombstone is hidden but still there
+			bc.keydir.Delete(key)
+			bc.expireIndex.Delete(key)
+			dropped = true
+		} else if !kdItem.contains(fileId, uint32(offset)) {
+			dropped = true
+		} else {
+			deleted = (r.flag & RECORD_FLAG_BIT_DELETE) > 0
+			expired = !deleted && kdItem.isExpired(begin.Unix())
+			if deleted || expired {
+				bucket, relKey, hooked = bc.splitKey(key)
+			}
+			if hooked && expired && kdItem.hasOperands() && bc.options.OnExpire != nil {
+				if folded, ferr = bc.fold(r.key, kdItem); ferr != nil {
+					bc.logger.Errorf("Fold expired record[%s] failed, err=%s", key, ferr)
+				}
+			} else if hooked && expired && bc.options.OnExpire != nil {
+				// value log gc may drop the value once key is deleted
+				if value, ferr = bc.readValue(r); ferr != nil {
+					bc.logger.Errorf("Read expired record[%s] failed, err=%s", key, ferr)
+				}
+			}
+			if deleted || expired {
+				dropped = true
 				bc.keydir.Delete(key)
-				return nil
+				bc.expireIndex.Delete(key)
+			} else if kdItem.hasOperands() {
+				// compact the base record and operands into a full record
+				if folded, err = bc.fold(r.key, kdItem); err == nil {
+					nr := newRecord(r.key, folded, false, kdItem.expiration)
+					nr.seq = kdItem.seq
+					err = bc.setRecord(nr)
+				}
+				if err != nil {
+					bc.logger.Errorf("Compact operands of key[%s] failed, err=%s", key, err)
+				}
+			} else {
+				// expiration may have been changed by touch records
+				r.expiration = kdItem.expiration
+				r.seq = kdItem.seq
+				if err = bc.setRecord(r); err != nil {
+					bc.logger.Errorf("Set Record[key%s] failed, err=%s", key, err)
+				}
 			}
-			if err = bc.setRecord(r); err != nil {
-				ylog.Errorf("Set Record[key%s] failed, err=%s", key, err)
+		}
+		bc.rwMutex.Unlock()
+
+		// call hooks before data file is removed
+		if !hooked {
+			return err
+		}
+		if deleted && bc.options.OnEvict != nil {
+			bc.options.OnEvict(bucket, relKey)
+		}
+		if expired && bc.options.OnExpire != nil && ferr == nil {
+			if kdItem.hasOperands() {
+				value = folded
 			}
+			bc.options.OnExpire(bucket, relKey, value)
 		}
 		return err
 	})
 
 	if err != nil {
-		ylog.Errorf("Merge datafile[%d] failed, err=%s", fileId, err)
+		bc.logger.Errorf("Merge datafile[%d] failed, err=%s", fileId, err)
 		return err
 	}
+	if dropped {
+		bc.rwMutex.Lock()
+		err = bc.writeSeqMark()
+		bc.rwMutex.Unlock()
+		if err != nil {
+			bc.logger.Errorf("Write sequence mark before removing datafile[%d] failed, err=%s", fileId, err)
+			return err
+		}
+	}
 	end := time.Now()
 
+	// records moved out must be durable before the data file is removed
+	bc.rwMutex.Lock()
+	err = bc.sync()
+	bc.rwMutex.Unlock()
+	if err != nil {
+		bc.logger.Errorf("Sync before removing datafile[%d] failed, err=%s", fileId, err)
+		return err
+	}
+
 	// Remove data file and hint file
-	os.Remove(path)
-	os.Remove(getHintFilePath(bc.dirPath, fileId))
+	bc.hookMutex.Lock()
+	bc.fs.Remove(path)
+	bc.fs.Remove(bc.hintFilePath(fileId))
+	if bc.tier != nil {
+		bc.tier.remove(fileId, bc.blobStubPath(fileId))
+	}
+	bc.placement.remove(fileId)
+	bc.hookMutex.Unlock()
 
-	ylog.Tracef("Merge datafile[%d](filesize:%d) succ in %fs.", fileId, entry.df.fileId, end.Sub(begin).Seconds())
+	bc.logger.Tracef("Merge datafile[%d](filesize:%d) succ in %fs.", fileId, entry.df.fileId, end.Sub(begin).Seconds())
 	return nil
 }
@@ -0,0 +1,136 @@
+package beecask
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+const TEST_DIR = "/db"
+
+// testOptions returns options of a database on fs without background work
+func testOptions(fs FS) *options {
+	opts := NewOptions()
+	opts.FS = fs
+	opts.Logger = NopLogger{}
+	return opts
+}
+
+func openTest(t *testing.T, opts *options) *Beecask {
+	t.Helper()
+	bc, err := NewBeecask(*opts, TEST_DIR)
+	if err != nil {
+		t.Fatalf("open failed, err=%s", err)
+	}
+	return bc
+}
+
+// openDirTest opens the database in dir
+func openDirTest(t *testing.T, opts *options, dir string) *Beecask {
+	t.Helper()
+	bc, err := NewBeecask(*opts, dir)
+	if err != nil {
+		t.Fatalf("open failed, err=%s", err)
+	}
+	return bc
+}
+
+// crashTest drops unsynced data of fs and reopens the database
+func crashTest(t *testing.T, bc *Beecask, fs *FaultFS, opts *options) *Beecask {
+	t.Helper()
+	if err := fs.Crash(); err != nil {
+		t.Fatalf("crash failed, err=%s", err)
+	}
+	bc.Close()
+	return openTest(t, opts)
+}
+
+// rotateTest seals the active file, so that merge takes its records
+func rotateTest(t *testing.T, bc *Beecask) {
+	t.Helper()
+	bc.rwMutex.Lock()
+	defer bc.rwMutex.Unlock()
+	if err := bc.rotateActiveFile(); err != nil {
+		t.Fatalf("rotate failed, err=%s", err)
+	}
+}
+
+// mergeTest merges sealed data files and fails t if merge fails
+func mergeTest(t *testing.T, bc *Beecask) {
+	t.Helper()
+	bc.Merge()
+	merges := bc.Stats().Merges
+	if len(merges) == 0 || merges[len(merges)-1].Err != "" {
+		t.Fatalf("merge failed, stats=%+v", merges)
+	}
+}
+
+func expectValue(t *testing.T, bc *Beecask, key string, value string) {
+	t.Helper()
+	v, err := bc.Get(key)
+	if err != nil || string(v) != value {
+		t.Fatalf("key %q expects %q, got %q, err=%v", key, value, v, err)
+	}
+}
+
+func expectNotExist(t *testing.T, bc *Beecask, key string) {
+	t.Helper()
+	if v, err := bc.Get(key); err != ErrDataNotExist {
+		t.Fatalf("key %q expects not exist, got %q, err=%v", key, v, err)
+	}
+}
+
+// testValue returns size bytes of a letter picked by i
+func testValue(i, size int) []byte {
+	return bytes.Repeat([]byte{byte('a' + i%26)}, size)
+}
+
+// fillKeys sets keys k0 to k(n-1) to valueFn(i)
+func fillKeys(t *testing.T, bc *Beecask, n int, valueFn func(i int) []byte) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := bc.Set(fmt.Sprintf("k%d", i), valueFn(i)); err != nil {
+			t.Fatalf("set k%d failed, err=%s", i, err)
+		}
+	}
+}
+
+// checkKeys checks keys k0 to k(n-1) are valueFn(i), nil means not exist
+func checkKeys(t *testing.T, bc *Beecask, n int, valueFn func(i int) []byte, tag string) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("k%d", i)
+		expect := valueFn(i)
+		v, err := bc.Get(key)
+		if expect == nil {
+			if err != ErrDataNotExist {
+				t.Fatalf("%s: key %s expects not exist, got %q, err=%v", tag, key, v, err)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(v, expect) {
+			t.Fatalf("%s: key %s expects %q, got %q, err=%v", tag, key, expect, v, err)
+		}
+	}
+}
+
+// countFiles returns number of files in dir with suffix
+func countFiles(t *testing.T, fs FS, dir, suffix string) int {
+	t.Helper()
+	names, err := fs.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, name := range names {
+		if strings.HasSuffix(name, suffix) {
+			n++
+		}
+	}
+	return n
+}
@@ -1,101 +1,248 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
-	"math/rand"
+	"io"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/yplusplus/beecask"
+	"github.com/yplusplus/beecask/bench/ycsb"
 	"github.com/yplusplus/ylog"
 )
 
-var (
-	removeAll = os.RemoveAll
-)
-
 const (
-	benchDir    = "./bc_bench"
-	letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	benchDir = "./bc_bench"
 )
 
 var (
-	bc            *beecask.Beecask
-	keys          []string
+	dir           string
+	clean         bool
+	workloadName  string
+	distribution  string
+	records       int64
 	vsize         int
-	operationsNum int
+	operationsNum int64
+	duration      time.Duration
+	threads       int
+	readers       int
+	writers       int
+	mergeRuns     bool
+	mergeInterval time.Duration
+	jsonPath      string
+	seed          int64
+	valueCache    int64
+	pread         bool
+	dataDirs      string
+	blobDir       string
+	offloadAfter  int
+	bulkLoad      bool
 )
 
-func GenerateKeys() {
-	keys = make([]string, operationsNum)
-	for i := 0; i < operationsNum; i++ {
-		keys[i] = fmt.Sprintf("%9d", i)
-	}
+// OpResult is the latency summary of an operation type, in microseconds
+type OpResult struct {
+	Count  uint64  `json:"count"`
+	Errors uint64  `json:"errors"`
+	Mean   float64 `json:"mean_us"`
+	Min    float64 `json:"min_us"`
+	P50    float64 `json:"p50_us"`
+	P99    float64 `json:"p99_us"`
+	P999   float64 `json:"p999_us"`
+	Max    float64 `json:"max_us"`
 }
 
-func RandomSetBench(num int) {
-	value := make([]byte, vsize)
+type MergeResult struct {
+	Runs     int     `json:"runs"`
+	Duration float64 `json:"duration_s"` // total duration of merges
+}
+
+type Result struct {
+	Workload     string              `json:"workload"`
+	Distribution string              `json:"distribution"`
+	Records      int64               `json:"records"`
+	ValueSize    int                 `json:"value_size"`
+	Threads      int                 `json:"threads"`
+	Readers      int                 `json:"readers"`
+	Writers      int                 `json:"writers"`
+	LoadDuration float64             `json:"load_duration_s"`
+	Operations   uint64              `json:"operations"`
+	Duration     float64             `json:"duration_s"`
+	Throughput   float64             `json:"ops_per_s"`
+	Ops          map[string]OpResult `json:"ops"`
+	Merge        MergeResult         `json:"merge"`
+}
+
+// workerStats is owned by one worker goroutine
+type workerStats struct {
+	hists  [ycsb.OP_TYPE_COUNT]ycsb.Histogram
+	errors [ycsb.OP_TYPE_COUNT]uint64
+}
+
+func micros(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
+
+// load loads records by set, or by Set of driver if set is nil
+func load(driver *ycsb.Driver, set func(key string, value []byte) error) time.Duration {
 	begin := time.Now()
-	j := 0
-	for i := 0; i < num; i++ {
-		if err := bc.Set(keys[j], value); err != nil {
-			ylog.Fatalf("Set Record[key:%s] failed, err=%s", keys[j], err)
-		}
-		j++
-		if j == len(keys) {
-			j = 0
-		}
+	n := int64(threads + readers + writers)
+	var wg sync.WaitGroup
+	for i := int64(0); i < n; i++ {
+		wg.Add(1)
+		go func(i int64) {
+			defer wg.Done()
+			from, to := records*i/n, records*(i+1)/n
+			var err error
+			if set != nil {
+				err = driver.LoadWith(set, from, to, seed+i)
+			} else {
+				err = driver.Load(from, to, seed+i)
+			}
+			if err != nil {
+				ylog.Fatalf("Load records failed, err=%s", err)
+			}
+		}(i)
 	}
-	end := time.Now()
-	d := end.Sub(begin)
-	fmt.Printf("%d set operation[key: %dB, value: %dB] in %fs\n", num, len(keys[0]), vsize, d.Seconds())
-	fmt.Printf("average %f qps\n", float64(num)/d.Seconds())
-	writeMB := int64(num) * int64(vsize) / 1e6
-	fmt.Printf("average %f MB/s\n", float64(writeMB)/d.Seconds())
-	fmt.Printf("average %f micros/op\n", d.Seconds()*1e6/float64(num))
+	wg.Wait()
+	return time.Since(begin)
 }
 
-func RandomGetBench(num int) {
+// run runs operations until operationsNum operations are done or duration
+// elapses if it is positive
+func run(driver *ycsb.Driver) (*workerStats, uint64, time.Duration) {
+	var done int64
+	var deadline time.Time
+	if duration > 0 {
+		deadline = time.Now().Add(duration)
+	}
+	next := func() bool {
+		if duration > 0 {
+			return time.Now().Before(deadline)
+		}
+		return atomic.AddInt64(&done, 1) <= operationsNum
+	}
+
+	var roles []ycsb.Role
+	for i := 0; i < threads; i++ {
+		roles = append(roles, ycsb.ROLE_MIXED)
+	}
+	for i := 0; i < readers; i++ {
+		roles = append(roles, ycsb.ROLE_READ)
+	}
+	for i := 0; i < writers; i++ {
+		roles = append(roles, ycsb.ROLE_WRITE)
+	}
+
+	stats := make([]workerStats, len(roles))
+	var wg sync.WaitGroup
 	begin := time.Now()
-	for i := 0; i < num; i++ {
-		r := rand.Intn(len(keys))
-		if _, err := bc.Get(keys[r]); err != nil {
-			ylog.Fatalf("Get Record[key:%s] failed", keys[r])
+	for i, role := range roles {
+		wg.Add(1)
+		go func(i int, role ycsb.Role) {
+			defer wg.Done()
+			w := driver.NewWorker(role, seed+int64(i))
+			s := &stats[i]
+			for next() {
+				op := w.Next()
+				opBegin := time.Now()
+				err := w.Do(op)
+				s.hists[op].Record(time.Since(opBegin))
+				if err != nil {
+					s.errors[op]++
+				}
+			}
+		}(i, role)
+	}
+	wg.Wait()
+	elapsed := time.Since(begin)
+
+	total := &workerStats{}
+	var count uint64
+	for i := range stats {
+		for op := range stats[i].hists {
+			total.hists[op].Merge(&stats[i].hists[op])
+			total.errors[op] += stats[i].errors[op]
+			count += stats[i].hists[op].Count()
 		}
 	}
-	end := time.Now()
-	d := end.Sub(begin)
-	fmt.Printf("%d get operation in %fs\n", num, d.Seconds())
-	fmt.Printf("average %f qps\n", float64(num)/d.Seconds())
-	fmt.Printf("average %f micros/op\n", d.Seconds()*1e6/float64(num))
+	return total, count, elapsed
 }
 
-func RandomSetBenchWhenMerge() {
-	fmt.Println("RandomSetBenchWhenMerge:")
-	done := make(chan bool, 1)
-	go func() {
+// runMerges runs merge repeatedly until stop is closed, at least once
+func runMerges(bc *beecask.Beecask, stop chan struct{}, result *MergeResult) {
+	for {
+		begin := time.Now()
 		bc.Merge()
-		done <- true
-	}()
-	RandomSetBench(operationsNum)
-	<-done
+		result.Runs++
+		result.Duration += time.Since(begin).Seconds()
+		if mergeInterval <= 0 {
+			return
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(mergeInterval):
+		}
+	}
 }
 
-func RandomGetBenchWhenMerge() {
-	fmt.Println("RandomGetBenchWhenMerge:")
-	done := make(chan bool, 1)
-	go func() {
-		bc.Merge()
-		done <- true
-	}()
-	RandomGetBench(operationsNum)
-	<-done
+func report(w io.Writer, result *Result) {
+	fmt.Fprintf(w, "workload %s, distribution %s, %d records of %dB values\n",
+		result.Workload, result.Distribution, result.Records, result.ValueSize)
+	fmt.Fprintf(w, "%d mixed, %d reader, %d writer goroutines\n", result.Threads, result.Readers, result.Writers)
+	fmt.Fprintf(w, "load in %fs\n", result.LoadDuration)
+	fmt.Fprintf(w, "%d operations in %fs, %f ops/s\n", result.Operations, result.Duration, result.Throughput)
+	fmt.Fprintf(w, "%d merges in %fs\n", result.Merge.Runs, result.Merge.Duration)
+	fmt.Fprintf(w, "%-18s %10s %8s %10s %10s %10s %10s %10s\n", "op", "count", "errors", "mean(us)", "p50(us)", "p99(us)", "p999(us)", "max(us)")
+	for op := ycsb.OpType(0); op < ycsb.OP_TYPE_COUNT; op++ {
+		r, ok := result.Ops[op.String()]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(w, "%-18s %10d %8d %10.1f %10.1f %10.1f %10.1f %10.1f\n", op, r.Count, r.Errors, r.Mean, r.P50, r.P99, r.P999, r.Max)
+	}
+}
+
+func writeJSON(result *Result) error {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if jsonPath == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(jsonPath, data, 0644)
 }
 
 func init() {
+	flag.StringVar(&dir, "dir", benchDir, "database directory")
+	flag.BoolVar(&clean, "clean", false, "remove database directory first")
+	flag.StringVar(&workloadName, "workload", "a", "YCSB core workload, a to f")
+	flag.StringVar(&distribution, "distribution", "", "key distribution: uniform, zipfian or latest, default is the one of workload")
+	flag.Int64Var(&records, "records", 1e5, "records loaded before running")
 	flag.IntVar(&vsize, "value-size", 2048, "value size")
-	flag.IntVar(&operationsNum, "op-num", 1e5, "operations number")
+	flag.Int64Var(&operationsNum, "op-num", 1e5, "operations number")
+	flag.DurationVar(&duration, "duration", 0, "run for duration instead of op-num operations")
+	flag.IntVar(&threads, "threads", 1, "goroutines running all operations of workload")
+	flag.IntVar(&readers, "readers", 0, "goroutines running read operations of workload only")
+	flag.IntVar(&writers, "writers", 0, "goroutines running write operations of workload only")
+	flag.BoolVar(&mergeRuns, "merge", true, "run merge concurrently")
+	flag.DurationVar(&mergeInterval, "merge-interval", 0, "interval between merges, zero runs merge once")
+	flag.StringVar(&jsonPath, "json", "", "write results in JSON to file, - for stdout")
+	flag.Int64Var(&seed, "seed", 1, "random seed")
+	flag.Int64Var(&valueCache, "value-cache", 0, "bytes of value cache, zero disables it")
+	flag.BoolVar(&pread, "pread", false, "read data files by pread instead of mmap")
+	flag.StringVar(&dataDirs, "data-dirs", "", "comma separated dirs of data files, empty keeps them in database directory")
+	flag.StringVar(&blobDir, "blob-dir", "", "dir standing in for a blob store of offloaded data files")
+	flag.IntVar(&offloadAfter, "offload-after", 4, "offload data files sealed more than this many rotations ago")
+	flag.BoolVar(&bulkLoad, "bulk-load", false, "load records by a bulk loader before opening database, needs a fresh database directory")
 }
 
 func main() {
@@ -104,33 +251,135 @@ func main() {
 	ylog.Init()
 	defer ylog.Flush()
 
-	// clear DB
-	//os.RemoveAll(benchDir)
+	workload, err := ycsb.LookupWorkload(workloadName)
+	if err != nil {
+		ylog.Fatal(err)
+	}
+	if threads+readers+writers <= 0 {
+		ylog.Fatal("No goroutines to run")
+	}
+	var dirs []string
+	if dataDirs != "" {
+		dirs = strings.Split(dataDirs, ",")
+	}
+	if clean {
+		os.RemoveAll(dir)
+		for _, d := range dirs {
+			os.RemoveAll(d)
+		}
+	}
 
 	options := beecask.NewOptions()
 	options.MaxOpenFiles = 256
-	var err error
-	bc, err = beecask.NewBeecask(*options, benchDir)
+	options.ValueCacheSize = valueCache
+	if pread {
+		options.FileAccess = beecask.FILE_ACCESS_PREAD
+	}
+	for _, d := range dirs {
+		options.DataDirs = append(options.DataDirs, beecask.DataDir{Path: d})
+	}
+	if blobDir != "" {
+		if clean {
+			os.RemoveAll(blobDir)
+		}
+		if options.BlobStore, err = beecask.NewDirBlobStore(nil, blobDir); err != nil {
+			ylog.Fatal(err)
+		}
+		options.OffloadAfter = offloadAfter
+	}
+	// load by bulk loader takes opening database into account
+	var loadDuration time.Duration
+	begin := time.Now()
+	if bulkLoad {
+		loader, err := beecask.NewBulkLoader(*options, dir, threads+readers+writers)
+		if err != nil {
+			ylog.Fatal(err)
+		}
+		// keys and values are generated by a driver without db
+		driver, err := ycsb.NewDriver(nil, workload, distribution, records, vsize)
+		if err != nil {
+			ylog.Fatal(err)
+		}
+		load(driver, loader.Set)
+		if err = loader.Close(); err != nil {
+			ylog.Fatal(err)
+		}
+	}
+	bc, err := beecask.NewBeecask(*options, dir)
 	if err != nil {
 		fmt.Print(err)
 		ylog.Fatal(err)
 	}
 	defer bc.Close()
+	if bulkLoad {
+		loadDuration = time.Since(begin)
+	}
 
-	GenerateKeys()
-
-	fmt.Println("RandomSetBench:")
-	RandomSetBench(operationsNum)
-
-	fmt.Println("RandomGetBench:")
-	RandomGetBench(operationsNum)
+	driver, err := ycsb.NewDriver(bc, workload, distribution, records, vsize)
+	if err != nil {
+		ylog.Fatal(err)
+	}
+	result := &Result{
+		Workload:     workload.Name,
+		Distribution: distribution,
+		Records:      records,
+		ValueSize:    vsize,
+		Threads:      threads,
+		Readers:      readers,
+		Writers:      writers,
+		Ops:          make(map[string]OpResult),
+	}
+	if result.Distribution == "" {
+		result.Distribution = workload.Distribution
+	}
+	if !bulkLoad {
+		loadDuration = load(driver, nil)
+	}
+	result.LoadDuration = loadDuration.Seconds()
 
-	RandomGetBenchWhenMerge()
+	stop := make(chan struct{})
+	mergeDone := make(chan struct{})
+	if mergeRuns {
+		go func() {
+			runMerges(bc, stop, &result.Merge)
+			close(mergeDone)
+		}()
+	} else {
+		close(mergeDone)
+	}
+	stats, count, elapsed := run(driver)
+	close(stop)
+	<-mergeDone
 
-	RandomSetBenchWhenMerge()
+	result.Operations = count
+	result.Duration = elapsed.Seconds()
+	result.Throughput = float64(count) / elapsed.Seconds()
+	for op := ycsb.OpType(0); op < ycsb.OP_TYPE_COUNT; op++ {
+		h := &stats.hists[op]
+		if h.Count() == 0 {
+			continue
+		}
+		result.Ops[op.String()] = OpResult{
+			Count:  h.Count(),
+			Errors: stats.errors[op],
+			Mean:   micros(h.Mean()),
+			Min:    micros(h.Min()),
+			P50:    micros(h.Percentile(0.5)),
+			P99:    micros(h.Percentile(0.99)),
+			P999:   micros(h.Percentile(0.999)),
+			Max:    micros(h.Max()),
+		}
+	}
 
-	mergeBegin := time.Now()
-	bc.Merge()
-	mergeEnd := time.Now()
-	fmt.Printf("Merge in %fs\n", mergeEnd.Sub(mergeBegin).Seconds())
+	// keep stdout for JSON
+	if jsonPath == "-" {
+		report(os.Stderr, result)
+	} else {
+		report(os.Stdout, result)
+	}
+	if jsonPath != "" {
+		if err := writeJSON(result); err != nil {
+			ylog.Fatal(err)
+		}
+	}
 }
@@ -0,0 +1,159 @@
+package ycsb
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	ZIPFIAN_CONSTANT = 0.99
+)
+
+// Generator chooses indexes of keys, it must be safe for concurrent use
+// with a rand.Rand per goroutine
+type Generator interface {
+	Next(r *rand.Rand) int64
+}
+
+// keySpace counts keys inserted so far
+type keySpace struct {
+	next  int64 // atomic, index of next key to insert
+	acked int64 // atomic, keys below it are all inserted
+	mu    sync.Mutex
+	done  map[int64]bool // keys inserted at or above acked
+}
+
+func (ks *keySpace) allocate() int64 {
+	return atomic.AddInt64(&ks.next, 1) - 1
+}
+
+// ack marks key i inserted
+func (ks *keySpace) ack(i int64) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	acked := atomic.LoadInt64(&ks.acked)
+	if i != acked {
+		// inserts finish out of order
+		ks.done[i] = true
+		return
+	}
+	for acked++; ks.done[acked]; acked++ {
+		delete(ks.done, acked)
+	}
+	atomic.StoreInt64(&ks.acked, acked)
+}
+
+// count returns number of keys safe to read
+func (ks *keySpace) count() int64 {
+	return atomic.LoadInt64(&ks.acked)
+}
+
+// Uniform chooses inserted keys uniformly
+type Uniform struct {
+	keys *keySpace
+}
+
+func (u *Uniform) Next(r *rand.Rand) int64 {
+	n := u.keys.count()
+	if n <= 0 {
+		return 0
+	}
+	return r.Int63n(n)
+}
+
+// Zipfian chooses items in [0, items) by zipfian distribution, item 0 is
+// the most popular one. It is the algorithm of Gray et al. used by YCSB.
+type Zipfian struct {
+	items int64
+	theta float64
+	alpha float64
+	zetan float64
+	eta   float64
+	half  float64 // 1 + 0.5^theta
+}
+
+func NewZipfian(items int64, theta float64) *Zipfian {
+	if items < 1 {
+		items = 1
+	}
+	zeta2 := zeta(2, theta)
+	zetan := zeta(items, theta)
+	return &Zipfian{
+		items: items,
+		theta: theta,
+		alpha: 1 / (1 - theta),
+		zetan: zetan,
+		eta:   (1 - math.Pow(2/float64(items), 1-theta)) / (1 - zeta2/zetan),
+		half:  1 + math.Pow(0.5, theta),
+	}
+}
+
+func zeta(n int64, theta float64) float64 {
+	var sum float64
+	for i := int64(1); i <= n; i++ {
+		sum += 1 / math.Pow(float64(i), theta)
+	}
+	return sum
+}
+
+func (z *Zipfian) Next(r *rand.Rand) int64 {
+	u := r.Float64()
+	uz := u * z.zetan
+	if uz < 1 {
+		return 0
+	}
+	if uz < z.half {
+		return 1
+	}
+	n := int64(float64(z.items) * math.Pow(z.eta*u-z.eta+1, z.alpha))
+	if n >= z.items {
+		n = z.items - 1
+	}
+	return n
+}
+
+// ScrambledZipfian spreads popular items of Zipfian over the key space,
+// so that they are not clustered at the first keys
+type ScrambledZipfian struct {
+	zipf *Zipfian
+	keys *keySpace
+}
+
+func (sz *ScrambledZipfian) Next(r *rand.Rand) int64 {
+	n := sz.keys.count()
+	if n <= 0 {
+		return 0
+	}
+	return int64(fnv64(uint64(sz.zipf.Next(r))) % uint64(n))
+}
+
+// Latest prefers recently inserted keys by zipfian distribution
+type Latest struct {
+	zipf *Zipfian
+	keys *keySpace
+}
+
+func (l *Latest) Next(r *rand.Rand) int64 {
+	n := l.keys.count()
+	if n <= 0 {
+		return 0
+	}
+	i := n - 1 - l.zipf.Next(r)
+	if i < 0 {
+		i = 0
+	}
+	return i
+}
+
+// fnv64 is FNV-1a hash of the 8 bytes of v
+func fnv64(v uint64) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < 8; i++ {
+		h ^= v & 0xff
+		h *= 1099511628211
+		v >>= 8
+	}
+	return h
+}
@@ -0,0 +1,122 @@
+package ycsb
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+const (
+	SUB_BUCKET_BITS  = 4 // each power of two is split into 16 buckets, error is below 6.25%
+	SUB_BUCKET_COUNT = 1 << SUB_BUCKET_BITS
+	BUCKET_COUNT     = (64 - SUB_BUCKET_BITS + 1) * SUB_BUCKET_COUNT
+)
+
+// Histogram records latencies in log-linear buckets, it is not safe
+// for concurrent use
+type Histogram struct {
+	counts [BUCKET_COUNT]uint64
+	count  uint64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+func bucketOf(d time.Duration) int {
+	v := uint64(d)
+	if d < 0 {
+		v = 0
+	}
+	if v < SUB_BUCKET_COUNT {
+		return int(v)
+	}
+	exp := bits.Len64(v) - 1
+	sub := int(v>>(exp-SUB_BUCKET_BITS)) - SUB_BUCKET_COUNT
+	return (exp-SUB_BUCKET_BITS+1)*SUB_BUCKET_COUNT + sub
+}
+
+// upperBoundOf returns the largest latency of bucket i
+func upperBoundOf(i int) time.Duration {
+	if i < SUB_BUCKET_COUNT {
+		return time.Duration(i)
+	}
+	exp := i/SUB_BUCKET_COUNT + SUB_BUCKET_BITS - 1
+	sub := uint64(i%SUB_BUCKET_COUNT + SUB_BUCKET_COUNT)
+	upper := (sub+1)<<(exp-SUB_BUCKET_BITS) - 1
+	if upper > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(upper)
+}
+
+func (h *Histogram) Record(d time.Duration) {
+	h.counts[bucketOf(d)]++
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.count++
+	h.sum += d
+}
+
+// Merge adds latencies recorded by other
+func (h *Histogram) Merge(other *Histogram) {
+	if other.count == 0 {
+		return
+	}
+	for i, c := range other.counts {
+		h.counts[i] += c
+	}
+	if h.count == 0 || other.min < h.min {
+		h.min = other.min
+	}
+	if other.max > h.max {
+		h.max = other.max
+	}
+	h.count += other.count
+	h.sum += other.sum
+}
+
+func (h *Histogram) Count() uint64 {
+	return h.count
+}
+
+func (h *Histogram) Mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.count)
+}
+
+func (h *Histogram) Min() time.Duration {
+	return h.min
+}
+
+func (h *Histogram) Max() time.Duration {
+	return h.max
+}
+
+// Percentile returns the latency which q of latencies are not above,
+// q is in [0, 1]
+func (h *Histogram) Percentile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(h.count)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			if upper := upperBoundOf(i); upper < h.max {
+				return upper
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
@@ -0,0 +1,232 @@
+// Package ycsb drives YCSB-style workloads against a key-value store
+package ycsb
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+type OpType int
+
+const (
+	OP_READ OpType = iota
+	OP_UPDATE
+	OP_INSERT
+	OP_SCAN
+	OP_READ_MODIFY_WRITE
+	OP_TYPE_COUNT
+)
+
+var opNames = [OP_TYPE_COUNT]string{"read", "update", "insert", "scan", "read-modify-write"}
+
+func (op OpType) String() string {
+	return opNames[op]
+}
+
+// isRead reports whether op only reads
+func (op OpType) isRead() bool {
+	return op == OP_READ || op == OP_SCAN
+}
+
+const (
+	DIST_UNIFORM = "uniform"
+	DIST_ZIPFIAN = "zipfian"
+	DIST_LATEST  = "latest"
+)
+
+// Workload is a mix of operations, proportions need not sum to 1
+type Workload struct {
+	Name          string
+	Proportions   [OP_TYPE_COUNT]float64
+	Distribution  string // distribution of keys chosen by operations
+	MaxScanLength int
+}
+
+// Workloads are the core workloads of YCSB
+var Workloads = map[string]Workload{
+	"a": {Name: "a", Distribution: DIST_ZIPFIAN, Proportions: [OP_TYPE_COUNT]float64{OP_READ: 0.5, OP_UPDATE: 0.5}},
+	"b": {Name: "b", Distribution: DIST_ZIPFIAN, Proportions: [OP_TYPE_COUNT]float64{OP_READ: 0.95, OP_UPDATE: 0.05}},
+	"c": {Name: "c", Distribution: DIST_ZIPFIAN, Proportions: [OP_TYPE_COUNT]float64{OP_READ: 1}},
+	"d": {Name: "d", Distribution: DIST_LATEST, Proportions: [OP_TYPE_COUNT]float64{OP_READ: 0.95, OP_INSERT: 0.05}},
+	"e": {Name: "e", Distribution: DIST_ZIPFIAN, Proportions: [OP_TYPE_COUNT]float64{OP_SCAN: 0.95, OP_INSERT: 0.05}, MaxScanLength: 100},
+	"f": {Name: "f", Distribution: DIST_ZIPFIAN, Proportions: [OP_TYPE_COUNT]float64{OP_READ: 0.5, OP_READ_MODIFY_WRITE: 0.5}},
+}
+
+// LookupWorkload returns the core workload of name, case insensitive
+func LookupWorkload(name string) (Workload, error) {
+	w, ok := Workloads[strings.ToLower(name)]
+	if !ok {
+		return Workload{}, fmt.Errorf("Unknown workload %q", name)
+	}
+	return w, nil
+}
+
+// DB is the store driven by workloads
+type DB interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte) error
+}
+
+// Role restricts operations run by a worker
+type Role int
+
+const (
+	ROLE_MIXED Role = iota // all operations of workload
+	ROLE_READ              // read and scan only
+	ROLE_WRITE             // update, insert and read-modify-write only
+)
+
+// Driver runs a workload against db
+type Driver struct {
+	db        DB
+	workload  Workload
+	valueSize int
+	keys      keySpace
+	chooser   Generator
+}
+
+// NewDriver creates a driver for records keys, distribution overrides
+// the one of workload if it is not empty
+func NewDriver(db DB, workload Workload, distribution string, records int64, valueSize int) (*Driver, error) {
+	d := &Driver{db: db, workload: workload, valueSize: valueSize}
+	if distribution == "" {
+		distribution = workload.Distribution
+	}
+	switch distribution {
+	case DIST_UNIFORM:
+		d.chooser = &Uniform{keys: &d.keys}
+	case DIST_ZIPFIAN:
+		d.chooser = &ScrambledZipfian{zipf: NewZipfian(records, ZIPFIAN_CONSTANT), keys: &d.keys}
+	case DIST_LATEST:
+		d.chooser = &Latest{zipf: NewZipfian(records, ZIPFIAN_CONSTANT), keys: &d.keys}
+	default:
+		return nil, fmt.Errorf("Unknown distribution %q", distribution)
+	}
+	d.keys.next = records
+	d.keys.acked = records
+	d.keys.done = make(map[int64]bool)
+	return d, nil
+}
+
+// Key returns the key of index i
+func Key(i int64) string {
+	return fmt.Sprintf("user%012d", i)
+}
+
+// Load inserts keys [from, to) with random values
+func (d *Driver) Load(from, to int64, seed int64) error {
+	return d.LoadWith(d.db.Set, from, to, seed)
+}
+
+// LoadWith inserts keys [from, to) with random values by set, such as
+// Set of a bulk loader
+func (d *Driver) LoadWith(set func(key string, value []byte) error, from, to int64, seed int64) error {
+	r := rand.New(rand.NewSource(seed))
+	value := make([]byte, d.valueSize)
+	for i := from; i < to; i++ {
+		r.Read(value)
+		if err := set(Key(i), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Worker runs operations of a driver, it is not safe for concurrent use
+type Worker struct {
+	d     *Driver
+	r     *rand.Rand
+	ops   []OpType
+	cum   []float64 // cumulative proportions of ops
+	value []byte
+}
+
+// NewWorker creates a worker running operations of role
+func (d *Driver) NewWorker(role Role, seed int64) *Worker {
+	w := &Worker{
+		d:     d,
+		r:     rand.New(rand.NewSource(seed)),
+		value: make([]byte, d.valueSize),
+	}
+	w.r.Read(w.value)
+	var sum float64
+	for op, p := range d.workload.Proportions {
+		if p <= 0 || (role == ROLE_READ && !OpType(op).isRead()) || (role == ROLE_WRITE && OpType(op).isRead()) {
+			continue
+		}
+		sum += p
+		w.ops = append(w.ops, OpType(op))
+		w.cum = append(w.cum, sum)
+	}
+	if len(w.ops) == 0 {
+		// workload has no operation of role
+		if role == ROLE_WRITE {
+			w.ops, w.cum = []OpType{OP_UPDATE}, []float64{1}
+		} else {
+			w.ops, w.cum = []OpType{OP_READ}, []float64{1}
+		}
+	}
+	return w
+}
+
+// Next chooses the next operation
+func (w *Worker) Next() OpType {
+	p := w.r.Float64() * w.cum[len(w.cum)-1]
+	for i, c := range w.cum {
+		if p < c {
+			return w.ops[i]
+		}
+	}
+	return w.ops[len(w.ops)-1]
+}
+
+// Do runs op
+func (w *Worker) Do(op OpType) error {
+	d := w.d
+	switch op {
+	case OP_READ:
+		_, err := d.db.Get(Key(d.chooser.Next(w.r)))
+		return err
+	case OP_UPDATE:
+		return d.db.Set(Key(d.chooser.Next(w.r)), w.nextValue())
+	case OP_INSERT:
+		i := d.keys.allocate()
+		err := d.db.Set(Key(i), w.nextValue())
+		d.keys.ack(i)
+		return err
+	case OP_SCAN:
+		// keys are read one by one, there is no ordered iteration
+		start := d.chooser.Next(w.r)
+		n := int64(1)
+		if d.workload.MaxScanLength > 1 {
+			n += int64(w.r.Intn(d.workload.MaxScanLength))
+		}
+		if count := d.keys.count(); start+n > count {
+			n = count - start
+		}
+		for i := start; i < start+n; i++ {
+			if _, err := d.db.Get(Key(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case OP_READ_MODIFY_WRITE:
+		key := Key(d.chooser.Next(w.r))
+		if _, err := d.db.Get(key); err != nil {
+			return err
+		}
+		return d.db.Set(key, w.nextValue())
+	}
+	return fmt.Errorf("Unknown operation %d", op)
+}
+
+// nextValue changes a few bytes of value, so that values differ
+func (w *Worker) nextValue() []byte {
+	if len(w.value) > 0 {
+		for i := 0; i < 8; i++ {
+			w.value[w.r.Intn(len(w.value))] = byte(w.r.Intn(256))
+		}
+	}
+	return w.value
+}
@@ -0,0 +1,187 @@
+package beecask
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yplusplus/beecask/bench/ycsb"
+)
+
+const (
+	BENCH_RECORDS    = 10000
+	BENCH_VALUE_SIZE = 100
+)
+
+func openBench(b *testing.B) *Beecask {
+	b.Helper()
+	return openBenchWith(b, NewOptions())
+}
+
+func openBenchWith(b *testing.B, opts *options) *Beecask {
+	b.Helper()
+	opts.Logger = NopLogger{}
+	bc, err := NewBeecask(*opts, b.TempDir())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(bc.Close)
+	return bc
+}
+
+func benchKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%09d", i)
+	}
+	return keys
+}
+
+func BenchmarkSet(b *testing.B) {
+	bc := openBench(b)
+	keys := benchKeys(BENCH_RECORDS)
+	value := make([]byte, BENCH_VALUE_SIZE)
+	b.SetBytes(BENCH_VALUE_SIZE)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := bc.Set(keys[i%len(keys)], value); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSetParallel(b *testing.B) {
+	bc := openBench(b)
+	keys := benchKeys(BENCH_RECORDS)
+	var next int64
+	b.SetBytes(BENCH_VALUE_SIZE)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		value := make([]byte, BENCH_VALUE_SIZE)
+		for pb.Next() {
+			i := atomic.AddInt64(&next, 1)
+			if err := bc.Set(keys[i%int64(len(keys))], value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func loadBench(b *testing.B, bc *Beecask, keys []string) {
+	b.Helper()
+	value := make([]byte, BENCH_VALUE_SIZE)
+	for _, key := range keys {
+		if err := bc.Set(key, value); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	bc := openBench(b)
+	keys := benchKeys(BENCH_RECORDS)
+	loadBench(b, bc, keys)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := bc.Get(keys[i%len(keys)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetValueCache(b *testing.B) {
+	opts := NewOptions()
+	opts.ValueCacheSize = 64 << 20
+	bc := openBenchWith(b, opts)
+	keys := benchKeys(BENCH_RECORDS)
+	loadBench(b, bc, keys)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := bc.Get(keys[i%len(keys)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	stats := bc.Stats().ValueCache
+	b.ReportMetric(float64(stats.Hits)/float64(stats.Hits+stats.Misses), "hit-ratio")
+}
+
+func BenchmarkGetParallel(b *testing.B) {
+	bc := openBench(b)
+	keys := benchKeys(BENCH_RECORDS)
+	loadBench(b, bc, keys)
+	var next int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddInt64(&next, 1)
+			if _, err := bc.Get(keys[i%int64(len(keys))]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkGetWhenMerge(b *testing.B) {
+	bc := openBench(b)
+	keys := benchKeys(BENCH_RECORDS)
+	for i := 0; i < 4; i++ {
+		loadBench(b, bc, keys)
+	}
+	b.ResetTimer()
+	done := make(chan struct{})
+	go func() {
+		bc.Merge()
+		close(done)
+	}()
+	for i := 0; i < b.N; i++ {
+		if _, err := bc.Get(keys[i%len(keys)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	<-done
+}
+
+// BenchmarkWorkload runs YCSB core workloads in parallel and reports
+// latency percentiles besides ns/op
+func BenchmarkWorkload(b *testing.B) {
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		b.Run(name, func(b *testing.B) {
+			bc := openBench(b)
+			driver, err := ycsb.NewDriver(bc, ycsb.Workloads[name], "", BENCH_RECORDS, BENCH_VALUE_SIZE)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err = driver.Load(0, BENCH_RECORDS, 1); err != nil {
+				b.Fatal(err)
+			}
+
+			var mu sync.Mutex
+			var total ycsb.Histogram
+			var seed int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				w := driver.NewWorker(ycsb.ROLE_MIXED, atomic.AddInt64(&seed, 1))
+				var h ycsb.Histogram
+				for pb.Next() {
+					begin := time.Now()
+					if err := w.Do(w.Next()); err != nil {
+						b.Error(err)
+						return
+					}
+					h.Record(time.Since(begin))
+				}
+				mu.Lock()
+				total.Merge(&h)
+				mu.Unlock()
+			})
+			b.StopTimer()
+			b.ReportMetric(float64(total.Percentile(0.5)), "p50-ns")
+			b.ReportMetric(float64(total.Percentile(0.99)), "p99-ns")
+			b.ReportMetric(float64(total.Percentile(0.999)), "p999-ns")
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package beecask
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrBucketNotExist = fmt.Errorf("Bucket not exist")
+)
+
+// Keys of buckets are stored as BUCKET_KEY_PREFIX + uvarint(bucket id) + key,
+// metadata of bucket is stored as BUCKET_META_PREFIX + name. Keys beginning
+// with BUCKET_KEY_PREFIX are reserved and can not be set out of buckets, such
+// keys written before buckets were introduced are still read and kept by merge
+// but can not be changed, see README.
+// SEQ_MARK_KEY is written by merge to keep the last sequence number handed
+// out, the records holding it may have been dropped.
+const (
+	BUCKET_KEY_PREFIX  = "\x00"
+	BUCKET_META_PREFIX = "\x00\x00"
+	SEQ_MARK_KEY       = BUCKET_KEY_PREFIX
+)
+
+// Bucket is a named namespace of keys within one database,
+// all buckets share files of the database
+type Bucket struct {
+	bc     *Beecask
+	name   string
+	id     uint64
+	prefix []byte
+	ttl    time.Duration // default ttl, requires bc.rwMutex held
+}
+
+// Bucket returns the bucket named name, it is created if not exist
+func (bc *Beecask) Bucket(name string) (*Bucket, error) {
+	bc.rwMutex.Lock()
+	defer bc.rwMutex.Unlock()
+
+	if b, ok := bc.buckets[name]; ok {
+		return b, nil
+	}
+	b := newBucket(bc, name, bc.maxBucketId+1, 0)
+	if err := bc.setRecord(b.metaRecord()); err != nil {
+		return nil, err
+	}
+	bc.maxBucketId = b.id
+	bc.addBucket(b)
+	return b, nil
+}
+
+// Buckets returns names of all buckets
+func (bc *Beecask) Buckets() []string {
+	bc.rwMutex.RLock()
+	defer bc.rwMutex.RUnlock()
+	names := make([]string, 0, len(bc.buckets))
+	for name := range bc.buckets {
+		names = append(names, name)
+	}
+	return names
+}
+
+// DropBucket removes bucket named name and all its keys, a single range
+// tombstone is written instead of one tombstone per key
+func (bc *Beecask) DropBucket(name string) error {
+	bc.rwMutex.Lock()
+	defer bc.rwMutex.Unlock()
+
+	b, ok := bc.buckets[name]
+	if !ok {
+		return ErrBucketNotExist
+	}
+
+	meta := newRecord(bucketMetaKey(name), nil, true, 0)
+	meta.flag |= RECORD_FLAG_BIT_BUCKET
+	tombstone := newRangeRecord(b.prefix, prefixEnd(b.prefix), RECORD_FLAG_BIT_BUCKET)
+	if err := bc.writeBatch([]*Record{meta, tombstone}); err != nil {
+		return err
+	}
+	delete(bc.buckets, name)
+	delete(bc.bucketIds, b.id)
+	return nil
+}
+
+func newBucket(bc *Beecask, name string, id uint64, ttl time.Duration) *Bucket {
+	return &Bucket{
+		bc:     bc,
+		name:   name,
+		id:     id,
+		prefix: bucketPrefix(id),
+		ttl:    ttl,
+	}
+}
+
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+// DefaultTTL returns ttl of keys set by Set, zero means no expiration
+func (b *Bucket) DefaultTTL() time.Duration {
+	b.bc.rwMutex.RLock()
+	defer b.bc.rwMutex.RUnlock()
+	return b.ttl
+}
+
+// SetDefaultTTL changes ttl of keys set by Set afterwards,
+// zero or negative ttl means no expiration
+func (b *Bucket) SetDefaultTTL(ttl time.Duration) error {
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	bc := b.bc
+	bc.rwMutex.Lock()
+	defer bc.rwMutex.Unlock()
+
+	if bc.bucketIds[b.id] != b {
+		return ErrBucketNotExist
+	}
+	old := b.ttl
+	b.ttl = ttl
+	if err := bc.setRecord(b.metaRecord()); err != nil {
+		b.ttl = old
+		return err
+	}
+	return nil
+}
+
+func (b *Bucket) Get(key string) ([]byte, error) {
+	return b.bc.GetBytes(b.key(key))
+}
+
+// Set sets a record(key, value) with default ttl of bucket
+func (b *Bucket) Set(key string, value []byte) (err error) {
+	defer b.bc.metrics.observe(OP_SET, time.Now(), &err)
+	b.bc.rwMutex.Lock()
+	defer b.bc.rwMutex.Unlock()
+
+	var expiration int64
+	if b.ttl > 0 {
+		expiration = expirationAfter(b.ttl)
+	}
+	return b.bc.setRecord(b.record(key, value, false, expiration))
+}
+
+// SetWithTTL sets a record(key, value) which expires after ttl,
+// zero or negative ttl means no expiration
+func (b *Bucket) SetWithTTL(key string, value []byte, ttl time.Duration) (err error) {
+	defer b.bc.metrics.observe(OP_SET, time.Now(), &err)
+	b.bc.rwMutex.Lock()
+	defer b.bc.rwMutex.Unlock()
+	return b.bc.setRecord(b.record(key, value, false, expirationAfter(ttl)))
+}
+
+func (b *Bucket) Delete(key string) (err error) {
+	defer b.bc.metrics.observe(OP_DELETE, time.Now(), &err)
+	b.bc.rwMutex.Lock()
+	defer b.bc.rwMutex.Unlock()
+	return b.bc.setRecord(b.record(key, nil, true, 0))
+}
+
+// Keys returns all keys of bucket which are neither deleted nor expired
+func (b *Bucket) Keys() []string {
+	b.bc.rwMutex.RLock()
+	defer b.bc.rwMutex.RUnlock()
+	return b.bc.keydir.PrefixKeys(string(b.prefix), time.Now().Unix())
+}
+
+// ForEach calls fn on each key of bucket and its value until fn returns error,
+// keys changed during iteration may or may not be visited
+func (b *Bucket) ForEach(fn func(key string, value []byte) error) error {
+	return forEachKey(b.Keys(), func(key string) ([]byte, error) {
+		return b.bc.GetWithOptions(string(b.key(key)), scanReadOptions)
+	}, fn)
+}
+
+// ForEach calls fn on each key out of buckets and its value until fn
+// returns error, keys changed during iteration may or may not be visited
+func (bc *Beecask) ForEach(fn func(key string, value []byte) error) error {
+	return forEachKey(bc.Keys(), func(key string) ([]byte, error) {
+		return bc.GetWithOptions(key, scanReadOptions)
+	}, fn)
+}
+
+// scanReadOptions keeps values of a scan out of value cache, so that hot
+// values are not evicted by it
+var scanReadOptions = ReadOptions{NoCache: true}
+
+func forEachKey(keys []string, get func(key string) ([]byte, error), fn func(key string, value []byte) error) error {
+	for _, key := range keys {
+		value, err := get(key)
+		if err == ErrDataNotExist {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Bucket) key(key string) []byte {
+	k := make([]byte, 0, len(b.prefix)+len(key))
+	return append(append(k, b.prefix...), key...)
+}
+
+func (b *Bucket) record(key string, value []byte, delete bool, expiration int64) *Record {
+	r := newRecord(b.key(key), value, delete, expiration)
+	r.flag |= RECORD_FLAG_BIT_BUCKET
+	return r
+}
+
+// metaRecord returns record of metadata: uvarint(id) + varint(ttl)
+func (b *Bucket) metaRecord() *Record {
+	value := make([]byte, 2*binary.MaxVarintLen64)
+	n := binary.PutUvarint(value, b.id)
+	n += binary.PutVarint(value[n:], int64(b.ttl))
+	r := newRecord(bucketMetaKey(b.name), value[:n], false, 0)
+	r.flag |= RECORD_FLAG_BIT_BUCKET
+	return r
+}
+
+func bucketPrefix(id uint64) []byte {
+	prefix := make([]byte, 1+binary.MaxVarintLen64)
+	prefix[0] = BUCKET_KEY_PREFIX[0]
+	n := binary.PutUvarint(prefix[1:], id)
+	return prefix[:1+n]
+}
+
+func bucketMetaKey(name string) []byte {
+	return []byte(BUCKET_META_PREFIX + name)
+}
+
+// splitKey returns name of bucket holding the stored key and key within it,
+// ok is false for metadata and keys of dropped buckets.
+// splitKey requires bc.rwMutex held
+func (bc *Beecask) splitKey(key string) (bucket string, relKey string, ok bool) {
+	if isDefaultKey(key) {
+		return "", key, true
+	}
+	id, n := binary.Uvarint([]byte(key[1:]))
+	if n <= 0 {
+		return "", "", false
+	}
+	b := bc.bucketIds[id]
+	if b == nil {
+		return "", "", false
+	}
+	return b.name, key[1+n:], true
+}
+
+// isDefaultKey reports whether key is out of buckets
+func isDefaultKey(key string) bool {
+	return len(key) == 0 || key[0] != BUCKET_KEY_PREFIX[0]
+}
+
+// checkBucket rejects records which misuse reserved keys and
+// records of dropped buckets.
+// checkBucket requires bc.rwMutex held
+func (bc *Beecask) checkBucket(r *Record) error {
+	// records rewritten by merge keep their sequence number,
+	// they were checked when written first
+	if r.seq != 0 {
+		return nil
+	}
+	if (r.flag & RECORD_FLAG_BIT_BUCKET) == 0 {
+		if !isDefaultKey(string(r.key)) {
+			bc.logger.Errorf("Key[%q] is reserved for buckets", r.key)
+			return ErrInvalid
+		}
+		return nil
+	}
+	if bytes.HasPrefix(r.key, []byte(BUCKET_META_PREFIX)) || string(r.key) == SEQ_MARK_KEY {
+		return nil
+	}
+	if len(r.key) < 2 {
+		return ErrInvalid
+	}
+	id, n := binary.Uvarint(r.key[1:])
+	if n <= 0 || bc.bucketIds[id] == nil {
+		return ErrBucketNotExist
+	}
+	return nil
+}
+
+// addBucket requires bc.rwMutex held
+func (bc *Beecask) addBucket(b *Bucket) {
+	bc.buckets[b.name] = b
+	bc.bucketIds[b.id] = b
+}
+
+// restoreBuckets loads metadata of buckets after all data files are restored
+func (bc *Beecask) restoreBuckets() error {
+	var err error
+	bc.keydir.ForEach(func(item *KDItem) bool {
+		return (item.flag&RECORD_FLAG_BIT_BUCKET) > 0 && (item.flag&RECORD_FLAG_BIT_DELETE) == 0
+	}, func(key string, item *KDItem) bool {
+		if len(key) < 2 || key[:2] != BUCKET_META_PREFIX {
+			return true
+		}
+		var r *Record
+		var value []byte
+		if r, err = bc.readRecord(item.fileId, item.valuePos); err != nil {
+			return false
+		}
+		if value, err = bc.readValue(r); err != nil {
+			return false
+		}
+		id, n := binary.Uvarint(value)
+		if n <= 0 {
+			err = ErrDataCorruption
+			return false
+		}
+		ttl, m := binary.Varint(value[n:])
+		if m <= 0 {
+			err = ErrDataCorruption
+			return false
+		}
+		bc.addBucket(newBucket(bc, key[len(BUCKET_META_PREFIX):], id, time.Duration(ttl)))
+		if id > bc.maxBucketId {
+			bc.maxBucketId = id
+		}
+		return true
+	})
+	return err
+}
@@ -0,0 +1,178 @@
+package beecask
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	opts := testOptions(NewMemFS())
+	bc := openTest(t, opts)
+
+	if err := bc.Set("k", []byte("default")); err != nil {
+		t.Fatal(err)
+	}
+	a, err := bc.Bucket("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := bc.Bucket("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Set("k", []byte("va")); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.SetDefaultTTL(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Set("k", []byte("vb")); err != nil {
+		t.Fatal(err)
+	}
+	if err = bc.Set(BUCKET_KEY_PREFIX+"x", nil); err != ErrInvalid {
+		t.Fatalf("reserved key expects ErrInvalid, err=%v", err)
+	}
+	if keys := bc.Keys(); len(keys) != 1 || bc.Count() != 1 {
+		t.Fatalf("keys out of buckets expects [k], got %v", keys)
+	}
+	bc.Close()
+
+	bc = openTest(t, opts)
+	defer bc.Close()
+	names := bc.Buckets()
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		t.Fatalf("buckets expects [a b], got %v", names)
+	}
+	expectValue(t, bc, "k", "default")
+	a, _ = bc.Bucket("a")
+	b, _ = bc.Bucket("b")
+	if v, err := a.Get("k"); err != nil || string(v) != "va" {
+		t.Fatalf("bucket a expects va, got %q, err=%v", v, err)
+	}
+	if v, err := b.Get("k"); err != nil || string(v) != "vb" {
+		t.Fatalf("bucket b expects vb, got %q, err=%v", v, err)
+	}
+	if b.DefaultTTL() != time.Hour {
+		t.Fatalf("default ttl expects 1h, got %s", b.DefaultTTL())
+	}
+}
+
+func TestDropBucket(t *testing.T) {
+	opts := testOptions(NewMemFS())
+	bc := openTest(t, opts)
+
+	a, _ := bc.Bucket("a")
+	b, _ := bc.Bucket("b")
+	for _, key := range []string{"x", "y", "z"} {
+		a.Set(key, []byte("va"))
+		b.Set(key, []byte("vb"))
+	}
+	if err := bc.DropBucket("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Set("x", nil); err != ErrBucketNotExist {
+		t.Fatalf("set of dropped bucket expects ErrBucketNotExist, err=%v", err)
+	}
+	if _, err := a.Get("x"); err != ErrDataNotExist {
+		t.Fatalf("key of dropped bucket expects not exist, err=%v", err)
+	}
+	bc.Close()
+
+	// neither restore nor merge brings back keys of dropped bucket
+	for i := 0; i < 2; i++ {
+		bc = openTest(t, opts)
+		names := bc.Buckets()
+		sort.Strings(names)
+		if len(names) != 1+i || names[0] != "b" {
+			t.Fatalf("bucket a is restored, buckets=%v", names)
+		}
+		if i == 0 {
+			c, _ := bc.Bucket("c")
+			if c.id <= 2 || len(c.Keys()) != 0 {
+				t.Fatalf("bucket id %d is reused", c.id)
+			}
+		}
+		b, _ = bc.Bucket("b")
+		if keys := b.Keys(); len(keys) != 3 {
+			t.Fatalf("keys of bucket b expects 3, got %v", keys)
+		}
+		rotateTest(t, bc)
+		mergeTest(t, bc)
+		bc.Close()
+	}
+}
+
+func TestBucketHooks(t *testing.T) {
+	type hookCall struct {
+		bucket, key, value string
+	}
+	var mu sync.Mutex
+	var expired, evicted []hookCall
+	opts := testOptions(NewMemFS())
+	opts.OnExpire = func(bucket string, key string, value []byte) {
+		mu.Lock()
+		expired = append(expired, hookCall{bucket, key, string(value)})
+		mu.Unlock()
+	}
+	opts.OnEvict = func(bucket string, key string) {
+		mu.Lock()
+		evicted = append(evicted, hookCall{bucket, key, ""})
+		mu.Unlock()
+	}
+	bc := openTest(t, opts)
+	defer bc.Close()
+
+	a, _ := bc.Bucket("a")
+	d, _ := bc.Bucket("d")
+	a.SetWithTTL("e", []byte("ve"), time.Minute)
+	a.Set("x", []byte("vx"))
+	a.Delete("x")
+	bc.SetWithTTL("e", []byte("default"), time.Minute)
+	bc.DropBucket("d")
+	d.Set("y", nil)
+
+	bc.expireKeys(time.Now().Add(time.Hour).Unix(), 10)
+	rotateTest(t, bc)
+	mergeTest(t, bc)
+
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Slice(expired, func(i, j int) bool { return expired[i].bucket < expired[j].bucket })
+	if len(expired) != 2 || expired[0] != (hookCall{"", "e", "default"}) || expired[1] != (hookCall{"a", "e", "ve"}) {
+		t.Fatalf("unexpected expire hooks %v", expired)
+	}
+	// tombstone of bucket metadata is not reported
+	if len(evicted) != 1 || evicted[0] != (hookCall{"a", "x", ""}) {
+		t.Fatalf("unexpected evict hooks %v", evicted)
+	}
+}
+
+// keys beginning with BUCKET_KEY_PREFIX written before buckets are kept by merge
+func TestLegacyReservedKey(t *testing.T) {
+	opts := testOptions(NewMemFS())
+	bc := openTest(t, opts)
+
+	bc.rwMutex.Lock()
+	r := newRecord([]byte(BUCKET_KEY_PREFIX+"legacy"), []byte("v"), false, 0)
+	bc.seq++
+	r.seq = bc.seq
+	err := bc.setRecord(r)
+	bc.rwMutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotateTest(t, bc)
+	mergeTest(t, bc)
+	bc.Close()
+
+	bc = openTest(t, opts)
+	defer bc.Close()
+	expectValue(t, bc, BUCKET_KEY_PREFIX+"legacy", "v")
+	if err = bc.Delete(BUCKET_KEY_PREFIX + "legacy"); err != ErrInvalid {
+		t.Fatalf("delete of reserved key expects ErrInvalid, err=%v", err)
+	}
+}
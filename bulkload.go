@@ -0,0 +1,248 @@
+package beecask
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	BULK_WRITE_BUFFER_SIZE = 16 << 20 // 16M, data files are written by large sequential writes
+)
+
+var (
+	ErrBulkDirNotEmpty = fmt.Errorf("Bulk load needs a fresh directory")
+	ErrBulkLoaderDone  = fmt.Errorf("Bulk loader has been closed")
+)
+
+// BulkLoader seeds a fresh database directory offline. Records are written
+// straight to data files which are sealed with their hint files, without
+// key dir or lock churn of Set, and NewBeecask opens the directory as is.
+//
+// Records may come in any order, the last write of a key wins. Keys are
+// spread over several writers by hash, each writing its own data files, so
+// that Set called from several goroutines runs in parallel. Records of a
+// key always go to the same writer, whose files only grow in file id and
+// offset, which is the order restore takes records in.
+//
+// Only keys of the default namespace are loaded, values are kept in data
+// files even if ValueThreshold is set. A directory left by a failed load
+// must be discarded.
+type BulkLoader struct {
+	fs          FS
+	dirPath     string
+	maxFileSize int64
+	logger      Logger
+	lock        io.Closer
+	writers     []*bulkWriter
+	seq         uint64 // last sequence number, atomic
+	fileId      uint64 // last data file id, atomic
+	closed      int32
+	wg          sync.WaitGroup // waits for files being sealed
+
+	mu  sync.Mutex
+	err error // first error of sealing files
+}
+
+// bulkWriter writes records of keys hashed to it
+type bulkWriter struct {
+	mu     sync.Mutex
+	file   *ActiveFile // nil until the first record or after sealed
+	keydir *KeyDir     // items of file, for hint file
+	err    error       // first error, records are refused after it
+}
+
+// NewBulkLoader locks dirPath for a load by writers parallel writers,
+// dirPath must hold no files. FS, MaxFileSize and Logger of options are used.
+func NewBulkLoader(options options, dirPath string, writers int) (*BulkLoader, error) {
+	bl := &BulkLoader{
+		fs:          options.FS,
+		dirPath:     dirPath,
+		maxFileSize: options.MaxFileSize,
+		logger:      options.Logger,
+	}
+	if bl.fs == nil {
+		bl.fs = OSFS{}
+	}
+	if bl.logger == nil {
+		bl.logger = YlogLogger{}
+	}
+	if writers <= 0 {
+		writers = 1
+	}
+	for i := 0; i < writers; i++ {
+		bl.writers = append(bl.writers, &bulkWriter{})
+	}
+
+	err := bl.fs.MkdirAll(dirPath, 0755)
+	if err != nil {
+		bl.logger.Errorf("%s", err)
+		return nil, err
+	}
+	if bl.lock, err = bl.fs.Lock(getLockFilePath(dirPath)); err != nil {
+		bl.logger.Errorf("Lock %s failed, err=%s", dirPath, err)
+		return nil, err
+	}
+	names, err := bl.fs.ReadDir(dirPath)
+	if err == nil {
+		for _, name := range names {
+			if name != LOCK_FILE_NAME {
+				err = ErrBulkDirNotEmpty
+				break
+			}
+		}
+	}
+	if err != nil {
+		bl.logger.Errorf("Bulk load to %s failed, err=%s", dirPath, err)
+		bl.lock.Close()
+		return nil, err
+	}
+	return bl, nil
+}
+
+func (bl *BulkLoader) Set(key string, value []byte) error {
+	return bl.write([]byte(key), value, false, 0)
+}
+
+// SetWithExpiration sets key which expires at expiration(unix seconds)
+func (bl *BulkLoader) SetWithExpiration(key string, value []byte, expiration int64) error {
+	return bl.write([]byte(key), value, false, expiration)
+}
+
+// Delete drops key loaded before, the delete record is kept until merge
+func (bl *BulkLoader) Delete(key string) error {
+	return bl.write([]byte(key), nil, true, 0)
+}
+
+func (bl *BulkLoader) write(key []byte, value []byte, delete bool, expiration int64) error {
+	if atomic.LoadInt32(&bl.closed) != 0 {
+		return ErrBulkLoaderDone
+	}
+	if !isDefaultKey(string(key)) {
+		bl.logger.Errorf("Key[%q] is reserved for buckets", key)
+		return ErrInvalid
+	}
+	h := fnv.New32a()
+	h.Write(key)
+	w := bl.writers[h.Sum32()%uint32(len(bl.writers))]
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	r := newRecord(key, value, delete, expiration)
+	r.seq = atomic.AddUint64(&bl.seq, 1)
+	r.flag |= RECORD_FLAG_BIT_SEQ
+	if w.err = bl.writeRecord(w, r); w.err != nil {
+		bl.logger.Errorf("Bulk load record failed, err=%s", w.err)
+	}
+	return w.err
+}
+
+// writeRecord requires w.mu held
+func (bl *BulkLoader) writeRecord(w *bulkWriter, r *Record) error {
+	if w.file != nil && w.file.Size()+r.Size() >= bl.maxFileSize {
+		// seal in another goroutine, records of w go on to a new file
+		bl.wg.Add(1)
+		go bl.sealAsync(w.file, w.keydir)
+		w.file, w.keydir = nil, nil
+	}
+	if w.file == nil {
+		fileId := atomic.AddUint64(&bl.fileId, 1)
+		file, err := NewActiveFile(bl.fs, getDataFilePath(bl.dirPath, fileId), fileId, BULK_WRITE_BUFFER_SIZE)
+		if err != nil {
+			return err
+		}
+		w.file = file
+		w.keydir = NewKeyDir()
+	}
+
+	offset, err := w.file.WriteRecord(r)
+	if err != nil {
+		return err
+	}
+	w.keydir.Set(string(r.key), &KDItem{
+		fileId:     w.file.FileId(),
+		valuePos:   uint32(offset),
+		valueSize:  r.valueSize,
+		flag:       r.flag,
+		expiration: r.expiration,
+		seq:        r.seq,
+	})
+	return nil
+}
+
+func (bl *BulkLoader) sealAsync(file *ActiveFile, keydir *KeyDir) {
+	defer bl.wg.Done()
+	if err := bl.seal(file, keydir); err != nil {
+		bl.mu.Lock()
+		if bl.err == nil {
+			bl.err = err
+		}
+		bl.mu.Unlock()
+	}
+}
+
+// seal syncs file and writes its hint file of keydir, which is renamed
+// into place after synced like the ones generated on rotation
+func (bl *BulkLoader) seal(file *ActiveFile, keydir *KeyDir) error {
+	fileId := file.FileId()
+	err := file.Sync()
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		bl.logger.Errorf("Seal datafile[%d] failed, err=%s", fileId, err)
+		return err
+	}
+
+	hintPath := getHintFilePath(bl.dirPath, fileId)
+	tmpPath := hintPath + TEMP_FILE_SUFFIX
+	err = writeHintFile(bl.fs, bl.logger, tmpPath, keydir, nil, fileId)
+	if err == nil {
+		err = bl.fs.Rename(tmpPath, hintPath)
+	}
+	if err != nil {
+		bl.logger.Errorf("Seal datafile[%d] failed, err=%s", fileId, err)
+		bl.fs.Remove(tmpPath)
+		return err
+	}
+	bl.logger.Infof("Bulk load datafile[%d] succ.", fileId)
+	return nil
+}
+
+// Close seals the data files being written and unlocks the directory, the
+// load is complete only if it returns nil
+func (bl *BulkLoader) Close() error {
+	if !atomic.CompareAndSwapInt32(&bl.closed, 0, 1) {
+		return ErrBulkLoaderDone
+	}
+	var err error
+	for _, w := range bl.writers {
+		w.mu.Lock()
+		if w.err == nil && w.file != nil {
+			w.err = bl.seal(w.file, w.keydir)
+		} else if w.file != nil {
+			w.file.Close()
+		}
+		w.file, w.keydir = nil, nil
+		if err == nil {
+			err = w.err
+		}
+		// refuse records of Set racing with Close
+		w.err = ErrBulkLoaderDone
+		w.mu.Unlock()
+	}
+	bl.wg.Wait()
+	if err == nil {
+		err = bl.err
+	}
+	if err != nil {
+		bl.logger.Errorf("Bulk load to %s failed, err=%s", bl.dirPath, err)
+	}
+	bl.lock.Close()
+	return err
+}
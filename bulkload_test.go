@@ -0,0 +1,126 @@
+package beecask
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const BULK_TEST_KEYS = 4000
+
+func bulkValue(i int) []byte {
+	return []byte(strings.Repeat("v", i%50) + fmt.Sprintf("k%d", i))
+}
+
+// checkBulkKeys checks keys written by TestBulkLoad: i%4 == 0 are set
+// again, 1 deleted, 2 expired and 3 keep the first value
+func checkBulkKeys(t *testing.T, bc *Beecask, tag string) {
+	t.Helper()
+	checkKeys(t, bc, BULK_TEST_KEYS, func(i int) []byte {
+		switch i % 4 {
+		case 0:
+			return bulkValue(i)
+		case 3:
+			return []byte("old")
+		}
+		return nil
+	}, tag)
+	if n := bc.Count(); n != BULK_TEST_KEYS/2 {
+		t.Fatalf("%s: count expects %d, got %d", tag, BULK_TEST_KEYS/2, n)
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	for _, mode := range []int{INDEX_MODE_MEMORY, INDEX_MODE_HASH} {
+		fs := NewMemFS()
+		opts := testOptions(fs)
+		opts.MaxFileSize = 32 << 10
+		opts.IndexMode = mode
+		bl, err := NewBulkLoader(*opts, TEST_DIR, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := g; i < BULK_TEST_KEYS; i += 4 {
+					if err := bl.Set(fmt.Sprintf("k%d", i), []byte("old")); err != nil {
+						t.Error(err)
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+		for i := 0; i < BULK_TEST_KEYS; i++ {
+			key := fmt.Sprintf("k%d", i)
+			switch i % 4 {
+			case 0:
+				bl.Set(key, bulkValue(i))
+			case 1:
+				bl.Delete(key)
+			case 2:
+				bl.SetWithExpiration(key, []byte("x"), time.Now().Unix()-1)
+			}
+		}
+		if err = bl.Set(BUCKET_KEY_PREFIX+"k", nil); err != ErrInvalid {
+			t.Fatalf("reserved key expects ErrInvalid, err=%v", err)
+		}
+		if err = bl.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err = bl.Set("k", nil); err != ErrBulkLoaderDone {
+			t.Fatalf("set after close expects ErrBulkLoaderDone, err=%v", err)
+		}
+		data, hints := countFiles(t, fs, TEST_DIR, ".data"), countFiles(t, fs, TEST_DIR, ".hint")
+		if data < 4 || data != hints {
+			t.Fatalf("index mode %d: each data file expects a hint file, %d data and %d hint files", mode, data, hints)
+		}
+		if _, err = NewBulkLoader(*opts, TEST_DIR, 1); err != ErrBulkDirNotEmpty {
+			t.Fatalf("bulk load into loaded dir expects ErrBulkDirNotEmpty, err=%v", err)
+		}
+
+		bc := openTest(t, opts)
+		checkBulkKeys(t, bc, "loaded")
+		// sequence numbers continue after bulk loaded records
+		loaded := uint64(BULK_TEST_KEYS + 3*BULK_TEST_KEYS/4)
+		version, err := bc.SetIfAbsent("new", []byte("v"))
+		if err != nil || version != loaded+1 {
+			t.Fatalf("index mode %d: version expects after loaded records, got %d, err=%v", mode, version, err)
+		}
+		bc.Delete("new")
+		rotateTest(t, bc)
+		mergeTest(t, bc)
+		bc.Close()
+
+		bc = openTest(t, opts)
+		checkBulkKeys(t, bc, "merged")
+		bc.Close()
+	}
+}
+
+func TestBulkLoadFailure(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	opts := testOptions(fs)
+	opts.MaxFileSize = 8 << 10
+	bl, err := NewBulkLoader(*opts, TEST_DIR, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.FailSyncs(ErrInjectedFault)
+	for i := 0; i < 2000; i++ {
+		bl.Set(fmt.Sprintf("k%d", i), make([]byte, 100))
+	}
+	if err = bl.Close(); err != ErrInjectedFault {
+		t.Fatalf("failed seal expects reported by close, err=%v", err)
+	}
+	l, err := fs.Lock(getLockFilePath(TEST_DIR))
+	if err != nil {
+		t.Fatalf("failed bulk load expects dir unlocked, err=%v", err)
+	}
+	l.Close()
+}
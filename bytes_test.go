@@ -0,0 +1,65 @@
+package beecask
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestBytesKeys(t *testing.T) {
+	opts := testOptions(NewMemFS())
+	opts.MaxFileSize = 300
+	bc := openTest(t, opts)
+	defer bc.Close()
+
+	key := []byte("k\xff")
+	if err := bc.SetBytes(key, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	// value of k is read from active file first, then from data file
+	for i := 0; i < 2; i++ {
+		v, err := bc.GetBytes(key)
+		if err != nil || string(v) != "hello" {
+			t.Fatalf("get bytes expects hello, got %q, err=%v", v, err)
+		}
+		buf := append(make([]byte, 0, 64), "v="...)
+		out, err := bc.GetInto(key, buf)
+		if err != nil || string(out) != "v=hello" || &out[0] != &buf[0] {
+			t.Fatalf("get into expects v=hello in dst, got %q, err=%v", out, err)
+		}
+		for j := 0; j < 20; j++ {
+			bc.Set("x", make([]byte, 50))
+		}
+	}
+	if _, err := bc.GetInto([]byte("none"), nil); err != ErrDataNotExist {
+		t.Fatalf("get into absent key expects ErrDataNotExist, err=%v", err)
+	}
+}
+
+func TestViewValue(t *testing.T) {
+	bc := openTest(t, testOptions(NewMemFS()))
+	defer bc.Close()
+
+	value := bytes.Repeat([]byte("v"), 100)
+	bc.SetBytes([]byte("k"), value)
+	var seen []byte
+	if err := bc.ViewValue([]byte("k"), func(v []byte) error {
+		seen = append(seen, v...)
+		return nil
+	}); err != nil || !bytes.Equal(seen, value) {
+		t.Fatalf("view value mismatches, err=%v", err)
+	}
+
+	errStop := fmt.Errorf("stop")
+	if err := bc.ViewValue([]byte("k"), func(v []byte) error {
+		return errStop
+	}); err != errStop {
+		t.Fatalf("view value expects error of fn, err=%v", err)
+	}
+	if err := bc.ViewValue([]byte("none"), func(v []byte) error {
+		t.Fatalf("fn called on absent key")
+		return nil
+	}); err != ErrDataNotExist {
+		t.Fatalf("view absent key expects ErrDataNotExist, err=%v", err)
+	}
+}
@@ -0,0 +1,360 @@
+package beecask
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	CHECKPOINT_MAGIC       = "BCKDCP01"
+	CHECKPOINT_HEADER_SIZE = 48
+)
+
+var errCheckpointInvalid = fmt.Errorf("Checkpoint is invalid")
+
+// keydirCheckpoint is the position a key dir checkpoint covers: records
+// of data files before fileId and the first offset bytes of fileId
+type keydirCheckpoint struct {
+	fileId      uint64
+	offset      int64
+	seq         uint64
+	maxBucketId uint64
+	fileSize    int64 // size of data file fileId found by load
+}
+
+// Checkpoint file keeps the whole key dir of memory index mode, so that
+// restore only replays records after its position, little endian:
+//
+//	header: magic(8) fileId(8) offset(8) seq(8) maxBucketId(8) count(8)
+//	item:   uvarint(len(key)) key uvarint(fileId) uvarint(valuePos)
+//	        uvarint(valueSize) uvarint(flag) varint(expiration) uvarint(seq)
+//	        uvarint(len(operands)) [uvarint(fileId) uvarint(valuePos)]*
+//	crc(4)
+//
+// crc is crc32 of all bytes before it, count is the number of items.
+// Range tombstones are not kept, keys they cover are out of key dir.
+
+// checkpointPeriodically writes checkpoint every interval until Close
+func (bc *Beecask) checkpointPeriodically(interval time.Duration) {
+	defer close(bc.checkpointDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bc.checkpointStop:
+			return
+		case <-ticker.C:
+			bc.checkpoint()
+		}
+	}
+}
+
+// checkpoint syncs active file and writes checkpoint of key dir, reads and
+// writes wait meanwhile
+func (bc *Beecask) checkpoint() {
+	// merge must not remove data files and records dropped by sweeper must
+	// be reported before they are out of checkpoint
+	bc.hookMutex.Lock()
+	defer bc.hookMutex.Unlock()
+	bc.rwMutex.Lock()
+	defer bc.rwMutex.Unlock()
+	if bc.degraded != nil {
+		return
+	}
+	if err := bc.sync(); err != nil {
+		bc.logger.Errorf("Sync before checkpoint failed, err=%s", err)
+		return
+	}
+	bc.writeCheckpoint()
+}
+
+// writeCheckpoint writes key dir to a temporary file and renames it after
+// synced, active file must have been synced.
+// writeCheckpoint requires bc.rwMutex held
+func (bc *Beecask) writeCheckpoint() {
+	kd, ok := bc.keydir.index.(*KeyDir)
+	if !ok {
+		return
+	}
+	bc.applyRanges()
+	cp := &keydirCheckpoint{
+		fileId:      bc.activeFile.FileId(),
+		offset:      bc.activeFile.Size(),
+		seq:         bc.seq,
+		maxBucketId: bc.maxBucketId,
+	}
+	begin := time.Now()
+	path := getCheckpointFilePath(bc.dirPath)
+	tmpPath := path + TEMP_FILE_SUFFIX
+	err := writeCheckpointFile(bc.fs, tmpPath, cp, kd)
+	if err == nil {
+		err = bc.fs.Rename(tmpPath, path)
+	}
+	if err != nil {
+		bc.logger.Errorf("Write checkpoint failed, err=%s", err)
+		bc.fs.Remove(tmpPath)
+		return
+	}
+	bc.logger.Infof("Write checkpoint of %d keys at datafile[%d]:%d in %s", kd.Len(), cp.fileId, cp.offset, time.Since(begin))
+}
+
+func writeCheckpointFile(fs FS, path string, cp *keydirCheckpoint, kd *KeyDir) error {
+	f, err := fs.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = f.Truncate(0); err != nil {
+		return err
+	}
+	bw := bufio.NewWriterSize(&appendWriter{f: f}, 1<<20)
+	crc := crc32.NewIEEE()
+	w := io.MultiWriter(bw, crc)
+
+	header := make([]byte, CHECKPOINT_HEADER_SIZE)
+	copy(header[0:8], CHECKPOINT_MAGIC)
+	binary.LittleEndian.PutUint64(header[8:16], cp.fileId)
+	binary.LittleEndian.PutUint64(header[16:24], uint64(cp.offset))
+	binary.LittleEndian.PutUint64(header[24:32], cp.seq)
+	binary.LittleEndian.PutUint64(header[32:40], cp.maxBucketId)
+	binary.LittleEndian.PutUint64(header[40:48], uint64(len(kd.dict)))
+	if _, err = w.Write(header); err != nil {
+		return err
+	}
+
+	var buf []byte
+	for key, item := range kd.dict {
+		buf = binary.AppendUvarint(buf[:0], uint64(len(key)))
+		buf = append(buf, key...)
+		buf = binary.AppendUvarint(buf, item.fileId)
+		buf = binary.AppendUvarint(buf, uint64(item.valuePos))
+		buf = binary.AppendUvarint(buf, uint64(item.valueSize))
+		buf = binary.AppendUvarint(buf, uint64(item.flag))
+		buf = binary.AppendVarint(buf, item.expiration)
+		buf = binary.AppendUvarint(buf, item.seq)
+		buf = binary.AppendUvarint(buf, uint64(len(item.operands)))
+		for _, ref := range item.operands {
+			buf = binary.AppendUvarint(buf, ref.fileId)
+			buf = binary.AppendUvarint(buf, uint64(ref.valuePos))
+		}
+		if _, err = w.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], crc.Sum32())
+	if _, err = bw.Write(sum[:]); err != nil {
+		return err
+	}
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// loadCheckpoint loads checkpoint into key dir if it is valid for data files
+// dataFileIds found by scan, it returns nil if all data files have to be
+// restored. Checkpoint is only valid if every data file it refers to is
+// still there, merge writes a new one when it is done, so only a crash
+// during merge makes a full restore.
+func (bc *Beecask) loadCheckpoint(dataFileIds []uint64) *keydirCheckpoint {
+	path := getCheckpointFilePath(bc.dirPath)
+	if _, err := bc.fs.Stat(path); err != nil {
+		return nil
+	}
+	cp, kd, err := bc.readCheckpoint(path, dataFileIds)
+	if err != nil {
+		bc.logger.Infof("Restore all data files, checkpoint is not used, reason=%s", err)
+		return nil
+	}
+	bc.keydir.index = kd
+	bc.seq = cp.seq
+	bc.maxBucketId = cp.maxBucketId
+	bc.logger.Infof("restore from checkpoint at datafile[%d]:%d succ.", cp.fileId, cp.offset)
+	return cp
+}
+
+func (bc *Beecask) readCheckpoint(path string, dataFileIds []uint64) (*keydirCheckpoint, *KeyDir, error) {
+	f, err := bc.fs.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	size, err := f.Size()
+	if err != nil {
+		return nil, nil, err
+	}
+	if size < CHECKPOINT_HEADER_SIZE+4 {
+		return nil, nil, errCheckpointInvalid
+	}
+	cr := &checkpointReader{
+		br:   bufio.NewReaderSize(io.NewSectionReader(f, 0, size-4), 1<<20),
+		crc:  crc32.NewIEEE(),
+		size: size,
+	}
+
+	header := make([]byte, CHECKPOINT_HEADER_SIZE)
+	cr.readFull(header)
+	if cr.err != nil || string(header[0:8]) != CHECKPOINT_MAGIC {
+		return nil, nil, errCheckpointInvalid
+	}
+	cp := &keydirCheckpoint{
+		fileId:      binary.LittleEndian.Uint64(header[8:16]),
+		offset:      int64(binary.LittleEndian.Uint64(header[16:24])),
+		seq:         binary.LittleEndian.Uint64(header[24:32]),
+		maxBucketId: binary.LittleEndian.Uint64(header[32:40]),
+	}
+	count := binary.LittleEndian.Uint64(header[40:48])
+
+	exists := make(map[uint64]bool, len(dataFileIds))
+	for _, fileId := range dataFileIds {
+		exists[fileId] = true
+	}
+	// data file cp.fileId must hold the records checkpoint covers, the
+	// ones appended after them are replayed
+	if exists[cp.fileId] {
+		if cp.fileSize, err = bc.dataFileSize(cp.fileId); err != nil {
+			return nil, nil, err
+		}
+	}
+	if cp.fileSize < cp.offset {
+		return nil, nil, fmt.Errorf("Datafile[%d] is shorter than checkpoint", cp.fileId)
+	}
+	covered := func(fileId uint64) bool {
+		return exists[fileId] && fileId <= cp.fileId
+	}
+
+	kd := NewKeyDir()
+	item := &KDItem{}
+	for i := uint64(0); i < count; i++ {
+		key := cr.readBytes()
+		item.fileId = cr.uvarint()
+		item.valuePos = uint32(cr.uvarint())
+		item.valueSize = uint32(cr.uvarint())
+		item.flag = uint32(cr.uvarint())
+		item.expiration = cr.varint()
+		item.seq = cr.uvarint()
+		item.operands = nil
+		for n := cr.uvarint(); n > 0 && cr.err == nil; n-- {
+			fileId, valuePos := cr.uvarint(), uint32(cr.uvarint())
+			if cr.err == nil && !covered(fileId) {
+				return nil, nil, fmt.Errorf("Datafile[%d] of checkpoint is gone", fileId)
+			}
+			item.appendOperand(fileId, valuePos)
+		}
+		if cr.err != nil {
+			return nil, nil, cr.err
+		}
+		if !covered(item.fileId) {
+			return nil, nil, fmt.Errorf("Datafile[%d] of checkpoint is gone", item.fileId)
+		}
+		kd.Set(string(key), item)
+	}
+
+	// nothing follows the last item but crc
+	if _, err = cr.br.ReadByte(); err != io.EOF {
+		return nil, nil, errCheckpointInvalid
+	}
+	sum := make([]byte, 4)
+	if _, err = f.ReadAt(sum, size-4); err != nil {
+		return nil, nil, err
+	}
+	if binary.LittleEndian.Uint32(sum) != cr.crc.Sum32() {
+		return nil, nil, ErrDataCorruption
+	}
+	return cp, kd, nil
+}
+
+// dataFileSize returns size of data file fileId, local or offloaded
+func (bc *Beecask) dataFileSize(fileId uint64) (int64, error) {
+	if bc.tier != nil {
+		if size, ok := bc.tier.offloaded(fileId); ok {
+			return size, nil
+		}
+	}
+	fi, err := bc.fs.Stat(bc.dataFilePath(fileId))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// removeCheckpoint removes checkpoint left by memory index mode, it would
+// be stale at next open after data files are changed in other modes
+func (bc *Beecask) removeCheckpoint() error {
+	err := bc.fs.Remove(getCheckpointFilePath(bc.dirPath))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// checkpointReader reads checkpoint file and hashes bytes read, err is
+// the first error and values read after it are zero
+type checkpointReader struct {
+	br   *bufio.Reader
+	crc  hash.Hash32
+	size int64 // size of checkpoint file, longer keys are corruption
+	err  error
+}
+
+// ReadByte reads a hashed byte, for binary.ReadUvarint
+func (cr *checkpointReader) ReadByte() (byte, error) {
+	b, err := cr.br.ReadByte()
+	if err != nil {
+		return 0, errCheckpointInvalid
+	}
+	cr.crc.Write([]byte{b})
+	return b, nil
+}
+
+func (cr *checkpointReader) readFull(data []byte) {
+	if cr.err != nil {
+		return
+	}
+	if _, err := io.ReadFull(cr.br, data); err != nil {
+		cr.err = errCheckpointInvalid
+		return
+	}
+	cr.crc.Write(data)
+}
+
+func (cr *checkpointReader) readBytes() []byte {
+	n := cr.uvarint()
+	if cr.err != nil || n > uint64(cr.size) {
+		cr.err = errCheckpointInvalid
+		return nil
+	}
+	data := make([]byte, n)
+	cr.readFull(data)
+	return data
+}
+
+func (cr *checkpointReader) uvarint() uint64 {
+	if cr.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(cr)
+	if err != nil {
+		cr.err = errCheckpointInvalid
+	}
+	return v
+}
+
+func (cr *checkpointReader) varint() int64 {
+	if cr.err != nil {
+		return 0
+	}
+	v, err := binary.ReadVarint(cr)
+	if err != nil {
+		cr.err = errCheckpointInvalid
+	}
+	return v
+}
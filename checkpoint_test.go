@@ -0,0 +1,153 @@
+package beecask
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dumpState returns all keys and values, bucket b included
+func dumpState(t *testing.T, bc *Beecask) string {
+	t.Helper()
+	var sb strings.Builder
+	keys := bc.Keys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		v, err := bc.Get(key)
+		fmt.Fprintf(&sb, "%q=%q,%v;", key, v, err)
+	}
+	if b, err := bc.Bucket("b"); err == nil {
+		keys = b.Keys()
+		sort.Strings(keys)
+		for _, key := range keys {
+			v, _ := b.Get(key)
+			fmt.Fprintf(&sb, "b/%q=%q;", key, v)
+		}
+	}
+	fmt.Fprintf(&sb, "count=%d", bc.Count())
+	return sb.String()
+}
+
+func TestCheckpoint(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	opts := testOptions(fs)
+	opts.MaxFileSize = 4 << 10
+	opts.MergeOperator = Int64AddOperator{}
+	reopen := func(bc *Beecask, crash bool) (*Beecask, *recordLogger) {
+		t.Helper()
+		logger := &recordLogger{}
+		opts.Logger = logger
+		if crash {
+			return crashTest(t, bc, fs, opts), logger
+		}
+		bc.Close()
+		return openTest(t, opts), logger
+	}
+
+	bc := openTest(t, opts)
+	for i := 0; i < 300; i++ {
+		bc.Set(fmt.Sprintf("k%d", i), []byte(strings.Repeat("x", i%40)))
+	}
+	bc.Delete("k5")
+	bc.Incr("n", 3)
+	bc.Append("n", encodeInt64(4))
+	bc.SetWithTTL("ttl", []byte("t"), time.Hour)
+	b, _ := bc.Bucket("b")
+	b.Set("in", []byte("bucket"))
+	bc.DeletePrefix("k29")
+	want := dumpState(t, bc)
+
+	bc, logger := reopen(bc, false)
+	if !logger.has("restore from checkpoint") || logger.has("restore from hintfile") || logger.has("restore from datafile") {
+		t.Fatalf("clean restart expects restored from checkpoint only, log=%v", logger.infos)
+	}
+	if got := dumpState(t, bc); got != want {
+		t.Fatalf("clean restart: state mismatches\n%s\n%s", got, want)
+	}
+	if ttl, err := bc.TTL("ttl"); err != nil || ttl <= 0 {
+		t.Fatalf("ttl expects kept by checkpoint, got %s, err=%v", ttl, err)
+	}
+
+	// records written after checkpoint are replayed
+	bc.checkpoint()
+	for i := 0; i < 100; i++ {
+		bc.Set(fmt.Sprintf("k%d", i), []byte("new"))
+	}
+	bc.Incr("n", 1)
+	bc.DeletePrefix("k1")
+	b, _ = bc.Bucket("b")
+	b.Set("in2", []byte("later"))
+	bc.Sync()
+	want = dumpState(t, bc)
+	bc, logger = reopen(bc, true)
+	if !logger.has("restore from checkpoint") {
+		t.Fatalf("crash expects restored from checkpoint, log=%v", logger.infos)
+	}
+	if got := dumpState(t, bc); got != want {
+		t.Fatalf("crash: state mismatches\n%s\n%s", got, want)
+	}
+	if n, _ := bc.Incr("n", 0); n != 8 {
+		t.Fatalf("counter expects 8, got %d", n)
+	}
+
+	// merge after checkpoint replaces it
+	bc.checkpoint()
+	rotateTest(t, bc)
+	mergeTest(t, bc)
+	bc.Set("k0", []byte("merged"))
+	bc.Sync()
+	want = dumpState(t, bc)
+	bc, logger = reopen(bc, true)
+	if !logger.has("restore from checkpoint") || logger.has("checkpoint is not used") {
+		t.Fatalf("merge expects restored from new checkpoint, log=%v", logger.infos)
+	}
+	if got := dumpState(t, bc); got != want {
+		t.Fatalf("merge: state mismatches\n%s\n%s", got, want)
+	}
+	bc.Close()
+
+	cpPath := getCheckpointFilePath(TEST_DIR)
+	fi, err := fs.Stat(cpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Corrupt(cpPath, fi.Size()/2); err != nil {
+		t.Fatal(err)
+	}
+	logger = &recordLogger{}
+	opts.Logger = logger
+	bc = openTest(t, opts)
+	if !logger.has("checkpoint is not used") {
+		t.Fatalf("corrupted checkpoint expects not used")
+	}
+	if got := dumpState(t, bc); got != want {
+		t.Fatalf("corrupted checkpoint: state mismatches\n%s\n%s", got, want)
+	}
+	bc.Close()
+
+	opts.IndexMode = INDEX_MODE_HASH
+	bc = openTest(t, opts)
+	bc.Close()
+	if _, err = fs.Stat(cpPath); err == nil {
+		t.Fatalf("hash mode expects checkpoint removed")
+	}
+}
+
+func TestCheckpointPeriodically(t *testing.T) {
+	fs := NewMemFS()
+	opts := testOptions(fs)
+	opts.CheckpointInterval = 10 * time.Millisecond
+	bc := openTest(t, opts)
+	defer bc.Close()
+
+	bc.Set("k", []byte("v"))
+	for i := 0; i < 100; i++ {
+		if _, err := fs.Stat(getCheckpointFilePath(TEST_DIR)); err == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("checkpoint expects written periodically")
+}
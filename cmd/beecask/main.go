@@ -0,0 +1,169 @@
+// Command beecask exports a database to a portable stream and imports one.
+//
+//	beecask export -dir DIR [-format jsonl|binary] [-o FILE] [-tombstones]
+//	beecask import -dir DIR [-format jsonl|binary] [-i FILE] [-batch N] [-drop-expiration] [-keep-expired]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/yplusplus/beecask"
+)
+
+const usage = `usage: beecask export -dir DIR [-format jsonl|binary] [-o FILE] [-tombstones]
+       beecask import -dir DIR [-format jsonl|binary] [-i FILE] [-batch N] [-drop-expiration] [-keep-expired]
+`
+
+// dbFlags are flags to open a database
+type dbFlags struct {
+	dir      string
+	dataDirs string
+	blobDir  string
+	format   string
+	verbose  bool
+}
+
+func (df *dbFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&df.dir, "dir", "", "database directory")
+	fs.StringVar(&df.dataDirs, "data-dirs", "", "comma separated dirs of data files of the database")
+	fs.StringVar(&df.blobDir, "blob-dir", "", "dir of blob store holding offloaded data files")
+	fs.StringVar(&df.format, "format", "jsonl", "stream format: jsonl or binary")
+	fs.BoolVar(&df.verbose, "v", false, "log database events to stderr")
+}
+
+func (df *dbFlags) exportFormat() (int, error) {
+	switch df.format {
+	case "jsonl":
+		return beecask.EXPORT_FORMAT_JSONL, nil
+	case "binary":
+		return beecask.EXPORT_FORMAT_BINARY, nil
+	}
+	return 0, fmt.Errorf("unknown format %q", df.format)
+}
+
+func (df *dbFlags) open() (*beecask.Beecask, error) {
+	if df.dir == "" {
+		return nil, fmt.Errorf("-dir is required")
+	}
+	options := beecask.NewOptions()
+	level := slog.LevelError + 1 // quiet
+	if df.verbose {
+		level = slog.LevelInfo
+	}
+	options.Logger = beecask.NewSlogLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	if df.dataDirs != "" {
+		for _, d := range strings.Split(df.dataDirs, ",") {
+			options.DataDirs = append(options.DataDirs, beecask.DataDir{Path: d})
+		}
+	}
+	if df.blobDir != "" {
+		store, err := beecask.NewDirBlobStore(nil, df.blobDir)
+		if err != nil {
+			return nil, err
+		}
+		options.BlobStore = store
+	}
+	return beecask.NewBeecask(*options, df.dir)
+}
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var df dbFlags
+	df.register(fs)
+	out := fs.String("o", "-", "output file, - for stdout")
+	tombstones := fs.Bool("tombstones", false, "export deleted keys as tombstones")
+	fs.Parse(args)
+
+	format, err := df.exportFormat()
+	if err != nil {
+		return err
+	}
+	bc, err := df.open()
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if err = bc.ExportWithOptions(w, format, beecask.ExportOptions{Tombstones: *tombstones}); err != nil {
+		return err
+	}
+	if f, ok := w.(*os.File); ok && f != os.Stdout {
+		return f.Sync()
+	}
+	return nil
+}
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	var df dbFlags
+	df.register(fs)
+	in := fs.String("i", "-", "input file, - for stdin")
+	batch := fs.Int("batch", beecask.IMPORT_BATCH_SIZE, "entries per batched write")
+	dropExpiration := fs.Bool("drop-expiration", false, "imported keys never expire")
+	keepExpired := fs.Bool("keep-expired", false, "import keys which have expired already")
+	fs.Parse(args)
+
+	format, err := df.exportFormat()
+	if err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	bc, err := df.open()
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+
+	opts := beecask.ImportOptions{
+		BatchSize:      *batch,
+		KeepExpiration: !*dropExpiration,
+		SkipExpired:    !*keepExpired,
+	}
+	if err = bc.ImportWithOptions(r, format, opts); err != nil {
+		return err
+	}
+	return bc.Sync()
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = runExport(os.Args[2:])
+	case "import":
+		err = runImport(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "beecask %s: %s\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,700 @@
+package beecask
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	crashSeed  = flag.Int64("crash.seed", 0, "seed of crash tests, zero picks one by time")
+	crashSteps = flag.Int("crash.steps", 3000, "operations per crash test")
+	crashRuns  = flag.Int("crash.runs", 8, "runs of crash tests, each with its own seed")
+)
+
+const (
+	CRASH_TEST_DIR         = "/db"
+	CRASH_TEST_KEYS        = 64
+	CRASH_TEST_BUCKET      = "b"
+	CRASH_TEST_BUCKET_KEYS = 16
+)
+
+// keys of bucket are kept in model with CRASH_TEST_BUCKET_PREFIX, it sorts
+// before keys out of buckets, so that range deletes of them never cover it
+const CRASH_TEST_BUCKET_PREFIX = CRASH_TEST_BUCKET + "/"
+
+type modelValue struct {
+	value      []byte
+	expiration int64
+}
+
+// model is the expected content of database, a deleted key is absent
+type model map[string]modelValue
+
+// modelOp is a write to model. A ranged op deletes keys in [key, end), empty
+// end means no upper bound. value of an op written by Append is the folded
+// value, operand is what has been appended.
+type modelOp struct {
+	key        string
+	value      []byte
+	operand    []byte
+	expiration int64
+	delete     bool
+	ranged     bool
+	end        string
+}
+
+func (m model) apply(op modelOp) {
+	switch {
+	case op.ranged:
+		for key := range m {
+			if key >= op.key && (op.end == "" || key < op.end) {
+				delete(m, key)
+			}
+		}
+	case op.delete:
+		delete(m, op.key)
+	default:
+		m[op.key] = modelValue{value: op.value, expiration: op.expiration}
+	}
+}
+
+func (m model) clone() model {
+	c := make(model, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// get returns value of key unless it is absent or expired
+func (m model) get(key string, now int64) ([]byte, bool) {
+	v, ok := m[key]
+	if !ok || (v.expiration > 0 && v.expiration <= now) {
+		return nil, false
+	}
+	return v.value, true
+}
+
+// crashHarness runs random operations against a database on a FaultFS
+// and checks results against a model
+type crashHarness struct {
+	t       *testing.T
+	seed    int64
+	rnd     *rand.Rand
+	fs      *FaultFS
+	opts    options
+	bc      *Beecask
+	keys    []string    // keys out of buckets and keys of bucket in model
+	current model       // acknowledged writes
+	durable model       // writes made durable by Sync or Close
+	pending [][]modelOp // atomic writes acknowledged since durable
+	now     int64
+}
+
+func newCrashHarness(t *testing.T, seed int64) *crashHarness {
+	h := &crashHarness{
+		t:       t,
+		seed:    seed,
+		rnd:     rand.New(rand.NewSource(seed)),
+		fs:      NewFaultFS(NewMemFS()),
+		current: make(model),
+		durable: make(model),
+		now:     time.Now().Unix(),
+	}
+	for i := 0; i < CRASH_TEST_KEYS; i++ {
+		h.keys = append(h.keys, fmt.Sprintf("key-%03d", i))
+	}
+	for i := 0; i < CRASH_TEST_BUCKET_KEYS; i++ {
+		h.keys = append(h.keys, fmt.Sprintf("%skey-%03d", CRASH_TEST_BUCKET_PREFIX, i))
+	}
+
+	opts := NewOptions()
+	opts.FS = h.fs
+	opts.Logger = NopLogger{}
+	opts.MergeOperator = concatOperator{}
+	opts.WriteBufferSize = 16 << h.rnd.Intn(8) // 16B - 2K
+	opts.MaxFileSize = 1 << (10 + h.rnd.Intn(4))
+	opts.IndexMode = h.rnd.Intn(2)
+	if h.rnd.Intn(2) == 0 {
+		opts.DataDirs = []DataDir{{Path: CRASH_TEST_DIR, Weight: 2}, {Path: "/disk1"}}
+	}
+	if h.rnd.Intn(2) == 0 {
+		store, err := NewDirBlobStore(h.fs, "/blobs")
+		if err != nil {
+			t.Fatalf("new blob store failed, err=%s", err)
+		}
+		opts.BlobStore = store
+		opts.OffloadAfter = 1 + h.rnd.Intn(3)
+		opts.BlobCacheLocal = h.rnd.Intn(2) == 0
+	}
+	if h.rnd.Intn(2) == 0 {
+		// values are up to 200 bytes, about three quarters of them separated
+		opts.ValueThreshold = 50
+	}
+	h.opts = *opts
+	h.open()
+	return h
+}
+
+func (h *crashHarness) fatalf(format string, v ...interface{}) {
+	h.t.Helper()
+	h.t.Fatalf("seed %d: %s, replay with -crash.seed=%d", h.seed, fmt.Sprintf(format, v...), h.seed)
+}
+
+func (h *crashHarness) open() {
+	h.t.Helper()
+	bc, err := NewBeecask(h.opts, CRASH_TEST_DIR)
+	if err != nil {
+		h.fatalf("open failed, err=%s", err)
+	}
+	h.bc = bc
+}
+
+func (h *crashHarness) randomKey() string {
+	return h.keys[h.rnd.Intn(len(h.keys))]
+}
+
+// randomDefaultKey returns a key out of buckets
+func (h *crashHarness) randomDefaultKey() string {
+	return h.keys[h.rnd.Intn(CRASH_TEST_KEYS)]
+}
+
+// bucket returns the bucket of test, nil if it does not exist
+func (h *crashHarness) bucket() *Bucket {
+	h.t.Helper()
+	names := h.bc.Buckets()
+	if len(names) == 0 {
+		return nil
+	}
+	if len(names) != 1 || names[0] != CRASH_TEST_BUCKET {
+		h.fatalf("buckets expect %q at most, got %v", CRASH_TEST_BUCKET, names)
+	}
+	b, err := h.bc.Bucket(CRASH_TEST_BUCKET)
+	if err != nil {
+		h.fatalf("open bucket failed, err=%s", err)
+	}
+	return b
+}
+
+// get reads key of model from database
+func (h *crashHarness) get(key string) ([]byte, error) {
+	if !strings.HasPrefix(key, CRASH_TEST_BUCKET_PREFIX) {
+		return h.bc.Get(key)
+	}
+	b := h.bucket()
+	if b == nil {
+		return nil, ErrDataNotExist
+	}
+	return b.Get(key[len(CRASH_TEST_BUCKET_PREFIX):])
+}
+
+func (h *crashHarness) randomValue() []byte {
+	value := make([]byte, h.rnd.Intn(200))
+	h.rnd.Read(value)
+	return value
+}
+
+// write writes op to database
+func (h *crashHarness) write(op modelOp) error {
+	bucketKey := strings.TrimPrefix(op.key, CRASH_TEST_BUCKET_PREFIX)
+	if op.ranged && op.key == CRASH_TEST_BUCKET_PREFIX {
+		return h.bc.DropBucket(CRASH_TEST_BUCKET)
+	}
+	if op.ranged {
+		return h.bc.DeleteRange(op.key, op.end)
+	}
+	if bucketKey != op.key {
+		b, err := h.bc.Bucket(CRASH_TEST_BUCKET)
+		if err != nil {
+			return err
+		}
+		if op.delete {
+			return b.Delete(bucketKey)
+		}
+		return b.Set(bucketKey, op.value)
+	}
+	switch {
+	case op.operand != nil:
+		return h.bc.Append(op.key, op.operand)
+	case op.delete:
+		return h.bc.Delete(op.key)
+	case op.expiration != 0:
+		return h.bc.SetWithExpiration(op.key, op.value, op.expiration)
+	}
+	return h.bc.Set(op.key, op.value)
+}
+
+// acknowledge applies ops written atomically to model
+func (h *crashHarness) acknowledge(ops ...modelOp) {
+	for _, op := range ops {
+		h.current.apply(op)
+	}
+	h.pending = append(h.pending, ops)
+}
+
+// randomWrite writes to database randomly, it returns the ops written
+// atomically to apply to model, which are nil if nothing is expected to be
+// written, and the error of the write
+func (h *crashHarness) randomWrite() ([]modelOp, error) {
+	h.t.Helper()
+	var op modelOp
+	switch n := h.rnd.Intn(100); {
+	case n < 32:
+		op = modelOp{key: h.randomKey(), value: h.randomValue()}
+	case n < 40:
+		// expired already or a long time later
+		expiration := h.now + 3600
+		if h.rnd.Intn(2) == 0 {
+			expiration = h.now - 3600
+		}
+		op = modelOp{key: h.randomDefaultKey(), value: h.randomValue(), expiration: expiration}
+	case n < 50:
+		op = modelOp{key: h.randomKey(), delete: true}
+	case n < 56:
+		operand := make([]byte, h.rnd.Intn(20))
+		h.rnd.Read(operand)
+		op = h.appendOp(h.randomDefaultKey(), operand)
+	case n < 62:
+		return h.update()
+	case n < 65:
+		return h.deleteRange()
+	case n < 73:
+		return h.touch()
+	case n < 81:
+		return h.compareAndSwap()
+	case n < 89:
+		return h.incr()
+	default:
+		return h.setReader()
+	}
+	return []modelOp{op}, h.write(op)
+}
+
+// appendOp returns op appending operand to key, operand keeps expiration of key
+func (h *crashHarness) appendOp(key string, operand []byte) modelOp {
+	op := modelOp{key: key, value: operand, operand: operand}
+	if v, ok := h.current.get(key, h.now); ok {
+		op.value = append(append([]byte(nil), v...), operand...)
+		op.expiration = h.current[key].expiration
+	}
+	return op
+}
+
+// keepExpiration returns op setting key to value with expiration of key
+func (h *crashHarness) keepExpiration(key string, value []byte) modelOp {
+	op := modelOp{key: key, value: value}
+	if _, ok := h.current.get(key, h.now); ok {
+		op.expiration = h.current[key].expiration
+	}
+	return op
+}
+
+// update writes random ops in a transaction, some of them write what the
+// transaction reads
+func (h *crashHarness) update() ([]modelOp, error) {
+	h.t.Helper()
+	var ops []modelOp
+	var reads []bool
+	for i := h.rnd.Intn(4); i >= 0; i-- {
+		op := modelOp{key: h.randomDefaultKey()}
+		switch h.rnd.Intn(3) {
+		case 0:
+			op.delete = true
+		case 1:
+			op.value = h.randomValue()
+		}
+		ops = append(ops, op)
+		reads = append(reads, !op.delete && op.value == nil)
+	}
+
+	err := h.bc.Update(func(tx *Txn) error {
+		for i := range ops {
+			op := &ops[i]
+			if op.delete {
+				if err := tx.Delete(op.key); err != nil {
+					return err
+				}
+				continue
+			}
+			if reads[i] {
+				// the value written doubles what is read
+				value, err := tx.Get(op.key)
+				if err != nil && err != ErrDataNotExist {
+					return err
+				}
+				op.value = append(append([]byte{}, value...), value...)
+			}
+			if err := tx.Set(op.key, op.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return ops, err
+}
+
+// touch changes expiration of a key by Touch, Expire or Persist
+func (h *crashHarness) touch() ([]modelOp, error) {
+	h.t.Helper()
+	key := h.randomDefaultKey()
+	value, ok := h.current.get(key, h.now)
+	op := modelOp{key: key, value: value}
+	var err error
+	switch h.rnd.Intn(3) {
+	case 0:
+		// expired already or a long time later
+		op.expiration = h.now + 3600
+		if h.rnd.Intn(2) == 0 {
+			op.expiration = h.now - 3600
+		}
+		err = h.bc.Touch(key, op.expiration)
+	case 1:
+		op.expiration = h.now + 3600
+		err = h.bc.Expire(key, time.Hour)
+	default:
+		err = h.bc.Persist(key)
+	}
+	if !ok {
+		if err != ErrDataNotExist {
+			h.fatalf("touch of absent key %q expects ErrDataNotExist, err=%v", key, err)
+		}
+		return nil, nil
+	}
+	return []modelOp{op}, err
+}
+
+// compareAndSwap sets a key by the version read, or by a stale one which
+// must not set it
+func (h *crashHarness) compareAndSwap() ([]modelOp, error) {
+	h.t.Helper()
+	key := h.randomDefaultKey()
+	_, version, err := h.bc.GetWithVersion(key)
+	if err != nil && err != ErrDataNotExist {
+		h.fatalf("get version of %q failed, err=%s", key, err)
+	}
+	op := h.keepExpiration(key, h.randomValue())
+	if h.rnd.Intn(4) == 0 {
+		if _, err = h.bc.CompareAndSwap(key, version+1, op.value); err != ErrVersionMismatch {
+			h.fatalf("compare and swap %q by stale version expects ErrVersionMismatch, err=%v", key, err)
+		}
+		return nil, nil
+	}
+	_, err = h.bc.CompareAndSwap(key, version, op.value)
+	return []modelOp{op}, err
+}
+
+// incr adds to a key which is absent or holds a counter, others must fail
+func (h *crashHarness) incr() ([]modelOp, error) {
+	h.t.Helper()
+	key := h.randomDefaultKey()
+	value, ok := h.current.get(key, h.now)
+	if ok && len(value) == 0 {
+		// an empty value may be read as absent
+		return nil, nil
+	}
+	delta := h.rnd.Int63n(100) - 50
+	n, err := h.bc.Incr(key, delta)
+	if ok && len(value) != 8 {
+		if err != ErrInvalid {
+			h.fatalf("incr of %q holding %d bytes expects ErrInvalid, err=%v", key, len(value), err)
+		}
+		return nil, nil
+	}
+	old, _ := decodeInt64(value)
+	if err == nil && n != old+delta {
+		h.fatalf("incr of %q expects %d, got %d", key, old+delta, n)
+	}
+	return []modelOp{h.keepExpiration(key, encodeInt64(old+delta))}, err
+}
+
+// setReader sets a key by SetReader, values larger than write buffer are
+// streamed into value logs of their own
+func (h *crashHarness) setReader() ([]modelOp, error) {
+	h.t.Helper()
+	value := h.randomValue()
+	if h.rnd.Intn(2) == 0 {
+		value = make([]byte, h.opts.WriteBufferSize+1+h.rnd.Intn(1000))
+		h.rnd.Read(value)
+	}
+	op := modelOp{key: h.randomDefaultKey(), value: value}
+	return []modelOp{op}, h.bc.SetReader(op.key, bytes.NewReader(value), int64(len(value)))
+}
+
+// makeDurable marks all acknowledged writes durable
+func (h *crashHarness) makeDurable() {
+	h.durable = h.current.clone()
+	h.pending = nil
+}
+
+func (h *crashHarness) step() {
+	h.t.Helper()
+	switch n := h.rnd.Intn(100); {
+	case n < 60:
+		ops, err := h.randomWrite()
+		if err != nil {
+			h.fatalf("write failed, err=%s", err)
+		}
+		if ops != nil {
+			h.acknowledge(ops...)
+		}
+	case n < 80:
+		h.checkKey(h.randomKey())
+	case n < 86:
+		if h.rnd.Intn(4) == 0 && h.opts.IndexMode == INDEX_MODE_MEMORY {
+			// as the periodic checkpointer does, it syncs first
+			h.bc.checkpoint()
+		} else if err := h.bc.Sync(); err != nil {
+			h.fatalf("sync failed, err=%s", err)
+		}
+		h.makeDurable()
+	case n < 88:
+		h.bc.Merge()
+		if h.opts.ValueThreshold > 0 {
+			h.bc.ValueLogGC()
+		}
+		h.checkAll()
+	case n < 90:
+		h.fault()
+	case n < 93:
+		h.bc.Close()
+		h.makeDurable()
+		h.open()
+		h.checkAll()
+	case n < 97:
+		h.crash(false)
+	default:
+		h.crash(true)
+	}
+}
+
+// fault arms a write, short write, sync or rename fault and keeps writing
+// until a write fails. The failed write may or may not be applied, the
+// database degraded by it refuses writes until Recover makes all applied
+// writes durable.
+func (h *crashHarness) fault() {
+	h.t.Helper()
+	switch h.rnd.Intn(4) {
+	case 0:
+		h.fs.FailWrites(h.rnd.Intn(8), nil)
+	case 1:
+		h.fs.ShortWrites(h.rnd.Intn(8))
+	case 2:
+		h.fs.FailSyncs(ErrInjectedFault)
+	default:
+		h.fs.FailRenames(ErrInjectedFault)
+	}
+	var failed []modelOp
+	var err error
+	for i := 0; i < 16 && err == nil; i++ {
+		var ops []modelOp
+		switch n := h.rnd.Intn(10); {
+		case n < 7:
+			ops, err = h.randomWrite()
+		case n < 8:
+			err = h.bc.Sync()
+		case n < 9:
+			// failures of merge are only logged
+			h.bc.Merge()
+		default:
+			if h.opts.IndexMode == INDEX_MODE_MEMORY {
+				h.bc.checkpoint()
+			}
+		}
+		if err != nil {
+			failed = ops
+		} else if ops != nil {
+			h.acknowledge(ops...)
+		}
+	}
+	h.fs.ClearFaults()
+
+	degraded := h.bc.Degraded() != nil
+	if degraded {
+		if err = h.bc.Set(h.randomDefaultKey(), nil); err != ErrDegraded {
+			h.fatalf("write to degraded database expects ErrDegraded, err=%v", err)
+		}
+		if err = h.bc.Recover(); err != nil {
+			h.fatalf("recover failed, err=%s", err)
+		}
+	}
+	if failed != nil {
+		applied := h.current.clone()
+		for _, op := range failed {
+			applied.apply(op)
+		}
+		if d := h.diff(h.current); d != "" {
+			if h.diff(applied) != "" {
+				h.fatalf("failed write is neither applied nor not, %s", d)
+			}
+			h.acknowledge(failed...)
+		}
+	}
+	if degraded {
+		h.makeDurable()
+	}
+	h.checkAll()
+}
+
+// deleteRange deletes a prefix or a range of keys, or drops the bucket rarely
+func (h *crashHarness) deleteRange() ([]modelOp, error) {
+	h.t.Helper()
+	switch n := h.rnd.Intn(10); {
+	case n < 1:
+		if h.bucket() == nil {
+			return nil, nil
+		}
+		op := modelOp{key: CRASH_TEST_BUCKET_PREFIX, ranged: true, end: string(prefixEnd([]byte(CRASH_TEST_BUCKET_PREFIX)))}
+		return []modelOp{op}, h.write(op)
+	case n < 3:
+		b, err := h.bc.Bucket(CRASH_TEST_BUCKET)
+		if err != nil {
+			return nil, err
+		}
+		prefix := fmt.Sprintf("key-%03d", h.rnd.Intn(CRASH_TEST_BUCKET_KEYS))[:6]
+		err = b.DeletePrefix(prefix)
+		prefix = CRASH_TEST_BUCKET_PREFIX + prefix
+		return []modelOp{{key: prefix, ranged: true, end: string(prefixEnd([]byte(prefix)))}}, err
+	case n < 6:
+		// key-0xy shares prefix with 9 keys at most
+		prefix := h.randomDefaultKey()[:6]
+		err := h.bc.DeletePrefix(prefix)
+		return []modelOp{{key: prefix, ranged: true, end: string(prefixEnd([]byte(prefix)))}}, err
+	}
+	start, end := h.randomDefaultKey(), h.randomDefaultKey()
+	if end < start {
+		start, end = end, start
+	}
+	if start == end || h.rnd.Intn(8) == 0 {
+		end = ""
+	}
+	op := modelOp{key: start, ranged: true, end: end}
+	return []modelOp{op}, h.write(op)
+}
+
+// crash drops unsynced data and reopens database, which must hold durable
+// writes followed by a prefix of pending writes
+func (h *crashHarness) crash(torn bool) {
+	h.t.Helper()
+	var err error
+	if torn {
+		err = h.fs.TornCrash(h.rnd)
+	} else {
+		err = h.fs.Crash()
+	}
+	if err != nil {
+		h.fatalf("crash failed, err=%s", err)
+	}
+	h.bc.Close()
+	h.open()
+
+	expect := h.durable.clone()
+	candidates := []model{expect.clone()}
+	for _, ops := range h.pending {
+		for _, op := range ops {
+			expect.apply(op)
+		}
+		candidates = append(candidates, expect.clone())
+	}
+	// prefer the longest prefix, it is the most likely one
+	for i := len(candidates) - 1; i >= 0; i-- {
+		if h.diff(candidates[i]) == "" {
+			h.current = candidates[i]
+			h.makeDurable()
+			h.checkAll()
+			return
+		}
+	}
+	h.fatalf("state after crash matches no prefix of %d pending writes, durable diff: %s",
+		len(h.pending), h.diff(h.durable))
+}
+
+// diff returns the first difference between database and m
+func (h *crashHarness) diff(m model) string {
+	for _, key := range h.keys {
+		expect, ok := m.get(key, h.now)
+		value, err := h.get(key)
+		if !ok && err != ErrDataNotExist {
+			return fmt.Sprintf("key %q expects not exist, got err=%v", key, err)
+		}
+		if ok && (err != nil || !bytes.Equal(value, expect)) {
+			return fmt.Sprintf("key %q expects %d bytes, got %d bytes, err=%v", key, len(expect), len(value), err)
+		}
+	}
+	return ""
+}
+
+func (h *crashHarness) checkKey(key string) {
+	h.t.Helper()
+	expect, ok := h.current.get(key, h.now)
+	value, err := h.get(key)
+	if !ok && err != ErrDataNotExist {
+		h.fatalf("key %q expects not exist, got err=%v", key, err)
+	}
+	if ok && (err != nil || !bytes.Equal(value, expect)) {
+		h.fatalf("key %q expects %d bytes, got %d bytes, err=%v", key, len(expect), len(value), err)
+	}
+}
+
+func (h *crashHarness) checkAll() {
+	h.t.Helper()
+	if d := h.diff(h.current); d != "" {
+		h.fatalf("%s", d)
+	}
+	var expect, expectBucket []string
+	for key := range h.current {
+		if _, ok := h.current.get(key, h.now); !ok {
+			continue
+		}
+		if strings.HasPrefix(key, CRASH_TEST_BUCKET_PREFIX) {
+			expectBucket = append(expectBucket, key[len(CRASH_TEST_BUCKET_PREFIX):])
+		} else {
+			expect = append(expect, key)
+		}
+	}
+	keys := h.bc.Keys()
+	sort.Strings(expect)
+	sort.Strings(keys)
+	if fmt.Sprint(keys) != fmt.Sprint(expect) {
+		h.fatalf("keys mismatch, expect %d keys, got %d keys", len(expect), len(keys))
+	}
+	if count := h.bc.Count(); count != len(expect) {
+		h.fatalf("count mismatch, expect %d, got %d", len(expect), count)
+	}
+	var bucketKeys []string
+	if b := h.bucket(); b != nil {
+		bucketKeys = b.Keys()
+	}
+	sort.Strings(expectBucket)
+	sort.Strings(bucketKeys)
+	if fmt.Sprint(bucketKeys) != fmt.Sprint(expectBucket) {
+		h.fatalf("keys of bucket mismatch, expect %d keys, got %d keys", len(expectBucket), len(bucketKeys))
+	}
+}
+
+func TestCrashConsistency(t *testing.T) {
+	seed := *crashSeed
+	runs := *crashRuns
+	if seed != 0 {
+		runs = 1
+	} else {
+		seed = time.Now().UnixNano()
+	}
+	steps := *crashSteps
+	if testing.Short() {
+		steps /= 10
+	}
+	for i := 0; i < runs; i++ {
+		h := newCrashHarness(t, seed+int64(i))
+		for j := 0; j < steps; j++ {
+			h.step()
+		}
+		h.bc.Close()
+		t.Logf("seed %d passed %d steps", h.seed, steps)
+	}
+}
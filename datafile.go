@@ -5,10 +5,7 @@ import (
 	"encoding/binary"
 	"hash/crc32"
 	"io"
-	"os"
 	"sync"
-
-	"github.com/yplusplus/ylog"
 )
 
 const (
@@ -22,80 +19,107 @@ type DataFile struct {
 	fileId uint64
 }
 
-func NewDataFile(path string, fileId uint64) (*DataFile, error) {
-	f, err := os.OpenFile(path, os.O_RDONLY, 0644)
-	if err != nil {
-		ylog.Error(err)
-		return nil, err
-	}
-	file, err := NewMmapFile(f)
+func NewDataFile(fs FS, path string, fileId uint64, fa fileAccess) (*DataFile, error) {
+	file, err := fa.open(fs, path)
 	if err != nil {
-		ylog.Error(err)
-		f.Close()
 		return nil, err
 	}
+	return newDataFile(file, fileId), nil
+}
+
+func newDataFile(file RandomAccessFile, fileId uint64) *DataFile {
+	// reads are random except scans of ForEachRecord
+	file.Advise(ADVICE_RANDOM)
 
-	ylog.Tracef("Open datafile[%d]", fileId)
-	return &DataFile{file: file, fileId: fileId}, nil
+	return &DataFile{file: file, fileId: fileId}
 }
 
 // ReadRecordAt reads a record from specific offset
 func (df *DataFile) ReadRecordAt(offset int64) (*Record, error) {
-	buff, err := df.file.ReadAt(offset, DATA_ITEM_HEADER_SIZE)
-	if err != nil {
-		ylog.Warn(err)
+	r := &Record{}
+	if err := df.ReadRecordInto(offset, r); err != nil {
 		return nil, err
 	}
+	return r, nil
+}
 
-	// calculate crc
-	r := &Record{
-		crc:        binary.LittleEndian.Uint32(buff[0:4]),
-		flag:       binary.LittleEndian.Uint32(buff[4:8]),
-		expiration: int64(binary.LittleEndian.Uint64(buff[8:16])),
-		keySize:    binary.LittleEndian.Uint32(buff[16:20]),
-		valueSize:  binary.LittleEndian.Uint32(buff[20:24]),
-		key:        nil,
-		value:      nil,
+// ReadRecordInto reads a record from specific offset into r,
+// r.key and r.value may refer to the mmaped region
+func (df *DataFile) ReadRecordInto(offset int64, r *Record) error {
+	buff, err := df.file.ReadAt(offset, DATA_ITEM_HEADER_SIZE)
+	if err != nil {
+		return err
 	}
 
+	r.decodeHeader(buff)
+	crc := crc32.ChecksumIEEE(buff[4:])
+
 	offset += DATA_ITEM_HEADER_SIZE
+	if (r.flag & RECORD_FLAG_BIT_SEQ) > 0 {
+		seq, err := df.file.ReadAt(offset, RECORD_SEQ_SIZE)
+		if err != nil {
+			return err
+		}
+		r.seq = binary.LittleEndian.Uint64(seq)
+		crc = crc32.Update(crc, crc32.IEEETable, seq)
+		offset += RECORD_SEQ_SIZE
+	}
+
 	r.key, err = df.file.ReadAt(offset, int64(r.keySize))
 	if err != nil {
-		ylog.Warn(err)
-		return nil, err
+		return err
 	}
 
 	offset += int64(r.keySize)
 	r.value, err = df.file.ReadAt(offset, int64(r.valueSize))
 	if err != nil {
-		ylog.Warn(err)
-		return nil, err
+		return err
 	}
 
-	crc := crc32.ChecksumIEEE(buff[4:])
+	// calculate crc
 	crc = crc32.Update(crc, crc32.IEEETable, r.key)
 	crc = crc32.Update(crc, crc32.IEEETable, r.value)
 	if crc != r.crc {
-		ylog.Errorf("check crc32 failed")
-		return nil, ErrDataCorruption
+		return ErrDataCorruption
 	}
 
-	return r, nil
+	return nil
+}
+
+// ReadKeyAt reads the key of the record at offset without checking crc,
+// the key may refer to the mmaped region
+func (df *DataFile) ReadKeyAt(offset int64) ([]byte, error) {
+	buff, err := df.file.ReadAt(offset, DATA_ITEM_HEADER_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	var r Record
+	r.decodeHeader(buff)
+	return df.file.ReadAt(offset+r.HeaderSize(), int64(r.keySize))
 }
 
 // ForEachRecord runs fn on each record until encounters error
 func (df *DataFile) ForEachRecord(fn RecordFn) error {
-	var offset int64 = 0
+	return df.ForEachRecordFrom(0, fn)
+}
+
+// ForEachRecordFrom runs fn on each record from offset until encounters error
+func (df *DataFile) ForEachRecordFrom(offset int64, fn RecordFn) error {
+	df.file.Advise(ADVICE_SEQUENTIAL)
+	defer df.file.Advise(ADVICE_RANDOM)
 	for {
 		r, err := df.ReadRecordAt(offset)
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			ylog.Warn(err)
 			return err
 		}
-		err = fn(r, df.fileId, offset)
+		if (r.flag & RECORD_FLAG_BIT_BATCH) > 0 {
+			err = df.forEachBatchRecord(r, offset, fn)
+		} else {
+			err = fn(r, df.fileId, offset)
+		}
 		if err != nil {
 			return err
 		}
@@ -104,12 +128,28 @@ func (df *DataFile) ForEachRecord(fn RecordFn) error {
 	return nil
 }
 
+// forEachBatchRecord runs fn on each record inside batch record r at offset
+func (df *DataFile) forEachBatchRecord(r *Record, offset int64, fn RecordFn) error {
+	end := offset + r.Size()
+	offset += r.HeaderSize() + int64(r.keySize)
+	for offset < end {
+		br, err := df.ReadRecordAt(offset)
+		if err != nil {
+			return err
+		}
+		if err = fn(br, df.fileId, offset); err != nil {
+			return err
+		}
+		offset += br.Size()
+	}
+	return nil
+}
+
 func (df *DataFile) Size() int64 {
 	return df.file.Size()
 }
 
 func (df *DataFile) Close() error {
-	ylog.Tracef("Close datafile[%d]", df.fileId)
 	return df.file.Close()
 }
 
@@ -121,35 +161,59 @@ type CacheEntry struct {
 
 // DataFileCache is a LRU cache which caches data files
 type DataFileCache struct {
+	fs       FS
+	fa       fileAccess
+	pathFn   func(fileId uint64) string
+	tier     *blobTier // opens offloaded data files, nil if tiering is disabled
+	logger   Logger
 	l        *list.List
 	hash     map[uint64]*list.Element
 	capacity int
 	mu       sync.Mutex
+
+	// counters, require mu held
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// CacheStats is a snapshot of counters of DataFileCache
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Open      int // number of files in cache
 }
 
-func NewDataFileCache(capacity int) *DataFileCache {
+// NewDataFileCache creates a cache opening files of fs at paths given by pathFn
+func NewDataFileCache(capacity int, fs FS, fa fileAccess, pathFn func(fileId uint64) string, logger Logger) *DataFileCache {
 	if capacity <= 0 {
 		capacity = defaultCacheCapacity
 	}
 	return &DataFileCache{
+		fs:       fs,
+		fa:       fa,
+		pathFn:   pathFn,
+		logger:   logger,
 		l:        list.New(),
 		hash:     make(map[uint64]*list.Element, capacity),
 		capacity: capacity,
 	}
 }
 
-func (cache *DataFileCache) Ref(path string, fileId uint64) (*CacheEntry, error) {
+func (cache *DataFileCache) Ref(fileId uint64) (*CacheEntry, error) {
 	cache.mu.Lock()
 	defer cache.mu.Unlock()
 
 	var entry *CacheEntry
 	ele, ok := cache.hash[fileId]
 	if !ok {
-		ylog.Tracef("Datafile[%d] not in cache, create a cache entry associated with it.", fileId)
+		cache.misses++
+		cache.logger.Tracef("Datafile[%d] not in cache, create a cache entry associated with it.", fileId)
 		// Create a new cache entry when not in cache
-		df, err := NewDataFile(path, fileId)
+		df, err := cache.open(fileId)
 		if err != nil {
-			ylog.Errorf("New datafile[%s] failed, err = %s", path, err)
+			cache.logger.Errorf("New datafile[%d] failed, err = %s", fileId, err)
 			return nil, err
 		}
 		entry = &CacheEntry{
@@ -160,7 +224,8 @@ func (cache *DataFileCache) Ref(path string, fileId uint64) (*CacheEntry, error)
 		ele = cache.l.PushFront(entry)
 		cache.hash[fileId] = ele
 	} else {
-		ylog.Tracef("Datafile[%d] in cache", fileId)
+		cache.hits++
+		cache.logger.Tracef("Datafile[%d] in cache", fileId)
 	}
 
 	entry = ele.Value.(*CacheEntry)
@@ -173,11 +238,37 @@ func (cache *DataFileCache) Ref(path string, fileId uint64) (*CacheEntry, error)
 		e := cache.l.Remove(cache.l.Back()).(*CacheEntry)
 		e.inList = false
 		cache.unref(e)
+		cache.evictions++
 	}
 
 	return entry, nil
 }
 
+// open opens file fileId from local disk, or from blob store if it has
+// been offloaded
+func (cache *DataFileCache) open(fileId uint64) (*DataFile, error) {
+	if cache.tier != nil {
+		if file, ok, err := cache.tier.open(fileId); ok {
+			if err != nil {
+				return nil, err
+			}
+			return newDataFile(file, fileId), nil
+		}
+	}
+	return NewDataFile(cache.fs, cache.pathFn(fileId), fileId, cache.fa)
+}
+
+func (cache *DataFileCache) Stats() CacheStats {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return CacheStats{
+		Hits:      cache.hits,
+		Misses:    cache.misses,
+		Evictions: cache.evictions,
+		Open:      cache.l.Len(),
+	}
+}
+
 // unref requires cache.mu held
 func (cache *DataFileCache) unref(entry *CacheEntry) {
 	entry.refCount--
@@ -186,6 +277,7 @@ func (cache *DataFileCache) unref(entry *CacheEntry) {
 		// Close the associated file
 		delete(cache.hash, entry.df.fileId)
 		entry.df.Close()
+		cache.logger.Tracef("Close datafile[%d]", entry.df.fileId)
 	}
 }
 
@@ -0,0 +1,88 @@
+package beecask
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// fileAccessValues returns values of keys written in round
+func fileAccessValues(round int) func(i int) []byte {
+	return func(i int) []byte { return testValue(i+round, 10+i%500) }
+}
+
+func TestFileAccess(t *testing.T) {
+	for _, c := range []struct {
+		access    int
+		readahead int
+		fs        FS
+		dir       string
+	}{
+		{FILE_ACCESS_MMAP, 0, OSFS{}, t.TempDir()},
+		{FILE_ACCESS_PREAD, 0, OSFS{}, t.TempDir()},
+		{FILE_ACCESS_PREAD, 0, NewMemFS(), TEST_DIR},
+		{FILE_ACCESS_PREAD, 100, NewMemFS(), TEST_DIR},
+		{FILE_ACCESS_PREAD, 4096, NewMemFS(), TEST_DIR},
+	} {
+		opts := testOptions(c.fs)
+		opts.FileAccess = c.access
+		opts.ReadaheadSize = c.readahead
+		opts.MaxFileSize = 8 << 10
+		opts.ValueThreshold = 300
+		bc, err := NewBeecask(*opts, c.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for round := 0; round < 2; round++ {
+			fillKeys(t, bc, 500, fileAccessValues(round))
+		}
+		mergeTest(t, bc)
+		bc.ValueLogGC()
+		bc.Close()
+
+		bc, err = NewBeecask(*opts, c.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value := fileAccessValues(1)
+		checkKeys(t, bc, 500, value, "reopen")
+		for i := 0; i < 500; i++ {
+			key := fmt.Sprintf("k%d", i)
+			rc, size, err := bc.GetReader(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil || int64(len(v)) != size || !bytes.Equal(v, value(i)) {
+				t.Fatalf("access %d readahead %d: reader of %s mismatches, err=%v", c.access, c.readahead, key, err)
+			}
+		}
+		bc.Close()
+	}
+}
+
+// a data file truncated underneath fails reads instead of crashing
+func TestPreadTruncatedFile(t *testing.T) {
+	fs := NewMemFS()
+	opts := testOptions(fs)
+	opts.FileAccess = FILE_ACCESS_PREAD
+	opts.MaxFileSize = 4 << 10
+	bc := openTest(t, opts)
+	defer bc.Close()
+
+	for i := 0; i < 100; i++ {
+		bc.Set(fmt.Sprintf("k%d", i), bytes.Repeat([]byte("v"), 200))
+	}
+	expectValue(t, bc, "k0", string(bytes.Repeat([]byte("v"), 200)))
+	f, err := fs.Create(bc.dataFilePath(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Truncate(100)
+	f.Close()
+	if _, err = bc.Get("k10"); err == nil {
+		t.Fatalf("read of truncated record expects error")
+	}
+}
@@ -0,0 +1,89 @@
+package beecask
+
+import (
+	"fmt"
+	"io"
+)
+
+var (
+	ErrDegraded = fmt.Errorf("Database is degraded to read-only")
+)
+
+// Degraded returns the error which degraded the database to read-only,
+// nil if the database is writable
+func (bc *Beecask) Degraded() error {
+	bc.rwMutex.RLock()
+	defer bc.rwMutex.RUnlock()
+	return bc.degraded
+}
+
+// Recover makes a degraded database writable again after the cause has been
+// fixed. Buffered records are flushed, a partially written record at the end
+// of active files is truncated and writes go to new active files.
+func (bc *Beecask) Recover() error {
+	bc.rwMutex.Lock()
+	defer bc.rwMutex.Unlock()
+
+	if bc.degraded == nil {
+		return nil
+	}
+	if bc.vlogFile != nil {
+		if err := bc.repairActiveFile(bc.vlogFile); err != nil {
+			return err
+		}
+		if err := bc.rotateValueLog(); err != nil {
+			return err
+		}
+	}
+	if err := bc.repairActiveFile(bc.activeFile); err != nil {
+		return err
+	}
+	if err := bc.rotateActiveFile(); err != nil {
+		return err
+	}
+
+	bc.logger.Infof("Recover from degraded state, cause=%s", bc.degraded)
+	bc.degraded = nil
+	return nil
+}
+
+// degrade switches the database to read-only, the first cause is kept.
+// degrade requires bc.rwMutex held
+func (bc *Beecask) degrade(err error) {
+	if bc.degraded == nil {
+		bc.degraded = err
+		bc.logger.Errorf("Database is degraded to read-only, err=%s", err)
+	}
+}
+
+// repairActiveFile flushes af and truncates a partially written record
+// at its end, corruption in the middle of af is not repaired.
+// repairActiveFile requires bc.rwMutex held
+func (bc *Beecask) repairActiveFile(af *ActiveFile) error {
+	if err := af.Flush(); err != nil {
+		bc.logger.Errorf("Flush file[%d] failed, err=%s", af.FileId(), err)
+		return err
+	}
+
+	var offset int64
+	var r Record
+	for offset < af.Size() {
+		err := af.ReadRecordInto(offset, &r)
+		if err == nil {
+			offset += r.Size()
+			continue
+		}
+		if err != io.EOF && offset+r.Size() < af.Size() {
+			bc.logger.Errorf("File[%d] is corrupted @ [%d], err=%s", af.FileId(), offset, err)
+			return ErrDataCorruption
+		}
+		break
+	}
+	if offset < af.Size() {
+		bc.logger.Warnf("Truncate partial record of file[%d] @ [%d], size=%d", af.FileId(), offset, af.Size())
+		if err := af.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	return af.Sync()
+}
@@ -0,0 +1,55 @@
+package beecask
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDegradeAndRecover(t *testing.T) {
+	for _, fault := range []string{"fail", "short", "sync"} {
+		fs := NewFaultFS(NewMemFS())
+		opts := testOptions(fs)
+		opts.WriteBufferSize = 16
+		bc := openTest(t, opts)
+
+		bc.Set("a", []byte("1"))
+		switch fault {
+		case "fail":
+			fs.FailWrites(0, nil)
+		case "short":
+			fs.ShortWrites(0)
+		case "sync":
+			fs.FailSyncs(ErrInjectedFault)
+		}
+		err := bc.Set("b", bytes.Repeat([]byte("x"), 100))
+		if fault == "sync" {
+			if err == nil {
+				err = bc.Sync()
+			}
+		}
+		if err == nil {
+			t.Fatalf("%s: write expects failure", fault)
+		}
+		if bc.Degraded() == nil {
+			t.Fatalf("%s: failed write expects degraded database", fault)
+		}
+		if err = bc.Set("c", []byte("1")); err != ErrDegraded {
+			t.Fatalf("%s: write of degraded database expects ErrDegraded, err=%v", fault, err)
+		}
+		expectValue(t, bc, "a", "1")
+
+		fs.ClearFaults()
+		if err = bc.Recover(); err != nil {
+			t.Fatalf("%s: recover failed, err=%v", fault, err)
+		}
+		if err = bc.Set("c", []byte("2")); err != nil {
+			t.Fatalf("%s: write after recover failed, err=%v", fault, err)
+		}
+		bc.Close()
+
+		bc = openTest(t, opts)
+		expectValue(t, bc, "a", "1")
+		expectValue(t, bc, "c", "2")
+		bc.Close()
+	}
+}
@@ -0,0 +1,113 @@
+package beecask
+
+import (
+	"container/heap"
+)
+
+type expireEntry struct {
+	key        string
+	expiration int64
+	index      int // index in expireHeap
+}
+
+type expireHeap []*expireEntry
+
+func (h expireHeap) Len() int           { return len(h) }
+func (h expireHeap) Less(i, j int) bool { return h[i].expiration < h[j].expiration }
+func (h expireHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expireHeap) Push(x interface{}) {
+	entry := x.(*expireEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expireHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return entry
+}
+
+// ExpireIndex is a min-heap of keys ordered by expiration,
+// only keys with expiration are indexed
+type ExpireIndex struct {
+	h    expireHeap
+	hash map[string]*expireEntry
+}
+
+func NewExpireIndex() *ExpireIndex {
+	return &ExpireIndex{
+		h:    make(expireHeap, 0, 1024),
+		hash: make(map[string]*expireEntry, 1024),
+	}
+}
+
+// Set indexes key with expiration, zero expiration removes key from index
+func (idx *ExpireIndex) Set(key string, expiration int64) {
+	if expiration <= 0 {
+		idx.Delete(key)
+		return
+	}
+	if entry, ok := idx.hash[key]; ok {
+		entry.expiration = expiration
+		heap.Fix(&idx.h, entry.index)
+		return
+	}
+	entry := &expireEntry{key: key, expiration: expiration}
+	heap.Push(&idx.h, entry)
+	idx.hash[key] = entry
+}
+
+func (idx *ExpireIndex) Delete(key string) {
+	if entry, ok := idx.hash[key]; ok {
+		heap.Remove(&idx.h, entry.index)
+		delete(idx.hash, key)
+	}
+}
+
+// PopExpired removes at most limit keys expired at now(unix seconds) from
+// index and runs fn on each of them, a non-positive limit means no limit
+func (idx *ExpireIndex) PopExpired(now int64, limit int, fn func(key string, expiration int64)) int {
+	n := 0
+	for len(idx.h) > 0 && (limit <= 0 || n < limit) {
+		entry := idx.h[0]
+		if entry.expiration > now {
+			break
+		}
+		heap.Pop(&idx.h)
+		delete(idx.hash, entry.key)
+		fn(entry.key, entry.expiration)
+		n++
+	}
+	return n
+}
+
+// CountExpired returns number of keys expired at now(unix seconds),
+// only keys accepted by filter are counted if filter is not nil
+func (idx *ExpireIndex) CountExpired(now int64, filter func(key string) bool) int {
+	n := 0
+	stack := []int{0}
+	for len(stack) > 0 {
+		i := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if i >= len(idx.h) || idx.h[i].expiration > now {
+			continue
+		}
+		if filter == nil || filter(idx.h[i].key) {
+			n++
+		}
+		stack = append(stack, 2*i+1, 2*i+2)
+	}
+	return n
+}
+
+func (idx *ExpireIndex) Len() int {
+	return len(idx.h)
+}
@@ -0,0 +1,166 @@
+package beecask
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTTL(t *testing.T) {
+	opts := testOptions(NewMemFS())
+	opts.MaxFileSize = 200
+	bc := openTest(t, opts)
+
+	bc.Set("a", []byte("1"))
+	if ttl, err := bc.TTL("a"); err != nil || ttl != NoExpiration {
+		t.Fatalf("ttl expects NoExpiration, got %s, err=%v", ttl, err)
+	}
+	if err := bc.Expire("a", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.Expire("a", 0); err != ErrInvalid {
+		t.Fatalf("zero ttl expects ErrInvalid, err=%v", err)
+	}
+	bc.SetWithTTL("b", []byte("2"), time.Hour)
+	if err := bc.Persist("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.Touch("none", 0); err != ErrDataNotExist {
+		t.Fatalf("touch of absent key expects ErrDataNotExist, err=%v", err)
+	}
+	if _, err := bc.TTL("none"); err != ErrDataNotExist {
+		t.Fatalf("ttl of absent key expects ErrDataNotExist, err=%v", err)
+	}
+	check := func(tag string) {
+		t.Helper()
+		if ttl, err := bc.TTL("a"); err != nil || ttl < 59*time.Minute || ttl > time.Hour+time.Second {
+			t.Fatalf("%s: ttl of a expects 1h, got %s, err=%v", tag, ttl, err)
+		}
+		if ttl, err := bc.TTL("b"); err != nil || ttl != NoExpiration {
+			t.Fatalf("%s: ttl of b expects NoExpiration, got %s, err=%v", tag, ttl, err)
+		}
+		expectValue(t, bc, "a", "1")
+		expectValue(t, bc, "b", "2")
+	}
+	check("live")
+
+	// touch records are applied after the records they touch
+	for i := 0; i < 20; i++ {
+		bc.Set("x", make([]byte, 50))
+	}
+	bc.Close()
+	bc = openTest(t, opts)
+	check("reopen")
+	mergeTest(t, bc)
+	check("merged")
+	bc.Close()
+	bc = openTest(t, opts)
+	defer bc.Close()
+	check("reopen after merge")
+
+	if err := bc.Touch("a", time.Now().Unix()-1); err != nil {
+		t.Fatal(err)
+	}
+	expectNotExist(t, bc, "a")
+}
+
+func TestExpireKeys(t *testing.T) {
+	bc := openTest(t, testOptions(NewMemFS()))
+	defer bc.Close()
+
+	now := time.Now().Unix()
+	for _, key := range []string{"a", "b", "c"} {
+		bc.SetWithExpiration(key, []byte("1"), now-1)
+	}
+	bc.SetWithTTL("d", []byte("1"), time.Hour)
+	bc.Set("e", []byte("1"))
+	if n := bc.expireIndex.Len(); n != 4 {
+		t.Fatalf("expiration index expects 4 keys, got %d", n)
+	}
+
+	if n := bc.expireKeys(now, 2); n != 2 {
+		t.Fatalf("sweep expects 2 keys limited, got %d", n)
+	}
+	if n := bc.expireKeys(now, 10); n != 1 {
+		t.Fatalf("sweep expects 1 key left, got %d", n)
+	}
+	if n := bc.keydir.Len(); n != 2 {
+		t.Fatalf("key dir expects 2 keys, got %d", n)
+	}
+	if n := bc.expireIndex.Len(); n != 1 {
+		t.Fatalf("expiration index expects 1 key, got %d", n)
+	}
+
+	// persisted keys leave expiration index
+	bc.Persist("d")
+	if n := bc.expireIndex.Len(); n != 0 {
+		t.Fatalf("expiration index expects empty after persist, got %d", n)
+	}
+	if n := bc.Count(); n != 2 {
+		t.Fatalf("count expects 2, got %d", n)
+	}
+}
+
+func TestExpireSweeper(t *testing.T) {
+	opts := testOptions(NewMemFS())
+	opts.ExpireSweepInterval = 10 * time.Millisecond
+	bc := openTest(t, opts)
+	defer bc.Close()
+
+	bc.SetWithExpiration("a", []byte("1"), time.Now().Unix()-1)
+	bc.SetWithTTL("b", []byte("1"), time.Hour)
+	for i := 0; i < 100; i++ {
+		bc.rwMutex.RLock()
+		n := bc.keydir.Len()
+		bc.rwMutex.RUnlock()
+		if n == 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("sweeper does not drop expired key")
+}
+
+func TestExpireHooks(t *testing.T) {
+	var mu sync.Mutex
+	expired := map[string]string{}
+	evicted := map[string]bool{}
+	opts := testOptions(NewMemFS())
+	opts.MaxFileSize = 300
+	opts.OnExpire = func(bucket string, key string, value []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		expired[key] = string(value)
+	}
+	opts.OnEvict = func(bucket string, key string) {
+		mu.Lock()
+		defer mu.Unlock()
+		evicted[key] = true
+	}
+	bc := openTest(t, opts)
+	defer bc.Close()
+
+	now := time.Now().Unix()
+	bc.SetWithExpiration("a", []byte("va"), now-1)
+	bc.Set("d", []byte("1"))
+	bc.Delete("d")
+	for i := 0; i < 20; i++ {
+		bc.Set("x", make([]byte, 50))
+	}
+	// a is reported by sweeper, b by merge
+	if n := bc.expireKeys(now, 10); n != 1 {
+		t.Fatalf("sweep expects 1 key, got %d", n)
+	}
+	bc.SetWithExpiration("b", []byte("vb"), now-1)
+	rotateTest(t, bc)
+	mergeTest(t, bc)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(expired) != 2 || expired["a"] != "va" || expired["b"] != "vb" {
+		t.Fatalf("expire hook expects a and b, got %v", expired)
+	}
+	if len(evicted) != 1 || !evicted["d"] {
+		t.Fatalf("evict hook expects d, got %v", evicted)
+	}
+}
@@ -0,0 +1,470 @@
+package beecask
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+// Export format
+const (
+	EXPORT_FORMAT_JSONL  = iota // a JSON object per line, values in base64
+	EXPORT_FORMAT_BINARY        // length-prefixed entries and a checksummed footer
+)
+
+const (
+	EXPORT_MAGIC          = "BCEXP001"
+	EXPORT_MAX_FIELD_SIZE = 1 << 30 // larger lengths are taken as corruption
+	IMPORT_BATCH_SIZE     = 256     // default entries per batched write
+	IMPORT_BATCH_BYTES    = 4 << 20 // a batch is written once it is larger
+)
+
+// Entry kind of binary format
+const (
+	EXPORT_KIND_FOOTER = iota
+	EXPORT_KIND_ENTRY
+)
+
+var (
+	ErrExportFormat  = fmt.Errorf("Unknown export format")
+	ErrExportCorrupt = fmt.Errorf("Export stream is corrupt")
+)
+
+type ExportOptions struct {
+	Tombstones bool // export deleted keys still in key dir, range deletes are not exported
+}
+
+type ImportOptions struct {
+	BatchSize      int  // entries per batched write, zero means IMPORT_BATCH_SIZE
+	KeepExpiration bool // keep original expirations, otherwise imported keys never expire
+	SkipExpired    bool // skip keys expired already
+}
+
+// DefaultImportOptions is used by Import
+var DefaultImportOptions = ImportOptions{KeepExpiration: true, SkipExpired: true}
+
+// exportEntry is a key of default namespace if bucket is empty
+type exportEntry struct {
+	raw        string // key as stored, bucket keys are prefixed
+	bucket     string
+	key        []byte
+	value      []byte
+	expiration int64
+	deleted    bool
+	item       KDItem // item when export started, values are read by it
+}
+
+// Export writes keys which are neither deleted nor expired to w in format.
+// It is a snapshot of the database when export starts, writes during export
+// are not blocked but not exported either. Merge, value log gc and offload
+// do not remove files until export is done, and OnExpire and OnEvict hooks
+// of the expiration sweeper and merge wait for it as well, so hooks must
+// not wait for an export to finish.
+func (bc *Beecask) Export(w io.Writer, format int) error {
+	return bc.ExportWithOptions(w, format, ExportOptions{})
+}
+
+func (bc *Beecask) ExportWithOptions(w io.Writer, format int, eo ExportOptions) error {
+	ew, err := newExportWriter(w, format)
+	if err != nil {
+		return err
+	}
+
+	// records of the snapshot stay where key dir pointed to while files
+	// are not removed
+	bc.hookMutex.Lock()
+	defer bc.hookMutex.Unlock()
+	for _, e := range bc.exportKeys(eo.Tombstones) {
+		if !e.deleted {
+			bc.rwMutex.RLock()
+			e.value, err = bc.valueOf([]byte(e.raw), &e.item)
+			bc.rwMutex.RUnlock()
+			if err != nil {
+				return err
+			}
+		}
+		if err = ew.write(e); err != nil {
+			return err
+		}
+	}
+	return ew.close()
+}
+
+// exportKeys returns entries without values sorted by bucket and key
+func (bc *Beecask) exportKeys(tombstones bool) []*exportEntry {
+	bc.rwMutex.RLock()
+	defer bc.rwMutex.RUnlock()
+	now := time.Now().Unix()
+	var entries []*exportEntry
+	bc.keydir.ForEach(func(item *KDItem) bool {
+		if (item.flag & RECORD_FLAG_BIT_RANGE_DELETE) > 0 {
+			return false
+		}
+		if (item.flag & RECORD_FLAG_BIT_DELETE) > 0 {
+			return tombstones
+		}
+		return !item.isExpired(now)
+	}, func(key string, item *KDItem) bool {
+		e := &exportEntry{
+			raw:        key,
+			key:        []byte(key),
+			expiration: item.expiration,
+			deleted:    (item.flag & RECORD_FLAG_BIT_DELETE) > 0,
+			item:       *item,
+		}
+		if (item.flag & RECORD_FLAG_BIT_BUCKET) > 0 {
+			if len(key) < 2 || key[:2] == BUCKET_META_PREFIX {
+				return true
+			}
+			id, n := binary.Uvarint([]byte(key[1:]))
+			b := bc.bucketIds[id]
+			if n <= 0 || b == nil {
+				// key of a dropped bucket
+				return true
+			}
+			e.bucket = b.name
+			e.key = e.key[len(b.prefix):]
+		}
+		if e.deleted {
+			e.expiration = 0
+		}
+		entries = append(entries, e)
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].bucket != entries[j].bucket {
+			return entries[i].bucket < entries[j].bucket
+		}
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+	return entries
+}
+
+// Import writes entries read from r in format by batched writes, each batch
+// is atomic. Entries before an error have been imported.
+func (bc *Beecask) Import(r io.Reader, format int) error {
+	return bc.ImportWithOptions(r, format, DefaultImportOptions)
+}
+
+func (bc *Beecask) ImportWithOptions(r io.Reader, format int, opts ImportOptions) error {
+	ir, err := newImportReader(r, format)
+	if err != nil {
+		return err
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = IMPORT_BATCH_SIZE
+	}
+
+	now := time.Now().Unix()
+	buckets := make(map[string]*Bucket)
+	var batch []*Record
+	var batchBytes int64
+	for {
+		var e exportEntry
+		if err = ir.read(&e); err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !e.deleted && e.expiration > 0 && e.expiration <= now && opts.SkipExpired {
+			continue
+		}
+		if !opts.KeepExpiration {
+			e.expiration = 0
+		}
+
+		var rec *Record
+		if e.bucket == "" {
+			if !isDefaultKey(string(e.key)) {
+				bc.logger.Errorf("Key[%q] is reserved for buckets", e.key)
+				return ErrInvalid
+			}
+			rec = newRecord(e.key, e.value, e.deleted, e.expiration)
+		} else {
+			b, ok := buckets[e.bucket]
+			if !ok {
+				if b, err = bc.Bucket(e.bucket); err != nil {
+					return err
+				}
+				buckets[e.bucket] = b
+			}
+			rec = b.record(string(e.key), e.value, e.deleted, e.expiration)
+		}
+		batch = append(batch, rec)
+		batchBytes += rec.Size()
+		if len(batch) >= batchSize || batchBytes >= IMPORT_BATCH_BYTES {
+			if err = bc.importBatch(batch); err != nil {
+				return err
+			}
+			batch, batchBytes = nil, 0
+		}
+	}
+	if len(batch) > 0 {
+		return bc.importBatch(batch)
+	}
+	return nil
+}
+
+func (bc *Beecask) importBatch(records []*Record) (err error) {
+	defer bc.metrics.observe(OP_COMMIT, time.Now(), &err)
+	bc.rwMutex.Lock()
+	defer bc.rwMutex.Unlock()
+	return bc.writeBatch(records)
+}
+
+type exportWriter interface {
+	write(e *exportEntry) error
+	close() error // flushes entries and writes footer if any, w is not closed
+}
+
+type importReader interface {
+	read(e *exportEntry) error // io.EOF after the last entry
+}
+
+func newExportWriter(w io.Writer, format int) (exportWriter, error) {
+	switch format {
+	case EXPORT_FORMAT_JSONL:
+		bw := bufio.NewWriter(w)
+		return &jsonExportWriter{bw: bw, enc: json.NewEncoder(bw)}, nil
+	case EXPORT_FORMAT_BINARY:
+		ew := &binaryExportWriter{bw: bufio.NewWriter(w), crc: crc32.NewIEEE()}
+		return ew, ew.writeHashed([]byte(EXPORT_MAGIC))
+	}
+	return nil, ErrExportFormat
+}
+
+func newImportReader(r io.Reader, format int) (importReader, error) {
+	switch format {
+	case EXPORT_FORMAT_JSONL:
+		return &jsonImportReader{dec: json.NewDecoder(r)}, nil
+	case EXPORT_FORMAT_BINARY:
+		ir := &binaryImportReader{br: bufio.NewReader(r), crc: crc32.NewIEEE()}
+		magic := make([]byte, len(EXPORT_MAGIC))
+		if err := ir.readFull(magic); err != nil || string(magic) != EXPORT_MAGIC {
+			return nil, ErrExportCorrupt
+		}
+		return ir, nil
+	}
+	return nil, ErrExportFormat
+}
+
+// jsonEntry is a line of JSON Lines format, expiration is in unix seconds.
+// Keys which are not valid UTF-8 are kept in key_base64 instead of key.
+type jsonEntry struct {
+	Bucket     string `json:"bucket,omitempty"`
+	Key        string `json:"key"`
+	KeyBase64  []byte `json:"key_base64,omitempty"`
+	Value      []byte `json:"value,omitempty"`
+	Expiration int64  `json:"expiration,omitempty"`
+	Deleted    bool   `json:"deleted,omitempty"`
+}
+
+type jsonExportWriter struct {
+	bw  *bufio.Writer
+	enc *json.Encoder
+}
+
+func (ew *jsonExportWriter) write(e *exportEntry) error {
+	je := jsonEntry{
+		Bucket:     e.bucket,
+		Value:      e.value,
+		Expiration: e.expiration,
+		Deleted:    e.deleted,
+	}
+	if utf8.Valid(e.key) {
+		je.Key = string(e.key)
+	} else {
+		je.KeyBase64 = e.key
+	}
+	return ew.enc.Encode(&je)
+}
+
+func (ew *jsonExportWriter) close() error {
+	return ew.bw.Flush()
+}
+
+type jsonImportReader struct {
+	dec *json.Decoder
+}
+
+func (ir *jsonImportReader) read(e *exportEntry) error {
+	var je jsonEntry
+	if err := ir.dec.Decode(&je); err != nil {
+		if err == io.EOF {
+			return err
+		}
+		return fmt.Errorf("%s: %s", ErrExportCorrupt, err)
+	}
+	e.bucket = je.Bucket
+	e.key = []byte(je.Key)
+	if je.KeyBase64 != nil {
+		e.key = je.KeyBase64
+	}
+	e.value = je.Value
+	e.expiration = je.Expiration
+	e.deleted = je.Deleted
+	return nil
+}
+
+// binaryExportWriter writes binary format, little endian:
+//
+//	stream: magic(8) entry* footer
+//	entry:  kind(1)=EXPORT_KIND_ENTRY deleted(1) uvarint(len(bucket)) bucket
+//	        uvarint(len(key)) key uvarint(len(value)) value varint(expiration)
+//	footer: kind(1)=EXPORT_KIND_FOOTER count(8) crc(4)
+//
+// crc is crc32 of all bytes before it, count is the number of entries
+type binaryExportWriter struct {
+	bw    *bufio.Writer
+	crc   hash.Hash32
+	count uint64
+	buf   [binary.MaxVarintLen64]byte
+}
+
+func (ew *binaryExportWriter) writeHashed(data []byte) error {
+	ew.crc.Write(data)
+	_, err := ew.bw.Write(data)
+	return err
+}
+
+func (ew *binaryExportWriter) writeBytes(data []byte) error {
+	n := binary.PutUvarint(ew.buf[:], uint64(len(data)))
+	if err := ew.writeHashed(ew.buf[:n]); err != nil {
+		return err
+	}
+	return ew.writeHashed(data)
+}
+
+func (ew *binaryExportWriter) write(e *exportEntry) error {
+	header := []byte{EXPORT_KIND_ENTRY, 0}
+	if e.deleted {
+		header[1] = 1
+	}
+	if err := ew.writeHashed(header); err != nil {
+		return err
+	}
+	for _, data := range [][]byte{[]byte(e.bucket), e.key, e.value} {
+		if err := ew.writeBytes(data); err != nil {
+			return err
+		}
+	}
+	n := binary.PutVarint(ew.buf[:], e.expiration)
+	if err := ew.writeHashed(ew.buf[:n]); err != nil {
+		return err
+	}
+	ew.count++
+	return nil
+}
+
+func (ew *binaryExportWriter) close() error {
+	footer := make([]byte, 9)
+	footer[0] = EXPORT_KIND_FOOTER
+	binary.LittleEndian.PutUint64(footer[1:], ew.count)
+	if err := ew.writeHashed(footer); err != nil {
+		return err
+	}
+	var crc [4]byte
+	binary.LittleEndian.PutUint32(crc[:], ew.crc.Sum32())
+	if _, err := ew.bw.Write(crc[:]); err != nil {
+		return err
+	}
+	return ew.bw.Flush()
+}
+
+type binaryImportReader struct {
+	br    *bufio.Reader
+	crc   hash.Hash32
+	count uint64
+	done  bool
+}
+
+// ReadByte reads a hashed byte, for binary.ReadUvarint
+func (ir *binaryImportReader) ReadByte() (byte, error) {
+	b, err := ir.br.ReadByte()
+	if err != nil {
+		return 0, ErrExportCorrupt
+	}
+	ir.crc.Write([]byte{b})
+	return b, nil
+}
+
+func (ir *binaryImportReader) readFull(data []byte) error {
+	if _, err := io.ReadFull(ir.br, data); err != nil {
+		return ErrExportCorrupt
+	}
+	ir.crc.Write(data)
+	return nil
+}
+
+func (ir *binaryImportReader) readBytes() ([]byte, error) {
+	n, err := binary.ReadUvarint(ir)
+	if err != nil || n > EXPORT_MAX_FIELD_SIZE {
+		return nil, ErrExportCorrupt
+	}
+	data := make([]byte, n)
+	return data, ir.readFull(data)
+}
+
+func (ir *binaryImportReader) read(e *exportEntry) error {
+	if ir.done {
+		return io.EOF
+	}
+	kind, err := ir.ReadByte()
+	if err != nil {
+		return err
+	}
+	if kind == EXPORT_KIND_FOOTER {
+		return ir.readFooter()
+	}
+	if kind != EXPORT_KIND_ENTRY {
+		return ErrExportCorrupt
+	}
+	deleted, err := ir.ReadByte()
+	if err != nil {
+		return err
+	}
+	e.deleted = deleted == 1
+	bucket, err := ir.readBytes()
+	if err != nil {
+		return err
+	}
+	e.bucket = string(bucket)
+	if e.key, err = ir.readBytes(); err != nil {
+		return err
+	}
+	if e.value, err = ir.readBytes(); err != nil {
+		return err
+	}
+	if e.expiration, err = binary.ReadVarint(ir); err != nil {
+		return ErrExportCorrupt
+	}
+	ir.count++
+	return nil
+}
+
+func (ir *binaryImportReader) readFooter() error {
+	count := make([]byte, 8)
+	if err := ir.readFull(count); err != nil {
+		return err
+	}
+	expect := ir.crc.Sum32()
+	crc := make([]byte, 4)
+	if _, err := io.ReadFull(ir.br, crc); err != nil {
+		return ErrExportCorrupt
+	}
+	if binary.LittleEndian.Uint64(count) != ir.count || binary.LittleEndian.Uint32(crc) != expect {
+		return ErrExportCorrupt
+	}
+	ir.done = true
+	return io.EOF
+}
@@ -0,0 +1,135 @@
+package beecask
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	for _, format := range []int{EXPORT_FORMAT_JSONL, EXPORT_FORMAT_BINARY} {
+		fs := NewMemFS()
+		src, err := NewBeecask(*testOptions(fs), "/src")
+		if err != nil {
+			t.Fatal(err)
+		}
+		src.Set("a", []byte("1"))
+		src.Set("bin\xff", []byte{0, 1, 2})
+		src.Set("gone", []byte("x"))
+		src.Delete("gone")
+		src.SetWithTTL("ttl", []byte("t"), time.Hour)
+		src.SetWithExpiration("exp", []byte("e"), time.Now().Unix()-1)
+		b, _ := src.Bucket("bk")
+		b.Set("a", []byte("bucket a"))
+		var buf bytes.Buffer
+		if err = src.ExportWithOptions(&buf, format, ExportOptions{Tombstones: true}); err != nil {
+			t.Fatal(err)
+		}
+		stream := buf.Bytes()
+		src.Close()
+
+		dst, err := NewBeecask(*testOptions(fs), "/dst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst.Set("gone", []byte("old"))
+		if err = dst.Import(bytes.NewReader(stream), format); err != nil {
+			t.Fatal(err)
+		}
+		expectValue(t, dst, "a", "1")
+		expectValue(t, dst, "bin\xff", "\x00\x01\x02")
+		expectValue(t, dst, "ttl", "t")
+		if ttl, err := dst.TTL("ttl"); err != nil || ttl <= 0 {
+			t.Fatalf("format %d: expiration expects kept, ttl=%s err=%v", format, ttl, err)
+		}
+		expectNotExist(t, dst, "gone")
+		expectNotExist(t, dst, "exp")
+		db, _ := dst.Bucket("bk")
+		if v, err := db.Get("a"); err != nil || string(v) != "bucket a" {
+			t.Fatalf("format %d: key of bucket expects imported, got %q, err=%v", format, v, err)
+		}
+
+		if format == EXPORT_FORMAT_BINARY {
+			var again bytes.Buffer
+			dst.ExportWithOptions(&again, format, ExportOptions{Tombstones: true})
+			if !bytes.Equal(again.Bytes(), stream) {
+				t.Fatalf("export of imported database differs")
+			}
+			for _, n := range []int{0, 5, len(stream) / 2, len(stream) - 1} {
+				if err = dst.Import(bytes.NewReader(stream[:n]), format); err != ErrExportCorrupt {
+					t.Fatalf("stream truncated at %d expects ErrExportCorrupt, err=%v", n, err)
+				}
+			}
+			bad := append([]byte(nil), stream...)
+			bad[12] ^= 0xff
+			if err = dst.Import(bytes.NewReader(bad), format); err != ErrExportCorrupt {
+				t.Fatalf("corrupted stream expects ErrExportCorrupt, err=%v", err)
+			}
+		}
+		dst.Close()
+	}
+}
+
+// hookWriter calls fn before the first write
+type hookWriter struct {
+	bytes.Buffer
+	fn func()
+}
+
+func (hw *hookWriter) Write(p []byte) (int, error) {
+	if hw.fn != nil {
+		hw.fn()
+		hw.fn = nil
+	}
+	return hw.Buffer.Write(p)
+}
+
+func TestExportIsSnapshot(t *testing.T) {
+	fs := NewMemFS()
+	opts := testOptions(fs)
+	opts.ValueThreshold = 1000
+	bc := openTest(t, opts)
+	defer bc.Close()
+
+	old := strings.Repeat("o", 5000)
+	for i := 0; i < 20; i++ {
+		bc.Set(fmt.Sprintf("k%02d", i), []byte(old))
+	}
+	done := make(chan struct{})
+	w := &hookWriter{fn: func() {
+		for i := 0; i < 20; i++ {
+			bc.Set(fmt.Sprintf("k%02d", i), []byte("new"))
+		}
+		bc.Delete("k19")
+		bc.Set("k20", []byte("new"))
+		rotateTest(t, bc)
+		// merge waits until export is done
+		go func() {
+			bc.Merge()
+			bc.ValueLogGC()
+			close(done)
+		}()
+	}}
+	if err := bc.Export(w, EXPORT_FORMAT_BINARY); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	dst, err := NewBeecask(*testOptions(fs), "/dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err = dst.Import(&w.Buffer, EXPORT_FORMAT_BINARY); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		if v, err := dst.Get(key); err != nil || string(v) != old {
+			t.Fatalf("key %s expects value when export started, got %d bytes, err=%v", key, len(v), err)
+		}
+	}
+	expectNotExist(t, dst, "k20")
+}
@@ -0,0 +1,420 @@
+package beecask
+
+import (
+	"io"
+	"math/rand"
+	"path"
+	"sort"
+	"sync"
+)
+
+// FaultFS wraps a FS and injects faults for tests. Crash simulates a power
+// loss: data written to a file since its last Sync is lost, and all open
+// files and locks become unusable. Creating, renaming and removing files
+// are durable once they return.
+type FaultFS struct {
+	FS
+	mu          sync.Mutex
+	states      map[string]*faultState // files opened for writing
+	files       map[*faultFile]struct{}
+	locks       map[*faultLock]struct{}
+	failIn      int // writes left before writes fail, -1 if disarmed
+	failErr     error
+	shortIn     int // writes left before writes are short, -1 if disarmed
+	failSyncs   error
+	failRenames error
+}
+
+// faultState remembers how to revert a file to its synced content
+type faultState struct {
+	syncedSize int64
+	undo       []undoRecord // synced bytes overwritten or truncated since last sync
+}
+
+type undoRecord struct {
+	offset int64
+	data   []byte
+}
+
+func NewFaultFS(fs FS) *FaultFS {
+	return &FaultFS{
+		FS:      fs,
+		states:  make(map[string]*faultState),
+		files:   make(map[*faultFile]struct{}),
+		locks:   make(map[*faultLock]struct{}),
+		failIn:  -1,
+		shortIn: -1,
+	}
+}
+
+// FailWrites makes writes fail with err after n more writes succeed,
+// a nil err fails them with ErrInjectedFault
+func (fs *FaultFS) FailWrites(n int, err error) {
+	if err == nil {
+		err = ErrInjectedFault
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.failIn = n
+	fs.failErr = err
+}
+
+// ShortWrites makes writes write only half of data and fail with
+// io.ErrShortWrite after n more writes succeed
+func (fs *FaultFS) ShortWrites(n int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.shortIn = n
+}
+
+// FailSyncs makes syncs fail with err, a nil err makes them succeed again
+func (fs *FaultFS) FailSyncs(err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.failSyncs = err
+}
+
+// FailRenames makes renames fail with err, a nil err makes them succeed again
+func (fs *FaultFS) FailRenames(err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.failRenames = err
+}
+
+// ClearFaults disarms all faults
+func (fs *FaultFS) ClearFaults() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.failIn = -1
+	fs.failErr = nil
+	fs.shortIn = -1
+	fs.failSyncs = nil
+	fs.failRenames = nil
+}
+
+// Crash reverts files to their synced content. Open files and locks fail
+// with ErrFileSystemCrash afterwards, faults stay armed.
+func (fs *FaultFS) Crash() error {
+	return fs.crash(nil)
+}
+
+// TornCrash is like Crash, but a random prefix of data appended to each file
+// since its last sync survives, as if it had been partially written back
+func (fs *FaultFS) TornCrash(rnd *rand.Rand) error {
+	return fs.crash(rnd)
+}
+
+func (fs *FaultFS) crash(rnd *rand.Rand) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for f := range fs.files {
+		f.f.Close()
+		f.crashed = true
+	}
+	fs.files = make(map[*faultFile]struct{})
+	for l := range fs.locks {
+		l.l.Close()
+	}
+	fs.locks = make(map[*faultLock]struct{})
+
+	var firstErr error
+	// visit files in order, so that a TornCrash is replayable
+	names := make([]string, 0, len(fs.states))
+	for name := range fs.states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := fs.revert(name, fs.states[name], rnd); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// revert requires fs.mu held
+func (fs *FaultFS) revert(name string, state *faultState, rnd *rand.Rand) error {
+	f, err := fs.FS.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	size := state.syncedSize
+	if rnd != nil {
+		cur, err := f.Size()
+		if err != nil {
+			return err
+		}
+		if cur > size {
+			size += rnd.Int63n(cur - size + 1)
+		}
+	}
+	for i := len(state.undo) - 1; i >= 0; i-- {
+		u := state.undo[i]
+		if _, err = f.WriteAt(u.data, u.offset); err != nil {
+			return err
+		}
+	}
+	state.undo = nil
+	state.syncedSize = size
+	if err = f.Truncate(size); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Corrupt flips all bits of the byte at offset of file name
+func (fs *FaultFS) Corrupt(name string, offset int64) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, err := fs.FS.Create(path.Clean(name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	if _, err = f.ReadAt(b, offset); err != nil {
+		return err
+	}
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, offset)
+	return err
+}
+
+func (fs *FaultFS) Open(name string) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, err := fs.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	ff := &faultFile{fs: fs, f: f}
+	fs.files[ff] = struct{}{}
+	return ff, nil
+}
+
+func (fs *FaultFS) Create(name string) (File, error) {
+	name = path.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, err := fs.FS.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	state, ok := fs.states[name]
+	if !ok {
+		// content existing before is durable
+		size, err := f.Size()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		state = &faultState{syncedSize: size}
+		fs.states[name] = state
+	}
+	ff := &faultFile{fs: fs, f: f, state: state}
+	fs.files[ff] = struct{}{}
+	return ff, nil
+}
+
+func (fs *FaultFS) Rename(oldname, newname string) error {
+	oldname, newname = path.Clean(oldname), path.Clean(newname)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.failRenames != nil {
+		return fs.failRenames
+	}
+	if err := fs.FS.Rename(oldname, newname); err != nil {
+		return err
+	}
+	delete(fs.states, newname)
+	if state, ok := fs.states[oldname]; ok {
+		delete(fs.states, oldname)
+		fs.states[newname] = state
+	}
+	return nil
+}
+
+func (fs *FaultFS) Remove(name string) error {
+	name = path.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.FS.Remove(name); err != nil {
+		return err
+	}
+	delete(fs.states, name)
+	return nil
+}
+
+func (fs *FaultFS) Lock(name string) (io.Closer, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	l, err := fs.FS.Lock(name)
+	if err != nil {
+		return nil, err
+	}
+	fl := &faultLock{fs: fs, l: l}
+	fs.locks[fl] = struct{}{}
+	return fl, nil
+}
+
+func (fs *FaultFS) Mmap(f File, size int64) ([]byte, error) {
+	ff, ok := f.(*faultFile)
+	if !ok {
+		return nil, ErrMmapUnsupported
+	}
+	return fs.FS.Mmap(ff.f, size)
+}
+
+// MmapWritable is not supported, writes through a mapping would bypass
+// fault injection
+func (fs *FaultFS) MmapWritable(f File, size int64) ([]byte, error) {
+	return nil, ErrMmapUnsupported
+}
+
+type faultLock struct {
+	fs *FaultFS
+	l  io.Closer
+}
+
+func (fl *faultLock) Close() error {
+	fl.fs.mu.Lock()
+	defer fl.fs.mu.Unlock()
+	if _, ok := fl.fs.locks[fl]; !ok {
+		// released by Crash
+		return ErrFileSystemCrash
+	}
+	delete(fl.fs.locks, fl)
+	return fl.l.Close()
+}
+
+// faultFile passes operations to f unless a fault is injected,
+// operations are serialized by fs.mu
+type faultFile struct {
+	fs      *FaultFS
+	f       File
+	state   *faultState // nil if opened read-only
+	crashed bool
+}
+
+func (ff *faultFile) Name() string {
+	return ff.f.Name()
+}
+
+func (ff *faultFile) ReadAt(p []byte, offset int64) (int, error) {
+	ff.fs.mu.Lock()
+	defer ff.fs.mu.Unlock()
+	if ff.crashed {
+		return 0, ErrFileSystemCrash
+	}
+	return ff.f.ReadAt(p, offset)
+}
+
+func (ff *faultFile) WriteAt(p []byte, offset int64) (int, error) {
+	fs := ff.fs
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if ff.crashed {
+		return 0, ErrFileSystemCrash
+	}
+	if ff.state == nil {
+		return ff.f.WriteAt(p, offset)
+	}
+
+	if fs.failIn == 0 {
+		return 0, fs.failErr
+	} else if fs.failIn > 0 {
+		fs.failIn--
+	}
+	var shortErr error
+	if fs.shortIn == 0 {
+		p = p[:len(p)/2]
+		shortErr = io.ErrShortWrite
+	} else if fs.shortIn > 0 {
+		fs.shortIn--
+	}
+
+	if err := ff.saveUndo(offset, int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := ff.f.WriteAt(p, offset)
+	if err == nil {
+		err = shortErr
+	}
+	return n, err
+}
+
+func (ff *faultFile) Truncate(size int64) error {
+	ff.fs.mu.Lock()
+	defer ff.fs.mu.Unlock()
+	if ff.crashed {
+		return ErrFileSystemCrash
+	}
+	if ff.state != nil && size < ff.state.syncedSize {
+		if err := ff.saveUndo(size, ff.state.syncedSize-size); err != nil {
+			return err
+		}
+	}
+	return ff.f.Truncate(size)
+}
+
+// saveUndo saves synced bytes in [offset, offset+n) before they are changed.
+// saveUndo requires fs.mu held
+func (ff *faultFile) saveUndo(offset, n int64) error {
+	end := offset + n
+	if end > ff.state.syncedSize {
+		end = ff.state.syncedSize
+	}
+	if offset >= end {
+		return nil
+	}
+	data := make([]byte, end-offset)
+	if _, err := ff.f.ReadAt(data, offset); err != nil && err != io.EOF {
+		return err
+	}
+	ff.state.undo = append(ff.state.undo, undoRecord{offset: offset, data: data})
+	return nil
+}
+
+func (ff *faultFile) Sync() error {
+	fs := ff.fs
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if ff.crashed {
+		return ErrFileSystemCrash
+	}
+	if fs.failSyncs != nil {
+		return fs.failSyncs
+	}
+	if err := ff.f.Sync(); err != nil {
+		return err
+	}
+	if ff.state != nil {
+		size, err := ff.f.Size()
+		if err != nil {
+			return err
+		}
+		ff.state.syncedSize = size
+		ff.state.undo = nil
+	}
+	return nil
+}
+
+func (ff *faultFile) Size() (int64, error) {
+	ff.fs.mu.Lock()
+	defer ff.fs.mu.Unlock()
+	if ff.crashed {
+		return 0, ErrFileSystemCrash
+	}
+	return ff.f.Size()
+}
+
+func (ff *faultFile) Close() error {
+	ff.fs.mu.Lock()
+	defer ff.fs.mu.Unlock()
+	if ff.crashed {
+		return ErrFileSystemCrash
+	}
+	delete(ff.fs.files, ff)
+	return ff.f.Close()
+}
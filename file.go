@@ -1,45 +1,78 @@
 package beecask
 
 import (
-	"github.com/yplusplus/ylog"
 	"io"
-	"os"
-	"syscall"
+	"sync"
+	"sync/atomic"
+)
+
+// Access pattern advice
+const (
+	ADVICE_NORMAL = iota
+	ADVICE_RANDOM
+	ADVICE_SEQUENTIAL
 )
 
 type RandomAccessFile interface {
 	ReadAt(offset, len int64) ([]byte, error)
 	Size() int64
+	// Advise hints the access pattern of following reads
+	Advise(advice int) error
 	Close() error
 }
 
+// fileAccess is how read-only files are accessed
+type fileAccess struct {
+	mode      int // FILE_ACCESS_MMAP or FILE_ACCESS_PREAD
+	readahead int // bytes read ahead by sequential reads of pread
+}
+
+// open opens path for reads, mmap falls back to pread if it fails
+func (fa fileAccess) open(fs FS, path string) (RandomAccessFile, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var file RandomAccessFile
+	if fa.mode == FILE_ACCESS_MMAP {
+		if file, err = NewMmapFile(fs, f); err == nil {
+			return file, nil
+		}
+	}
+	if file, err = NewPreadFile(f, fa.readahead); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
 type MmapFile struct {
 	mmapedRegion []byte
-	f            *os.File
+	fs           FS
+	f            File
 }
 
-func NewMmapFile(f *os.File) (*MmapFile, error) {
-	stat, err := f.Stat()
+// NewMmapFile maps f through fs, ErrMmapUnsupported is returned
+// if fs does not support mmap
+func NewMmapFile(fs FS, f File) (*MmapFile, error) {
+	size, err := f.Size()
 	if err != nil {
-		ylog.Errorf("Stat failed, err = %s.", err)
 		return nil, err
 	}
 
 	var region []byte = nil
-	if int(stat.Size()) > 0 {
-		region, err = syscall.Mmap(int(f.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_PRIVATE)
+	if size > 0 {
+		region, err = fs.Mmap(f, size)
 		if err != nil {
-			ylog.Errorf("syscall.Mmap failed, err = %s.", err)
 			return nil, err
 		}
 	}
 
-	return &MmapFile{mmapedRegion: region, f: f}, nil
+	return &MmapFile{mmapedRegion: region, fs: fs, f: f}, nil
 }
 
 func (file *MmapFile) ReadAt(offset, len int64) ([]byte, error) {
 	if offset > file.Size() {
-		ylog.Errorf("Expect to read from offset[%d], but file size is %d.", offset, file.Size())
 		return nil, ErrInvalid
 	}
 
@@ -54,29 +87,159 @@ func (file *MmapFile) Size() int64 {
 	return int64(len(file.mmapedRegion))
 }
 
+func (file *MmapFile) Advise(advice int) error {
+	if len(file.mmapedRegion) == 0 {
+		return nil
+	}
+	return file.fs.Madvise(file.mmapedRegion, advice)
+}
+
 func (file *MmapFile) Close() error {
-	if file.mmapedRegion != nil {
-		syscall.Munmap(file.mmapedRegion)
+	if len(file.mmapedRegion) > 0 {
+		file.fs.Munmap(file.mmapedRegion)
 	}
 	return file.f.Close()
 }
 
+// PreadFile reads f by pread instead of mmap, so that no address space is
+// consumed and a file truncated under us gives an error instead of SIGBUS.
+// Reads are served from a readahead buffer after ADVICE_SEQUENTIAL.
+type PreadFile struct {
+	f          readerAtCloser
+	size       int64
+	readahead  int
+	advice     int32      // atomic
+	mu         sync.Mutex // guards rbuf and rbufOffset
+	rbuf       []byte     // never reused, slices of it are returned by ReadAt
+	rbufOffset int64
+}
+
+// NewPreadFile creates a PreadFile reading readahead bytes at a time for
+// sequential reads, zero disables readahead
+func NewPreadFile(f File, readahead int) (*PreadFile, error) {
+	size, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+	return newPreadFile(f, size, readahead), nil
+}
+
+type readerAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// newPreadFile creates a PreadFile reading size bytes of r, r needs not
+// be a file, blobs are read by ranges through it
+func newPreadFile(r readerAtCloser, size int64, readahead int) *PreadFile {
+	return &PreadFile{f: r, size: size, readahead: readahead}
+}
+
+func (file *PreadFile) ReadAt(offset, size int64) ([]byte, error) {
+	if offset > file.size {
+		return nil, ErrInvalid
+	}
+
+	var eof error
+	if offset+size > file.size {
+		size = file.size - offset
+		eof = io.EOF
+	}
+	if size == 0 {
+		return nil, eof
+	}
+
+	if size < int64(file.readahead) && atomic.LoadInt32(&file.advice) == ADVICE_SEQUENTIAL {
+		data, err := file.readAhead(offset, size)
+		if err != nil {
+			return nil, err
+		}
+		return data, eof
+	}
+	data := make([]byte, size)
+	if err := file.pread(data, offset); err != nil {
+		return nil, err
+	}
+	return data, eof
+}
+
+// readAhead returns data from readahead buffer, the buffer is refilled
+// at offset if data is out of it
+func (file *PreadFile) readAhead(offset, size int64) ([]byte, error) {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	if offset < file.rbufOffset || offset+size > file.rbufOffset+int64(len(file.rbuf)) {
+		n := int64(file.readahead)
+		if offset+n > file.size {
+			n = file.size - offset
+		}
+		buf := make([]byte, n)
+		if err := file.pread(buf, offset); err != nil {
+			return nil, err
+		}
+		file.rbuf, file.rbufOffset = buf, offset
+	}
+	start := offset - file.rbufOffset
+	return file.rbuf[start : start+size : start+size], nil
+}
+
+// pread fills data at offset, a short read means the file has been
+// truncated under us
+func (file *PreadFile) pread(data []byte, offset int64) error {
+	n, err := file.f.ReadAt(data, offset)
+	if n < len(data) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+func (file *PreadFile) Size() int64 {
+	return file.size
+}
+
+func (file *PreadFile) Advise(advice int) error {
+	atomic.StoreInt32(&file.advice, int32(advice))
+	return nil
+}
+
+func (file *PreadFile) Close() error {
+	return file.f.Close()
+}
+
 type FileWithBuffer struct {
-	f    *os.File
-	size int64
-	wbuf []byte
-	n    int
+	f     File
+	size  int64
+	wbuf  []byte
+	n     int
+	dirty bool // written since last Sync, data of last run may be unsynced as well
+
+	// beforeWrite is called before data reaches f, nothing is written if it fails
+	beforeWrite func() error
 }
 
-func NewFileWithBuffer(f *os.File, size int64, wbufSize int) *FileWithBuffer {
+func NewFileWithBuffer(f File, size int64, wbufSize int) *FileWithBuffer {
 	return &FileWithBuffer{
-		f:    f,
-		size: size,
-		wbuf: make([]byte, wbufSize),
-		n:    0,
+		f:     f,
+		size:  size,
+		wbuf:  make([]byte, wbufSize),
+		n:     0,
+		dirty: true,
 	}
 }
 
+// writeAt writes data to f at offset after beforeWrite
+func (file *FileWithBuffer) writeAt(data []byte, offset int64) (int, error) {
+	if file.beforeWrite != nil {
+		if err := file.beforeWrite(); err != nil {
+			return 0, err
+		}
+	}
+	return file.f.WriteAt(data, offset)
+}
+
 func (file *FileWithBuffer) ReadAt(offset, size int64) ([]byte, error) {
 	if offset > file.size {
 		return nil, ErrInvalid
@@ -112,37 +275,81 @@ func (file *FileWithBuffer) ReadAt(offset, size int64) ([]byte, error) {
 }
 
 func (file *FileWithBuffer) Write(data []byte) (nn int, err error) {
+	file.dirty = true
 	for len(data) > len(file.wbuf)-file.n && err == nil {
 		var n int
 		if file.n == 0 {
 			// Large write, empty buffer
 			// Write directly to avoid copy
-			n, err = file.f.Write(data)
+			n, err = file.writeAt(data, file.size)
+			file.size += int64(n)
 		} else {
 			n = copy(file.wbuf[file.n:], data)
 			file.n += n
+			file.size += int64(n)
 			err = file.Flush()
 		}
 		nn += n
 		data = data[n:]
 	}
 	if err != nil {
-		ylog.Error(err)
-		file.size += int64(nn)
 		return
 	}
 	n := copy(file.wbuf[file.n:], data)
 	file.n += n
+	file.size += int64(n)
 	nn += n
-	file.size += int64(nn)
 	return
 }
 
+// WriteAt overwrites data which has been written at offset
+func (file *FileWithBuffer) WriteAt(data []byte, offset int64) error {
+	if offset < 0 || offset+int64(len(data)) > file.size {
+		return ErrInvalid
+	}
+	file.dirty = true
+	fsize := file.size - int64(file.n)
+	if offset < fsize {
+		n := len(data)
+		if offset+int64(n) > fsize {
+			n = int(fsize - offset)
+		}
+		if _, err := file.writeAt(data[:n], offset); err != nil {
+			return err
+		}
+		data = data[n:]
+		offset += int64(n)
+	}
+	if len(data) > 0 {
+		copy(file.wbuf[offset-fsize:], data)
+	}
+	return nil
+}
+
+// Truncate discards data after size
+func (file *FileWithBuffer) Truncate(size int64) error {
+	if size < 0 || size > file.size {
+		return ErrInvalid
+	}
+	file.dirty = true
+	fsize := file.size - int64(file.n)
+	if size >= fsize {
+		file.n = int(size - fsize)
+	} else {
+		if err := file.f.Truncate(size); err != nil {
+			return err
+		}
+		file.n = 0
+	}
+	file.size = size
+	return nil
+}
+
 func (file *FileWithBuffer) Flush() error {
 	if file.n == 0 {
 		return nil
 	}
-	n, err := file.f.Write(file.wbuf[:file.n])
+	n, err := file.writeAt(file.wbuf[:file.n], file.size-int64(file.n))
 	if err != nil {
 		if n > 0 && n < file.n {
 			copy(file.wbuf[:file.n-n], file.wbuf[n:file.n])
@@ -155,8 +362,19 @@ func (file *FileWithBuffer) Flush() error {
 }
 
 func (file *FileWithBuffer) Sync() error {
-	file.Flush()
-	return file.f.Sync()
+	if err := file.Flush(); err != nil {
+		return err
+	}
+	if err := file.f.Sync(); err != nil {
+		return err
+	}
+	file.dirty = false
+	return nil
+}
+
+// Dirty reports whether data may have been written since last Sync
+func (file *FileWithBuffer) Dirty() bool {
+	return file.dirty
 }
 
 func (file *FileWithBuffer) Size() int64 {
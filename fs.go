@@ -0,0 +1,177 @@
+package beecask
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	ErrLocked               = fmt.Errorf("Database is locked")
+	ErrMmapUnsupported      = fmt.Errorf("Mmap is not supported")
+	ErrFreeSpaceUnsupported = fmt.Errorf("Free space is not supported")
+	ErrFileSystemCrash      = fmt.Errorf("File system crashed")
+	ErrInjectedFault        = fmt.Errorf("Injected fault")
+)
+
+// File is a file opened by FS
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Name() string
+	Size() (int64, error)
+	Truncate(size int64) error
+	Sync() error
+}
+
+// FS is the file system a database lives in, all paths are joined
+// with the database directory by callers
+type FS interface {
+	// Open opens a file read-only
+	Open(name string) (File, error)
+	// Create opens a file read-write, it is created if not exist
+	// and is not truncated if exists
+	Create(name string) (File, error)
+	Rename(oldname, newname string) error
+	Remove(name string) error
+	// ReadDir returns names of entries in dir
+	ReadDir(dir string) ([]string, error)
+	MkdirAll(dir string, perm os.FileMode) error
+	Stat(name string) (os.FileInfo, error)
+	// FreeSpace returns bytes available to unprivileged users on the file
+	// system holding dir, ErrFreeSpaceUnsupported if it is unknown
+	FreeSpace(dir string) (int64, error)
+	// Lock locks name exclusively, it fails with ErrLocked if name is
+	// locked by others. The lock is released by closing the closer.
+	Lock(name string) (io.Closer, error)
+	// Mmap maps size bytes of f read-only, ErrMmapUnsupported means
+	// callers should read the file instead
+	Mmap(f File, size int64) ([]byte, error)
+	// MmapWritable maps size bytes of f shared and writable, changes are
+	// written back to f. ErrMmapUnsupported means callers should write f.
+	MmapWritable(f File, size int64) ([]byte, error)
+	// Msync writes changes of a writable mapping back synchronously
+	Msync(data []byte) error
+	Munmap(data []byte) error
+	// Madvise hints the access pattern of a mapping by ADVICE_*
+	Madvise(data []byte, advice int) error
+}
+
+// OSFS is the FS of the operating system, it is used if Options.FS is nil
+type OSFS struct{}
+
+func (OSFS) Open(name string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{f}, nil
+}
+
+func (OSFS) Create(name string) (File, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{f}, nil
+}
+
+func (OSFS) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (OSFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFS) ReadDir(dir string) ([]string, error) {
+	return ReadDir(dir)
+}
+
+func (OSFS) MkdirAll(dir string, perm os.FileMode) error {
+	return os.MkdirAll(dir, perm)
+}
+
+func (OSFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OSFS) FreeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+func (OSFS) Lock(name string) (io.Closer, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	// closing f releases the lock
+	return f, nil
+}
+
+func (OSFS) Mmap(f File, size int64) ([]byte, error) {
+	of, ok := f.(osFile)
+	if !ok {
+		return nil, ErrMmapUnsupported
+	}
+	return syscall.Mmap(int(of.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_PRIVATE)
+}
+
+func (OSFS) MmapWritable(f File, size int64) ([]byte, error) {
+	of, ok := f.(osFile)
+	if !ok {
+		return nil, ErrMmapUnsupported
+	}
+	return syscall.Mmap(int(of.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+func (OSFS) Msync(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (OSFS) Munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
+
+func (OSFS) Madvise(data []byte, advice int) error {
+	switch advice {
+	case ADVICE_RANDOM:
+		return syscall.Madvise(data, syscall.MADV_RANDOM)
+	case ADVICE_SEQUENTIAL:
+		return syscall.Madvise(data, syscall.MADV_SEQUENTIAL)
+	}
+	return syscall.Madvise(data, syscall.MADV_NORMAL)
+}
+
+type osFile struct {
+	*os.File
+}
+
+func (f osFile) Size() (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
@@ -0,0 +1,139 @@
+package beecask
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func readAll(t *testing.T, fs FS, name string) string {
+	t.Helper()
+	f, err := fs.Open(name)
+	if err != nil {
+		t.Fatalf("open %s failed, err=%v", name, err)
+	}
+	defer f.Close()
+	size, err := f.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, size)
+	if _, err = f.ReadAt(data, 0); err != nil && size > 0 {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestMemFS(t *testing.T) {
+	fs := NewMemFS()
+	if err := fs.MkdirAll("/db", 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Create("/db/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("hello"), 0)
+	f.WriteAt([]byte("!"), 7)
+	f.Close()
+	if data := readAll(t, fs, "/db/a"); data != "hello\x00\x00!" {
+		t.Fatalf("content mismatches, got %q", data)
+	}
+	if err = fs.Rename("/db/a", "/db/b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Open("/db/a"); err == nil {
+		t.Fatalf("renamed file still exists")
+	}
+	names, err := fs.ReadDir("/db")
+	if err != nil || len(names) != 1 || names[0] != "b" {
+		t.Fatalf("read dir expects b, got %v, err=%v", names, err)
+	}
+	if err = fs.Remove("/db/b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Stat("/db/b"); err == nil {
+		t.Fatalf("removed file still exists")
+	}
+
+	l, err := fs.Lock("/db/LOCK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Lock("/db/LOCK"); err != ErrLocked {
+		t.Fatalf("second lock expects ErrLocked, err=%v", err)
+	}
+	l.Close()
+	if l, err = fs.Lock("/db/LOCK"); err != nil {
+		t.Fatalf("lock after release failed, err=%v", err)
+	}
+	l.Close()
+}
+
+func TestFaultFSCrash(t *testing.T) {
+	for i, torn := range []bool{false, true} {
+		fs := NewFaultFS(NewMemFS())
+		fs.MkdirAll("/db", 0755)
+		f, _ := fs.Create("/db/a")
+		f.WriteAt([]byte("synced"), 0)
+		f.Sync()
+		f.WriteAt([]byte("SYN"), 0)
+		f.WriteAt([]byte("-lost"), 6)
+
+		var err error
+		if torn {
+			err = fs.TornCrash(rand.New(rand.NewSource(int64(i))))
+		} else {
+			err = fs.Crash()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = f.WriteAt([]byte("x"), 0); err != ErrFileSystemCrash {
+			t.Fatalf("torn %v: write after crash expects ErrFileSystemCrash, err=%v", torn, err)
+		}
+		data := readAll(t, fs, "/db/a")
+		if len(data) < 6 || data[:6] != "synced" || (!torn && len(data) != 6) || data[6:] != "-lost"[:len(data)-6] {
+			t.Fatalf("torn %v: content expects synced prefix, got %q", torn, data)
+		}
+	}
+}
+
+func TestFaultFSFaults(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	fs.MkdirAll("/db", 0755)
+	f, _ := fs.Create("/db/a")
+	defer f.Close()
+
+	fs.FailWrites(1, nil)
+	if _, err := f.WriteAt([]byte("ab"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("cd"), 2); err != ErrInjectedFault {
+		t.Fatalf("write expects ErrInjectedFault, err=%v", err)
+	}
+	fs.ClearFaults()
+	fs.ShortWrites(0)
+	if n, err := f.WriteAt([]byte("cdef"), 2); err == nil || n != 2 {
+		t.Fatalf("write expects short, n=%d err=%v", n, err)
+	}
+	errSync := fmt.Errorf("sync")
+	fs.FailSyncs(errSync)
+	if err := f.Sync(); err != errSync {
+		t.Fatalf("sync expects injected error, err=%v", err)
+	}
+	fs.FailRenames(ErrInjectedFault)
+	if err := fs.Rename("/db/a", "/db/b"); err != ErrInjectedFault {
+		t.Fatalf("rename expects ErrInjectedFault, err=%v", err)
+	}
+	fs.ClearFaults()
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Corrupt("/db/a", 0); err != nil {
+		t.Fatal(err)
+	}
+	if data := readAll(t, fs, "/db/a"); data != string([]byte{'a' ^ 0xff})+"bcd" {
+		t.Fatalf("content expects first byte flipped, got %q", data)
+	}
+}
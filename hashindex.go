@@ -0,0 +1,590 @@
+package beecask
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+const (
+	HASH_INDEX_MAGIC       = "BCHIDX01"
+	HASH_INDEX_HEADER_SIZE = 4096 // a page, so that the table is page aligned
+	HASH_INDEX_SLOT_SIZE   = 64
+	HASH_INDEX_MIN_SLOTS   = 1024
+	HASH_INDEX_MAX_LOAD    = 0.7 // deleted slots included
+)
+
+// Slot state
+const (
+	HASH_SLOT_EMPTY = iota
+	HASH_SLOT_USED
+	HASH_SLOT_DELETED // keeps probe sequences going through the slot
+)
+
+var (
+	errIndexInvalid  = fmt.Errorf("Index is invalid")
+	errIndexNotClean = fmt.Errorf("Index was not closed cleanly")
+)
+
+// hashIndexCheckpoint is the state of database saved by a clean close,
+// the index is only valid for the data files it was saved with
+type hashIndexCheckpoint struct {
+	seq          uint64
+	maxBucketId  uint64
+	lastFileId   uint64 // last data file
+	lastFileSize int64
+}
+
+// KeyFn reads the key of the record at valuePos of data file fileId
+type KeyFn func(fileId uint64, valuePos uint32) (string, error)
+
+// HashIndex keeps items in an open-addressing hash table in a mmaped file,
+// so that key sets larger than memory can be served. Slots keep hash of keys
+// instead of keys, keys are verified against records in data files.
+// The table is only trusted after a clean close, it is rebuilt from hint
+// files otherwise. Operand lists of Append are kept in memory, an index
+// holding any of them is not saved clean.
+//
+// File layout: a header of HASH_INDEX_HEADER_SIZE bytes followed by slots
+// of HASH_INDEX_SLOT_SIZE bytes, little endian.
+//
+//	header: magic(8) slots(8) used(8) count(8) tombstones(8) internals(8)
+//	        seq(8) maxBucketId(8) lastFileId(8) lastFileSize(8)
+//	        clean(4) tableCrc(4) headerCrc(4)
+//	slot:   state(1) pad(3) flag(4) hash(8) fileId(8) valuePos(4)
+//	        valueSize(4) keySize(4) pad(4) expiration(8) seq(8) pad(8)
+type HashIndex struct {
+	fs         FS
+	path       string
+	f          File
+	region     []byte                      // header and slots
+	mmaped     bool                        // region is a writable mapping, otherwise writes go through f
+	slots      uint64                      // power of two
+	used       uint64                      // slots not empty, deleted ones included
+	count      uint64                      // slots in use
+	tombstones int                         // number of items with delete flag
+	internals  int                         // number of items with bucket flag and without delete flag
+	operands   map[operandRef][]operandRef // operand lists by base record
+	keyFn      KeyFn
+	logger     Logger
+	err        error // first write error, changes are only kept in memory after it
+}
+
+// openHashIndex opens the index at path. The checkpoint is returned if the
+// index was closed cleanly, otherwise the index is reset to be rebuilt.
+// The index is marked unclean durably before it is returned.
+func openHashIndex(fs FS, path string, keyFn KeyFn, logger Logger) (*HashIndex, *hashIndexCheckpoint, error) {
+	f, err := fs.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	hi := &HashIndex{
+		fs:       fs,
+		path:     path,
+		f:        f,
+		operands: make(map[operandRef][]operandRef),
+		keyFn:    keyFn,
+		logger:   logger,
+	}
+	cp, err := hi.load()
+	if err == nil {
+		err = hi.markUnclean()
+	} else {
+		logger.Infof("Rebuild hash index[%s], reason=%s", path, err)
+		cp = nil
+		err = hi.Reset()
+	}
+	if err != nil {
+		hi.unmap()
+		f.Close()
+		return nil, nil, err
+	}
+	return hi, cp, nil
+}
+
+// load maps the index and returns its checkpoint if it is valid and clean
+func (hi *HashIndex) load() (*hashIndexCheckpoint, error) {
+	size, err := hi.f.Size()
+	if err != nil {
+		return nil, err
+	}
+	if size < HASH_INDEX_HEADER_SIZE {
+		return nil, errIndexInvalid
+	}
+	if err = hi.mapRegion(size); err != nil {
+		return nil, err
+	}
+
+	header := hi.region[:HASH_INDEX_HEADER_SIZE]
+	if string(header[0:8]) != HASH_INDEX_MAGIC || crc32.ChecksumIEEE(header[:88]) != binary.LittleEndian.Uint32(header[88:92]) {
+		return nil, errIndexInvalid
+	}
+	slots := binary.LittleEndian.Uint64(header[8:16])
+	if slots < HASH_INDEX_MIN_SLOTS || slots&(slots-1) != 0 || size != HASH_INDEX_HEADER_SIZE+int64(slots)*HASH_INDEX_SLOT_SIZE {
+		return nil, errIndexInvalid
+	}
+	if binary.LittleEndian.Uint32(header[80:84]) != 1 {
+		return nil, errIndexNotClean
+	}
+	if crc32.ChecksumIEEE(hi.region[HASH_INDEX_HEADER_SIZE:]) != binary.LittleEndian.Uint32(header[84:88]) {
+		return nil, ErrDataCorruption
+	}
+
+	hi.slots = slots
+	hi.used = binary.LittleEndian.Uint64(header[16:24])
+	hi.count = binary.LittleEndian.Uint64(header[24:32])
+	hi.tombstones = int(binary.LittleEndian.Uint64(header[32:40]))
+	hi.internals = int(binary.LittleEndian.Uint64(header[40:48]))
+	return &hashIndexCheckpoint{
+		seq:          binary.LittleEndian.Uint64(header[48:56]),
+		maxBucketId:  binary.LittleEndian.Uint64(header[56:64]),
+		lastFileId:   binary.LittleEndian.Uint64(header[64:72]),
+		lastFileSize: int64(binary.LittleEndian.Uint64(header[72:80])),
+	}, nil
+}
+
+// Reset empties the index
+func (hi *HashIndex) Reset() error {
+	hi.unmap()
+	size := HASH_INDEX_HEADER_SIZE + int64(HASH_INDEX_MIN_SLOTS)*HASH_INDEX_SLOT_SIZE
+	if err := hi.f.Truncate(0); err != nil {
+		return err
+	}
+	if err := hi.f.Truncate(size); err != nil {
+		return err
+	}
+	if err := hi.mapRegion(size); err != nil {
+		return err
+	}
+	hi.slots = HASH_INDEX_MIN_SLOTS
+	hi.used, hi.count = 0, 0
+	hi.tombstones, hi.internals = 0, 0
+	hi.operands = make(map[operandRef][]operandRef)
+	hi.err = nil
+	return hi.markUnclean()
+}
+
+// mapFile maps size bytes of f writable, or reads them into memory if mmap is
+// unsupported
+func mapFile(fs FS, f File, size int64) ([]byte, bool, error) {
+	region, err := fs.MmapWritable(f, size)
+	if err == nil {
+		return region, true, nil
+	}
+	if err != ErrMmapUnsupported {
+		return nil, false, err
+	}
+	region = make([]byte, size)
+	if _, err = f.ReadAt(region, 0); err != nil && err != io.EOF {
+		return nil, false, err
+	}
+	return region, false, nil
+}
+
+func (hi *HashIndex) mapRegion(size int64) error {
+	region, mmaped, err := mapFile(hi.fs, hi.f, size)
+	if err != nil {
+		return err
+	}
+	hi.region, hi.mmaped = region, mmaped
+	return nil
+}
+
+func (hi *HashIndex) unmap() {
+	if hi.mmaped {
+		hi.fs.Munmap(hi.region)
+	}
+	hi.region, hi.mmaped = nil, false
+}
+
+// sync makes the first n bytes of region durable
+func (hi *HashIndex) sync(n int) error {
+	if hi.mmaped {
+		return hi.fs.Msync(hi.region[:n])
+	}
+	return hi.f.Sync()
+}
+
+// write writes n bytes of region at off through f if region is not mapped
+func (hi *HashIndex) write(off uint64, n int) {
+	if hi.mmaped || hi.err != nil {
+		return
+	}
+	if _, err := hi.f.WriteAt(hi.region[off:off+uint64(n)], int64(off)); err != nil {
+		hi.logger.Errorf("Write hash index[%s] failed, err=%s", hi.path, err)
+		hi.err = err
+	}
+}
+
+// writeHeader encodes header with cp, a nil cp marks the index unclean
+func (hi *HashIndex) writeHeader(cp *hashIndexCheckpoint) error {
+	header := hi.region[:HASH_INDEX_HEADER_SIZE]
+	for i := range header {
+		header[i] = 0
+	}
+	copy(header[0:8], HASH_INDEX_MAGIC)
+	binary.LittleEndian.PutUint64(header[8:16], hi.slots)
+	binary.LittleEndian.PutUint64(header[16:24], hi.used)
+	binary.LittleEndian.PutUint64(header[24:32], hi.count)
+	binary.LittleEndian.PutUint64(header[32:40], uint64(hi.tombstones))
+	binary.LittleEndian.PutUint64(header[40:48], uint64(hi.internals))
+	if cp != nil {
+		binary.LittleEndian.PutUint64(header[48:56], cp.seq)
+		binary.LittleEndian.PutUint64(header[56:64], cp.maxBucketId)
+		binary.LittleEndian.PutUint64(header[64:72], cp.lastFileId)
+		binary.LittleEndian.PutUint64(header[72:80], uint64(cp.lastFileSize))
+		binary.LittleEndian.PutUint32(header[80:84], 1)
+		binary.LittleEndian.PutUint32(header[84:88], crc32.ChecksumIEEE(hi.region[HASH_INDEX_HEADER_SIZE:]))
+	}
+	binary.LittleEndian.PutUint32(header[88:92], crc32.ChecksumIEEE(header[:88]))
+	if !hi.mmaped {
+		if _, err := hi.f.WriteAt(header, 0); err != nil {
+			return err
+		}
+	}
+	return hi.sync(HASH_INDEX_HEADER_SIZE)
+}
+
+// markUnclean must be durable before the table is changed, so that a crash
+// leaves an index to be rebuilt
+func (hi *HashIndex) markUnclean() error {
+	return hi.writeHeader(nil)
+}
+
+// Close saves the index with checkpoint cp, a nil cp leaves the index to be
+// rebuilt at next open
+func (hi *HashIndex) Close(cp *hashIndexCheckpoint) error {
+	var err error
+	if cp != nil && hi.err == nil && len(hi.operands) == 0 {
+		// table must be durable before clean flag
+		if err = hi.sync(len(hi.region)); err == nil {
+			err = hi.writeHeader(cp)
+		}
+	}
+	hi.unmap()
+	if cerr := hi.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// hashKey is FNV-1a hash of key
+func hashKey(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+func (hi *HashIndex) slotOffset(i uint64) uint64 {
+	return HASH_INDEX_HEADER_SIZE + i*HASH_INDEX_SLOT_SIZE
+}
+
+func (hi *HashIndex) slot(i uint64) []byte {
+	off := hi.slotOffset(i)
+	return hi.region[off : off+HASH_INDEX_SLOT_SIZE]
+}
+
+func (hi *HashIndex) decodeSlot(s []byte, item *KDItem) {
+	item.flag = binary.LittleEndian.Uint32(s[4:8])
+	item.fileId = binary.LittleEndian.Uint64(s[16:24])
+	item.valuePos = binary.LittleEndian.Uint32(s[24:28])
+	item.valueSize = binary.LittleEndian.Uint32(s[28:32])
+	item.keySize = binary.LittleEndian.Uint32(s[32:36])
+	item.expiration = int64(binary.LittleEndian.Uint64(s[40:48]))
+	item.seq = binary.LittleEndian.Uint64(s[48:56])
+	item.operands = nil
+	if len(hi.operands) > 0 {
+		item.operands = hi.operands[operandRef{fileId: item.fileId, valuePos: item.valuePos}]
+	}
+}
+
+func encodeSlot(s []byte, hash uint64, keySize int, item *KDItem) {
+	for i := range s {
+		s[i] = 0
+	}
+	s[0] = HASH_SLOT_USED
+	binary.LittleEndian.PutUint32(s[4:8], item.flag)
+	binary.LittleEndian.PutUint64(s[8:16], hash)
+	binary.LittleEndian.PutUint64(s[16:24], item.fileId)
+	binary.LittleEndian.PutUint32(s[24:28], item.valuePos)
+	binary.LittleEndian.PutUint32(s[28:32], item.valueSize)
+	binary.LittleEndian.PutUint32(s[32:36], uint32(keySize))
+	binary.LittleEndian.PutUint64(s[40:48], uint64(item.expiration))
+	binary.LittleEndian.PutUint64(s[48:56], item.seq)
+}
+
+// keyOf reads key of a used slot, a key failed to read matches nothing
+func (hi *HashIndex) keyOf(s []byte) (string, bool) {
+	fileId := binary.LittleEndian.Uint64(s[16:24])
+	valuePos := binary.LittleEndian.Uint32(s[24:28])
+	key, err := hi.keyFn(fileId, valuePos)
+	if err != nil {
+		hi.logger.Errorf("Read key at datafile[%d] @ [%d] failed, err=%s", fileId, valuePos, err)
+		return "", false
+	}
+	return key, true
+}
+
+// find returns the slot of key, or the slot to insert key into if key is
+// not found
+func (hi *HashIndex) find(key string, hash uint64) (uint64, bool) {
+	mask := hi.slots - 1
+	free, hasFree := uint64(0), false
+	for i := hash & mask; ; i = (i + 1) & mask {
+		s := hi.slot(i)
+		switch s[0] {
+		case HASH_SLOT_EMPTY:
+			if !hasFree {
+				free = i
+			}
+			return free, false
+		case HASH_SLOT_DELETED:
+			if !hasFree {
+				free, hasFree = i, true
+			}
+		default:
+			if binary.LittleEndian.Uint64(s[8:16]) != hash || binary.LittleEndian.Uint32(s[32:36]) != uint32(len(key)) {
+				continue
+			}
+			if k, ok := hi.keyOf(s); ok && k == key {
+				return i, true
+			}
+		}
+	}
+}
+
+func (hi *HashIndex) addCounts(item *KDItem, delta int) {
+	if item.flag&RECORD_FLAG_BIT_DELETE != 0 {
+		hi.tombstones += delta
+	} else if item.flag&RECORD_FLAG_BIT_BUCKET != 0 {
+		hi.internals += delta
+	}
+}
+
+// grow rehashes used slots into a new table, deleted slots are dropped.
+// The new table is written to a temp file and renamed over the index.
+func (hi *HashIndex) grow() {
+	slots := uint64(HASH_INDEX_MIN_SLOTS)
+	for float64(hi.count+1) > float64(slots)*HASH_INDEX_MAX_LOAD/2 {
+		slots *= 2
+	}
+	size := HASH_INDEX_HEADER_SIZE + int64(slots)*HASH_INDEX_SLOT_SIZE
+
+	var f File
+	var region []byte
+	var mmaped bool
+	err := hi.err
+	if err == nil {
+		f, region, mmaped, err = hi.createTable(hi.path+TEMP_FILE_SUFFIX, size)
+	}
+	if err != nil {
+		if hi.err == nil {
+			hi.logger.Errorf("Grow hash index[%s] failed, err=%s", hi.path, err)
+			hi.err = err
+		}
+		// keep the table in memory, it is rebuilt at next open
+		region = make([]byte, size)
+	}
+
+	copy(region, hi.region[:HASH_INDEX_HEADER_SIZE])
+	mask := slots - 1
+	for i := uint64(0); i < hi.slots; i++ {
+		s := hi.slot(i)
+		if s[0] != HASH_SLOT_USED {
+			continue
+		}
+		j := binary.LittleEndian.Uint64(s[8:16]) & mask
+		for region[hi.slotOffset(j)] != HASH_SLOT_EMPTY {
+			j = (j + 1) & mask
+		}
+		copy(region[hi.slotOffset(j):], s)
+	}
+
+	if f != nil {
+		if !mmaped {
+			_, err = f.WriteAt(region, 0)
+		}
+		if err == nil {
+			err = hi.fs.Rename(f.Name(), hi.path)
+		}
+		if err != nil {
+			hi.logger.Errorf("Grow hash index[%s] failed, err=%s", hi.path, err)
+			hi.err = err
+			if mmaped {
+				// the mapping is dropped with f, keep a copy in memory
+				mapping := region
+				region = append([]byte(nil), mapping...)
+				hi.fs.Munmap(mapping)
+			}
+			f.Close()
+			hi.fs.Remove(f.Name())
+			f, mmaped = nil, false
+		}
+	}
+
+	hi.unmap()
+	if f != nil {
+		hi.f.Close()
+		hi.f = f
+	}
+	hi.region, hi.mmaped = region, mmaped
+	hi.slots = slots
+	hi.used = hi.count
+}
+
+func (hi *HashIndex) createTable(path string, size int64) (File, []byte, bool, error) {
+	f, err := hi.fs.Create(path)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if err = f.Truncate(0); err == nil {
+		err = f.Truncate(size)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, false, err
+	}
+	region, mmaped, err := mapFile(hi.fs, f, size)
+	if err != nil {
+		f.Close()
+		return nil, nil, false, err
+	}
+	return f, region, mmaped, nil
+}
+
+func (hi *HashIndex) Get(key string) *KDItem {
+	item, ok := hi.Lookup([]byte(key))
+	if !ok {
+		return nil
+	}
+	return &item
+}
+
+func (hi *HashIndex) Lookup(key []byte) (KDItem, bool) {
+	var item KDItem
+	skey := string(key)
+	i, found := hi.find(skey, hashKey(skey))
+	if !found {
+		return item, false
+	}
+	hi.decodeSlot(hi.slot(i), &item)
+	return item, true
+}
+
+func (hi *HashIndex) Set(key string, item *KDItem) {
+	hash := hashKey(key)
+	i, found := hi.find(key, hash)
+	if found {
+		var old KDItem
+		hi.decodeSlot(hi.slot(i), &old)
+		hi.addCounts(&old, -1)
+		delete(hi.operands, operandRef{fileId: old.fileId, valuePos: old.valuePos})
+	} else {
+		if hi.slot(i)[0] == HASH_SLOT_EMPTY {
+			if float64(hi.used+1) > float64(hi.slots)*HASH_INDEX_MAX_LOAD {
+				hi.grow()
+				i, _ = hi.find(key, hash)
+			}
+			hi.used++
+		}
+		hi.count++
+	}
+	encodeSlot(hi.slot(i), hash, len(key), item)
+	hi.write(hi.slotOffset(i), HASH_INDEX_SLOT_SIZE)
+	hi.addCounts(item, 1)
+	if item.hasOperands() {
+		hi.operands[operandRef{fileId: item.fileId, valuePos: item.valuePos}] = item.operands
+	}
+}
+
+func (hi *HashIndex) Delete(key string) {
+	i, found := hi.find(key, hashKey(key))
+	if !found {
+		return
+	}
+	s := hi.slot(i)
+	var old KDItem
+	hi.decodeSlot(s, &old)
+	hi.addCounts(&old, -1)
+	delete(hi.operands, operandRef{fileId: old.fileId, valuePos: old.valuePos})
+	s[0] = HASH_SLOT_DELETED
+	hi.write(hi.slotOffset(i), 1)
+	hi.count--
+}
+
+func (hi *HashIndex) ForEach(filter func(item *KDItem) bool, fn func(key string, item *KDItem) bool) {
+	var item KDItem
+	for i := uint64(0); i < hi.slots; i++ {
+		s := hi.slot(i)
+		if s[0] != HASH_SLOT_USED {
+			continue
+		}
+		hi.decodeSlot(s, &item)
+		if filter != nil && !filter(&item) {
+			continue
+		}
+		key, ok := hi.keyOf(s)
+		if !ok {
+			continue
+		}
+		if !fn(key, &item) {
+			return
+		}
+	}
+}
+
+func (hi *HashIndex) ForEachItem(fn func(item *KDItem)) {
+	var item KDItem
+	for i := uint64(0); i < hi.slots; i++ {
+		s := hi.slot(i)
+		if s[0] == HASH_SLOT_USED {
+			hi.decodeSlot(s, &item)
+			fn(&item)
+		}
+	}
+}
+
+// Keys returns keys which are neither deleted nor expired at now(unix seconds),
+// keys of buckets are excluded
+func (hi *HashIndex) Keys(now int64) []string {
+	keys := make([]string, 0, hi.Len())
+	hi.ForEach(func(item *KDItem) bool {
+		return item.flag&(RECORD_FLAG_BIT_DELETE|RECORD_FLAG_BIT_BUCKET) == 0 && !item.isExpired(now)
+	}, func(key string, item *KDItem) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// PrefixKeys returns keys of bucket prefixed by prefix which are neither
+// deleted nor expired at now(unix seconds), prefix is trimmed
+func (hi *HashIndex) PrefixKeys(prefix string, now int64) []string {
+	var keys []string
+	hi.ForEach(func(item *KDItem) bool {
+		return item.flag&(RECORD_FLAG_BIT_DELETE|RECORD_FLAG_BIT_RANGE_DELETE) == 0 && item.flag&RECORD_FLAG_BIT_BUCKET != 0 &&
+			item.keySize >= uint32(len(prefix)) && !item.isExpired(now)
+	}, func(key string, item *KDItem) bool {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key[len(prefix):])
+		}
+		return true
+	})
+	return keys
+}
+
+// Len returns number of items without delete flag, expired items are included
+// and keys of buckets are excluded
+func (hi *HashIndex) Len() int {
+	return int(hi.count) - hi.tombstones - hi.internals
+}
+
+// Tombstones returns number of items with delete flag
+func (hi *HashIndex) Tombstones() int {
+	return hi.tombstones
+}
@@ -0,0 +1,98 @@
+package beecask
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+const HASH_TEST_KEYS = 3000
+
+// hashTestValue is the value of key i, every seventh one is deleted
+func hashTestValue(i int) []byte {
+	if i%7 == 0 {
+		return nil
+	}
+	return []byte(fmt.Sprintf("v%d", i))
+}
+
+// hashTestKeys writes keys of hashTestValue over old values
+func hashTestKeys(t *testing.T, bc *Beecask) {
+	t.Helper()
+	fillKeys(t, bc, HASH_TEST_KEYS, func(int) []byte { return []byte("old") })
+	fillKeys(t, bc, HASH_TEST_KEYS, func(i int) []byte { return []byte(fmt.Sprintf("v%d", i)) })
+	for i := 0; i < HASH_TEST_KEYS; i += 7 {
+		bc.Delete(fmt.Sprintf("k%d", i))
+	}
+}
+
+func checkHashTestKeys(t *testing.T, bc *Beecask, tag string) {
+	t.Helper()
+	checkKeys(t, bc, HASH_TEST_KEYS, hashTestValue, tag)
+	expect := HASH_TEST_KEYS - (HASH_TEST_KEYS+6)/7
+	if n := bc.Count(); n != expect {
+		t.Fatalf("%s: count expects %d, got %d", tag, expect, n)
+	}
+	if n := len(bc.Keys()); n != expect {
+		t.Fatalf("%s: keys expects %d, got %d", tag, expect, n)
+	}
+}
+
+func TestHashIndex(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	logger := &recordLogger{}
+	opts := testOptions(fs)
+	opts.Logger = logger
+	opts.MaxFileSize = 64 << 10
+	opts.IndexMode = INDEX_MODE_HASH
+	bc := openTest(t, opts)
+
+	hashTestKeys(t, bc)
+	if hi := bc.keydir.index.(*HashIndex); hi.slots <= HASH_INDEX_MIN_SLOTS {
+		t.Fatalf("hash index expects grown, slots=%d", hi.slots)
+	}
+	rotateTest(t, bc)
+	mergeTest(t, bc)
+	checkHashTestKeys(t, bc, "live")
+	bc.Close()
+
+	bc = openTest(t, opts)
+	if !logger.has("restore from hash index succ") {
+		t.Fatalf("clean restart expects hash index reused")
+	}
+	checkHashTestKeys(t, bc, "clean restart")
+	if err := bc.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	bc = crashTest(t, bc, fs, opts)
+	if !logger.has(errIndexNotClean.Error()) {
+		t.Fatalf("crash expects hash index rebuilt")
+	}
+	checkHashTestKeys(t, bc, "crash")
+	bc.Close()
+
+	// a corrupted index is rebuilt from data files
+	indexPath := path.Join(TEST_DIR, INDEX_FILE_NAME)
+	if err := fs.Corrupt(indexPath, HASH_INDEX_HEADER_SIZE+100); err != nil {
+		t.Fatal(err)
+	}
+	bc = openTest(t, opts)
+	if !logger.has(ErrDataCorruption.Error()) {
+		t.Fatalf("corrupted index expects rebuilt")
+	}
+	checkHashTestKeys(t, bc, "corrupted index")
+	bc.Close()
+
+	opts.IndexMode = INDEX_MODE_MEMORY
+	bc = openTest(t, opts)
+	checkHashTestKeys(t, bc, "memory mode")
+	if _, err := fs.Stat(indexPath); !os.IsNotExist(err) {
+		t.Fatalf("memory mode expects hash index removed, err=%v", err)
+	}
+	bc.Close()
+	opts.IndexMode = INDEX_MODE_HASH
+	bc = openTest(t, opts)
+	defer bc.Close()
+	checkHashTestKeys(t, bc, "hash mode again")
+}
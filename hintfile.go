@@ -4,9 +4,6 @@ import (
 	"bufio"
 	"encoding/binary"
 	"io"
-	"os"
-
-	"github.com/yplusplus/ylog"
 )
 
 const (
@@ -19,17 +16,30 @@ type HintItem struct {
 	keySize    uint32
 	valueSize  uint32
 	valuePos   uint32
+	seq        uint64 // present if flag has RECORD_FLAG_BIT_SEQ
 	key        []byte
 }
 
+// HeaderSize returns header size including the optional sequence number
+func (item *HintItem) HeaderSize() int64 {
+	if (item.flag & RECORD_FLAG_BIT_SEQ) > 0 {
+		return HINT_ITEM_HEADER_SIZE + RECORD_SEQ_SIZE
+	}
+	return HINT_ITEM_HEADER_SIZE
+}
+
 func (item *HintItem) Encode() []byte {
-	buff := make([]byte, HINT_ITEM_HEADER_SIZE+int(item.keySize))
+	headerSize := item.HeaderSize()
+	buff := make([]byte, headerSize+int64(item.keySize))
 	binary.LittleEndian.PutUint32(buff[0:4], item.flag)
 	binary.LittleEndian.PutUint64(buff[4:12], uint64(item.expiration))
 	binary.LittleEndian.PutUint32(buff[12:16], item.keySize)
 	binary.LittleEndian.PutUint32(buff[16:20], item.valueSize)
 	binary.LittleEndian.PutUint32(buff[20:24], item.valuePos)
-	copy(buff[HINT_ITEM_HEADER_SIZE:], item.key)
+	if (item.flag & RECORD_FLAG_BIT_SEQ) > 0 {
+		binary.LittleEndian.PutUint64(buff[24:32], item.seq)
+	}
+	copy(buff[headerSize:], item.key)
 	return buff
 }
 
@@ -37,17 +47,13 @@ type ReadableHintFile struct {
 	file RandomAccessFile
 }
 
-func NewReadableHintFile(path string) (*ReadableHintFile, error) {
-	f, err := os.OpenFile(path, os.O_RDONLY, 0)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
-	file, err := NewMmapFile(f)
+func NewReadableHintFile(fs FS, path string, fa fileAccess) (*ReadableHintFile, error) {
+	file, err := fa.open(fs, path)
 	if err != nil {
 		return nil, err
 	}
+	// hint file is only read through by restore
+	file.Advise(ADVICE_SEQUENTIAL)
 
 	return &ReadableHintFile{file: file}, nil
 }
@@ -59,7 +65,6 @@ func (rhf *ReadableHintFile) ReadItem() (*HintItem, error) {
 func (rhf *ReadableHintFile) readItemAt(offset int64) (*HintItem, error) {
 	buff, err := rhf.file.ReadAt(offset, HINT_ITEM_HEADER_SIZE)
 	if err != nil {
-		ylog.Warn(err)
 		return nil, err
 	}
 
@@ -73,10 +78,19 @@ func (rhf *ReadableHintFile) readItemAt(offset int64) (*HintItem, error) {
 	}
 
 	offset += HINT_ITEM_HEADER_SIZE
+	if (item.flag & RECORD_FLAG_BIT_SEQ) > 0 {
+		buff, err = rhf.file.ReadAt(offset, RECORD_SEQ_SIZE)
+		if err != nil {
+			// may return io.EOF
+			return nil, err
+		}
+		item.seq = binary.LittleEndian.Uint64(buff)
+		offset += RECORD_SEQ_SIZE
+	}
+
 	item.key, err = rhf.file.ReadAt(offset, int64(item.keySize))
 	if err != nil {
 		// may return io.EOF
-		ylog.Warn(err)
 		return nil, err
 	}
 
@@ -91,14 +105,13 @@ func (rhf *ReadableHintFile) ForEachItem(fn func(item *HintItem) error) error {
 			if err == io.EOF {
 				break
 			}
-			ylog.Warn(err)
 			return err
 		}
 		err = fn(item)
 		if err != nil {
 			return err
 		}
-		offset += int64(HINT_ITEM_HEADER_SIZE) + int64(item.keySize)
+		offset += item.HeaderSize() + int64(item.keySize)
 	}
 	return nil
 }
@@ -108,27 +121,51 @@ func (rhf *ReadableHintFile) Close() error {
 }
 
 type WritableHintFile struct {
-	file *os.File
+	file File
 	wbuf *bufio.Writer
 }
 
-func NewWritableHintFile(path string) (*WritableHintFile, error) {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+// NewWritableHintFile creates a hint file, existing content is discarded
+func NewWritableHintFile(fs FS, path string) (*WritableHintFile, error) {
+	f, err := fs.Create(path)
 	if err != nil {
 		return nil, err
 	}
-	return &WritableHintFile{file: f, wbuf: bufio.NewWriter(f)}, nil
+	if err = f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &WritableHintFile{file: f, wbuf: bufio.NewWriter(&appendWriter{f: f})}, nil
 }
 
 func (whf *WritableHintFile) Append(buff []byte) error {
 	_, err := whf.wbuf.Write(buff)
-	if err != nil {
-		ylog.Warn(err)
-	}
 	return err
 }
 
+func (whf *WritableHintFile) Sync() error {
+	if err := whf.wbuf.Flush(); err != nil {
+		return err
+	}
+	return whf.file.Sync()
+}
+
 func (whf *WritableHintFile) Close() error {
-	whf.wbuf.Flush()
-	return whf.file.Close()
+	err := whf.wbuf.Flush()
+	if cerr := whf.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// appendWriter writes to the end of a File
+type appendWriter struct {
+	f      File
+	offset int64
+}
+
+func (aw *appendWriter) Write(p []byte) (int, error) {
+	n, err := aw.f.WriteAt(p, aw.offset)
+	aw.offset += int64(n)
+	return n, err
 }
@@ -1,12 +1,25 @@
 package beecask
 
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
 const (
 	DATA_ITEM_HEADER_SIZE = 24
+	RECORD_SEQ_SIZE       = 8
 )
 
 // Record flag
 const (
-	RECORD_FLAG_BIT_DELETE = 1 << iota
+	RECORD_FLAG_BIT_DELETE        = 1 << iota
+	RECORD_FLAG_BIT_TOUCH         // only updates expiration of an existing record
+	RECORD_FLAG_BIT_VALUE_POINTER // value is a pointer to value log
+	RECORD_FLAG_BIT_SEQ           // header is followed by a sequence number
+	RECORD_FLAG_BIT_BATCH         // value is a sequence of records written atomically
+	RECORD_FLAG_BIT_OPERAND       // value is an operand of merge operator
+	RECORD_FLAG_BIT_BUCKET        // key belongs to a bucket or is bucket metadata
+	RECORD_FLAG_BIT_RANGE_DELETE  // range tombstone, deletes keys in [key, value), empty value means no upper bound
 )
 
 type Record struct {
@@ -15,10 +28,68 @@ type Record struct {
 	expiration int64
 	keySize    uint32
 	valueSize  uint32
+	seq        uint64 // sequence number, zero if record has none
 	key        []byte
 	value      []byte
 }
 
+func newRecord(key []byte, value []byte, delete bool, expiration int64) *Record {
+	r := &Record{
+		crc:        0,
+		flag:       0,
+		expiration: expiration,
+		keySize:    uint32(len(key)),
+		valueSize:  uint32(len(value)),
+		key:        key,
+		value:      value,
+	}
+	if delete {
+		r.flag |= RECORD_FLAG_BIT_DELETE
+	}
+	return r
+}
+
+// HeaderSize returns header size including the optional sequence number
+func (r *Record) HeaderSize() int64 {
+	if (r.flag & RECORD_FLAG_BIT_SEQ) > 0 {
+		return DATA_ITEM_HEADER_SIZE + RECORD_SEQ_SIZE
+	}
+	return DATA_ITEM_HEADER_SIZE
+}
+
 func (r *Record) Size() int64 {
-	return int64(DATA_ITEM_HEADER_SIZE + r.keySize + r.valueSize)
+	return r.HeaderSize() + int64(r.keySize) + int64(r.valueSize)
+}
+
+// encodeHeader encodes header of r with crc unset
+func (r *Record) encodeHeader() []byte {
+	header := make([]byte, r.HeaderSize())
+	binary.LittleEndian.PutUint32(header[4:8], r.flag)
+	binary.LittleEndian.PutUint64(header[8:16], uint64(r.expiration))
+	binary.LittleEndian.PutUint32(header[16:20], r.keySize)
+	binary.LittleEndian.PutUint32(header[20:24], r.valueSize)
+	if (r.flag & RECORD_FLAG_BIT_SEQ) > 0 {
+		binary.LittleEndian.PutUint64(header[24:32], r.seq)
+	}
+	return header
+}
+
+// Encode encodes the whole record with crc
+func (r *Record) Encode() []byte {
+	buff := append(r.encodeHeader(), r.key...)
+	buff = append(buff, r.value...)
+	r.crc = crc32.ChecksumIEEE(buff[4:])
+	binary.LittleEndian.PutUint32(buff[0:4], r.crc)
+	return buff
+}
+
+// decodeHeader decodes the fixed-size part of header,
+// sequence number follows it if r.flag has RECORD_FLAG_BIT_SEQ
+func (r *Record) decodeHeader(header []byte) {
+	r.crc = binary.LittleEndian.Uint32(header[0:4])
+	r.flag = binary.LittleEndian.Uint32(header[4:8])
+	r.expiration = int64(binary.LittleEndian.Uint64(header[8:16]))
+	r.keySize = binary.LittleEndian.Uint32(header[16:20])
+	r.valueSize = binary.LittleEndian.Uint32(header[20:24])
+	r.seq = 0
 }
@@ -1,16 +1,80 @@
 package beecask
 
-import ()
+import (
+	"strings"
+)
 
 type KDItem struct {
-	fileId    uint64
-	valuePos  uint32
-	valueSize uint32
-	flag      uint32
+	fileId     uint64
+	valuePos   uint32
+	valueSize  uint32
+	flag       uint32
+	keySize    uint32 // set by index
+	expiration int64
+	seq        uint64       // version of key, bumped by every write of it
+	operands   []operandRef // operand records appended after the record above
+}
+
+// operandRef locates an operand record written by Append
+type operandRef struct {
+	fileId   uint64
+	valuePos uint32
+}
+
+// hasOperands reports whether value of item has to be folded by merge operator
+func (item *KDItem) hasOperands() bool {
+	return len(item.operands) > 0
+}
+
+// contains reports whether the record at (fileId, valuePos) belongs to item
+func (item *KDItem) contains(fileId uint64, valuePos uint32) bool {
+	if item.fileId == fileId && item.valuePos == valuePos {
+		return true
+	}
+	for _, ref := range item.operands {
+		if ref.fileId == fileId && ref.valuePos == valuePos {
+			return true
+		}
+	}
+	return false
+}
+
+// appendOperand appends an operand record, the operand list is copied
+// since items share it after KeyDir.Get and KeyDir.Set
+func (item *KDItem) appendOperand(fileId uint64, valuePos uint32) {
+	n := len(item.operands)
+	item.operands = append(item.operands[:n:n], operandRef{fileId: fileId, valuePos: valuePos})
+}
+
+// isExpired reports whether item has expired at now(unix seconds)
+func (item *KDItem) isExpired(now int64) bool {
+	return item.expiration > 0 && item.expiration <= now
+}
+
+// index maps keys to items, it is implemented by KeyDir in memory and by
+// HashIndex on disk. Items passed to fn of ForEach and ForEachItem must not
+// be retained. fn of ForEach may Set existing keys or Delete keys, but must
+// not add keys.
+type index interface {
+	Get(key string) *KDItem
+	Lookup(key []byte) (KDItem, bool)
+	Set(key string, item *KDItem)
+	Delete(key string)
+	Keys(now int64) []string
+	PrefixKeys(prefix string, now int64) []string
+	Len() int
+	Tombstones() int
+	// ForEach calls fn on each item passing filter until fn returns false,
+	// filter may be nil. Keys are only resolved for items passing filter.
+	ForEach(filter func(item *KDItem) bool, fn func(key string, item *KDItem) bool)
+	// ForEachItem calls fn on each item without resolving keys
+	ForEachItem(fn func(item *KDItem))
 }
 
 type KeyDir struct {
-	dict map[string]*KDItem
+	dict       map[string]*KDItem
+	tombstones int // number of items with delete flag
+	internals  int // number of items with bucket flag and without delete flag
 }
 
 func NewKeyDir() *KeyDir {
@@ -29,22 +93,88 @@ func (kd *KeyDir) Get(key string) *KDItem {
 	return nil
 }
 
+// Lookup returns a copy of item by value, it does not allocate
+func (kd *KeyDir) Lookup(key []byte) (KDItem, bool) {
+	item, ok := kd.dict[string(key)]
+	if ok {
+		return *item, true
+	}
+	return KDItem{}, false
+}
+
 func (kd *KeyDir) Set(key string, item *KDItem) {
+	kd.Delete(key)
 	// make a copy
 	nitem := *item
+	nitem.keySize = uint32(len(key))
 	kd.dict[key] = &nitem
+	if nitem.flag&RECORD_FLAG_BIT_DELETE != 0 {
+		kd.tombstones++
+	} else if nitem.flag&RECORD_FLAG_BIT_BUCKET != 0 {
+		kd.internals++
+	}
 }
 
 func (kd *KeyDir) Delete(key string) {
-	delete(kd.dict, key)
+	if item, ok := kd.dict[key]; ok {
+		if item.flag&RECORD_FLAG_BIT_DELETE != 0 {
+			kd.tombstones--
+		} else if item.flag&RECORD_FLAG_BIT_BUCKET != 0 {
+			kd.internals--
+		}
+		delete(kd.dict, key)
+	}
 }
 
-func (kd *KeyDir) Keys() []string {
-	keys := make([]string, 0, len(kd.dict))
+// Keys returns keys which are neither deleted nor expired at now(unix seconds),
+// keys of buckets are excluded
+func (kd *KeyDir) Keys(now int64) []string {
+	keys := make([]string, 0, kd.Len())
 	for k, v := range kd.dict {
-		if v.flag&RECORD_FLAG_BIT_DELETE == 0 {
+		if v.flag&(RECORD_FLAG_BIT_DELETE|RECORD_FLAG_BIT_BUCKET) == 0 && !v.isExpired(now) {
 			keys = append(keys, k)
 		}
 	}
 	return keys
 }
+
+// PrefixKeys returns keys of bucket prefixed by prefix which are neither
+// deleted nor expired at now(unix seconds), prefix is trimmed
+func (kd *KeyDir) PrefixKeys(prefix string, now int64) []string {
+	var keys []string
+	for k, v := range kd.dict {
+		if v.flag&(RECORD_FLAG_BIT_DELETE|RECORD_FLAG_BIT_RANGE_DELETE) == 0 && v.flag&RECORD_FLAG_BIT_BUCKET != 0 &&
+			strings.HasPrefix(k, prefix) && !v.isExpired(now) {
+			keys = append(keys, k[len(prefix):])
+		}
+	}
+	return keys
+}
+
+// Len returns number of items without delete flag, expired items are included
+// and keys of buckets are excluded
+func (kd *KeyDir) Len() int {
+	return len(kd.dict) - kd.tombstones - kd.internals
+}
+
+// Tombstones returns number of items with delete flag
+func (kd *KeyDir) Tombstones() int {
+	return kd.tombstones
+}
+
+func (kd *KeyDir) ForEach(filter func(item *KDItem) bool, fn func(key string, item *KDItem) bool) {
+	for key, item := range kd.dict {
+		if filter != nil && !filter(item) {
+			continue
+		}
+		if !fn(key, item) {
+			return
+		}
+	}
+}
+
+func (kd *KeyDir) ForEachItem(fn func(item *KDItem)) {
+	for _, item := range kd.dict {
+		fn(item)
+	}
+}
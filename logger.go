@@ -0,0 +1,60 @@
+package beecask
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/yplusplus/ylog"
+)
+
+// Logger receives log lines of the database, it must be safe for
+// concurrent use. Errors are always returned to callers as well,
+// logging them is only for diagnosis.
+type Logger interface {
+	Tracef(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// YlogLogger logs through github.com/yplusplus/ylog, it is used
+// if Options.Logger is nil
+type YlogLogger struct{}
+
+func (YlogLogger) Tracef(format string, v ...interface{}) { ylog.Tracef(format, v...) }
+func (YlogLogger) Infof(format string, v ...interface{})  { ylog.Infof(format, v...) }
+func (YlogLogger) Warnf(format string, v ...interface{})  { ylog.Warnf(format, v...) }
+func (YlogLogger) Errorf(format string, v ...interface{}) { ylog.Errorf(format, v...) }
+
+// NopLogger discards all log lines
+type NopLogger struct{}
+
+func (NopLogger) Tracef(format string, v ...interface{}) {}
+func (NopLogger) Infof(format string, v ...interface{})  {}
+func (NopLogger) Warnf(format string, v ...interface{})  {}
+func (NopLogger) Errorf(format string, v ...interface{}) {}
+
+// LevelTrace is the slog level of trace lines, it is below slog.LevelDebug
+const LevelTrace = slog.LevelDebug - 4
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlogLogger returns a Logger writing to l
+func NewSlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l: l}
+}
+
+func (sl slogLogger) logf(level slog.Level, format string, v ...interface{}) {
+	ctx := context.Background()
+	if sl.l.Enabled(ctx, level) {
+		sl.l.Log(ctx, level, fmt.Sprintf(format, v...))
+	}
+}
+
+func (sl slogLogger) Tracef(format string, v ...interface{}) { sl.logf(LevelTrace, format, v...) }
+func (sl slogLogger) Infof(format string, v ...interface{})  { sl.logf(slog.LevelInfo, format, v...) }
+func (sl slogLogger) Warnf(format string, v ...interface{})  { sl.logf(slog.LevelWarn, format, v...) }
+func (sl slogLogger) Errorf(format string, v ...interface{}) { sl.logf(slog.LevelError, format, v...) }
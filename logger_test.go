@@ -0,0 +1,80 @@
+package beecask
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordLogger keeps info and error lines
+type recordLogger struct {
+	NopLogger
+	mu     sync.Mutex
+	infos  []string
+	errors []string
+}
+
+func (rl *recordLogger) Infof(format string, v ...interface{}) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.infos = append(rl.infos, fmt.Sprintf(format, v...))
+}
+
+func (rl *recordLogger) Errorf(format string, v ...interface{}) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.errors = append(rl.errors, fmt.Sprintf(format, v...))
+}
+
+// has reports whether a line containing s is logged
+func (rl *recordLogger) has(s string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for _, line := range append(rl.infos, rl.errors...) {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLoggerReceivesErrors(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	logger := &recordLogger{}
+	opts := testOptions(fs)
+	opts.Logger = logger
+	opts.WriteBufferSize = 16
+	bc := openTest(t, opts)
+	defer bc.Close()
+
+	fs.FailWrites(0, nil)
+	if err := bc.Set("k", make([]byte, 100)); err == nil {
+		t.Fatalf("write expects failure")
+	}
+	fs.ClearFaults()
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if len(logger.errors) == 0 {
+		t.Fatalf("failed write expects error lines")
+	}
+}
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewSlogLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	logger.Tracef("trace %d", 1)
+	logger.Infof("info %d", 2)
+	logger.Errorf("error %d", 3)
+
+	out := buf.String()
+	if strings.Contains(out, "trace 1") {
+		t.Fatalf("trace line expects filtered, got %s", out)
+	}
+	if !strings.Contains(out, "level=INFO msg=\"info 2\"") || !strings.Contains(out, "level=ERROR msg=\"error 3\"") {
+		t.Fatalf("info and error lines expected, got %s", out)
+	}
+}
@@ -0,0 +1,352 @@
+package beecask
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemFS is a FS keeping files in memory, it is meant for tests.
+// Mmap is not supported, so files are read into memory instead.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memNode
+	dirs  map[string]bool
+	locks map[string]bool
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memNode),
+		dirs:  make(map[string]bool),
+		locks: make(map[string]bool),
+	}
+}
+
+type memNode struct {
+	mu      sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+// isDir requires fs.mu held
+func (fs *MemFS) isDir(dir string) bool {
+	return dir == "." || dir == "/" || fs.dirs[dir]
+}
+
+func (fs *MemFS) Open(name string) (File, error) {
+	name = path.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	node, ok := fs.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return &memFile{name: name, node: node}, nil
+}
+
+func (fs *MemFS) Create(name string) (File, error) {
+	name = path.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	node, err := fs.create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &memFile{name: name, node: node, writable: true}, nil
+}
+
+// create returns the node of name, it is created if not exist.
+// create requires fs.mu held
+func (fs *MemFS) create(name string) (*memNode, error) {
+	if node, ok := fs.files[name]; ok {
+		return node, nil
+	}
+	if !fs.isDir(path.Dir(name)) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	node := &memNode{modTime: time.Now()}
+	fs.files[name] = node
+	return node, nil
+}
+
+func (fs *MemFS) Rename(oldname, newname string) error {
+	oldname, newname = path.Clean(oldname), path.Clean(newname)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	node, ok := fs.files[oldname]
+	if !ok || !fs.isDir(path.Dir(newname)) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	delete(fs.files, oldname)
+	fs.files[newname] = node
+	return nil
+}
+
+func (fs *MemFS) Remove(name string) error {
+	name = path.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.files[name]; ok {
+		// open files are still readable like unix
+		delete(fs.files, name)
+		return nil
+	}
+	if fs.dirs[name] {
+		if len(fs.list(name)) > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: os.ErrExist}
+		}
+		delete(fs.dirs, name)
+		return nil
+	}
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *MemFS) ReadDir(dir string) ([]string, error) {
+	dir = path.Clean(dir)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if !fs.isDir(dir) {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+	return fs.list(dir), nil
+}
+
+// list returns names of entries in dir.
+// list requires fs.mu held
+func (fs *MemFS) list(dir string) []string {
+	var names []string
+	for name := range fs.files {
+		if path.Dir(name) == dir {
+			names = append(names, path.Base(name))
+		}
+	}
+	for name := range fs.dirs {
+		if name != dir && path.Dir(name) == dir {
+			names = append(names, path.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (fs *MemFS) MkdirAll(dir string, perm os.FileMode) error {
+	dir = path.Clean(dir)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for d := dir; !fs.isDir(d); d = path.Dir(d) {
+		if _, ok := fs.files[d]; ok {
+			return &os.PathError{Op: "mkdir", Path: d, Err: os.ErrExist}
+		}
+		fs.dirs[d] = true
+	}
+	return nil
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	name = path.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if node, ok := fs.files[name]; ok {
+		node.mu.RLock()
+		defer node.mu.RUnlock()
+		return &memFileInfo{name: path.Base(name), size: int64(len(node.data)), modTime: node.modTime}, nil
+	}
+	if fs.isDir(name) {
+		return &memFileInfo{name: path.Base(name), dir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *MemFS) Lock(name string) (io.Closer, error) {
+	name = path.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.locks[name] {
+		return nil, ErrLocked
+	}
+	// the lock file is created like OSFS does
+	if _, err := fs.create(name); err != nil {
+		return nil, err
+	}
+	fs.locks[name] = true
+	return &memLock{fs: fs, name: name}, nil
+}
+
+func (fs *MemFS) FreeSpace(dir string) (int64, error) {
+	return 0, ErrFreeSpaceUnsupported
+}
+
+func (fs *MemFS) Mmap(f File, size int64) ([]byte, error) {
+	return nil, ErrMmapUnsupported
+}
+
+func (fs *MemFS) MmapWritable(f File, size int64) ([]byte, error) {
+	return nil, ErrMmapUnsupported
+}
+
+func (fs *MemFS) Msync(data []byte) error {
+	return nil
+}
+
+func (fs *MemFS) Munmap(data []byte) error {
+	return nil
+}
+
+func (fs *MemFS) Madvise(data []byte, advice int) error {
+	return nil
+}
+
+type memLock struct {
+	fs   *MemFS
+	name string
+	once sync.Once
+}
+
+func (l *memLock) Close() error {
+	l.once.Do(func() {
+		l.fs.mu.Lock()
+		delete(l.fs.locks, l.name)
+		l.fs.mu.Unlock()
+	})
+	return nil
+}
+
+type memFile struct {
+	name     string
+	node     *memNode
+	writable bool
+	closed   bool // requires node.mu held
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) ReadAt(p []byte, offset int64) (int, error) {
+	f.node.mu.RLock()
+	defer f.node.mu.RUnlock()
+	if f.closed {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrClosed}
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrInvalid}
+	}
+	if offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, offset int64) (int, error) {
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	if err := f.checkWritable("write"); err != nil {
+		return 0, err
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrInvalid}
+	}
+	if end := offset + int64(len(p)); end > int64(len(f.node.data)) {
+		f.node.resize(end)
+	}
+	copy(f.node.data[offset:], p)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	if err := f.checkWritable("truncate"); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.node.resize(size)
+	f.node.modTime = time.Now()
+	return nil
+}
+
+// checkWritable requires f.node.mu held
+func (f *memFile) checkWritable(op string) error {
+	if f.closed {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	if !f.writable {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	f.node.mu.RLock()
+	defer f.node.mu.RUnlock()
+	if f.closed {
+		return &os.PathError{Op: "sync", Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+func (f *memFile) Size() (int64, error) {
+	f.node.mu.RLock()
+	defer f.node.mu.RUnlock()
+	if f.closed {
+		return 0, &os.PathError{Op: "stat", Path: f.name, Err: os.ErrClosed}
+	}
+	return int64(len(f.node.data)), nil
+}
+
+func (f *memFile) Close() error {
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+// resize requires node.mu held
+func (node *memNode) resize(size int64) {
+	if size <= int64(cap(node.data)) {
+		old := len(node.data)
+		node.data = node.data[:size]
+		// zero bytes exposed again after shrinking
+		for i := old; i < len(node.data); i++ {
+			node.data[i] = 0
+		}
+		return
+	}
+	data := make([]byte, size, size+size/2)
+	copy(data, node.data)
+	node.data = data
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return fi.dir }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
+
+func (fi *memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
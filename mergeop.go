@@ -0,0 +1,91 @@
+package beecask
+
+import (
+	"encoding/binary"
+)
+
+// MergeOperator folds operands written by Append into a full value.
+// Merge is called on read and when merge compacts operand records.
+type MergeOperator interface {
+	// Merge folds operands in write order into existing value,
+	// existing is nil if key does not exist
+	Merge(key []byte, existing []byte, operands [][]byte) ([]byte, error)
+}
+
+// Int64AddOperator treats values as int64 in the encoding of Incr,
+// and adds operands to the existing value
+type Int64AddOperator struct{}
+
+func (Int64AddOperator) Merge(key []byte, existing []byte, operands [][]byte) ([]byte, error) {
+	sum, err := decodeInt64(existing)
+	if err != nil {
+		return nil, err
+	}
+	for _, operand := range operands {
+		delta, err := decodeInt64(operand)
+		if err != nil {
+			return nil, err
+		}
+		sum += delta
+	}
+	return encodeInt64(sum), nil
+}
+
+// encodeInt64 encodes n for Incr and Decr
+func encodeInt64(n int64) []byte {
+	buff := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buff, uint64(n))
+	return buff
+}
+
+// decodeInt64 decodes value written by Incr and Decr, nil value means zero
+func decodeInt64(value []byte) (int64, error) {
+	if value == nil {
+		return 0, nil
+	}
+	if len(value) != 8 {
+		return 0, ErrInvalid
+	}
+	return int64(binary.LittleEndian.Uint64(value)), nil
+}
+
+// fold returns the value of kdItem with its operands folded by merge operator.
+// fold requires bc.rwMutex held
+func (bc *Beecask) fold(key []byte, kdItem *KDItem) ([]byte, error) {
+	if bc.options.MergeOperator == nil {
+		bc.logger.Errorf("Key[%s] has operands but merge operator is not set", string(key))
+		return nil, ErrInvalid
+	}
+
+	r, err := bc.readRecord(kdItem.fileId, kdItem.valuePos)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := bc.readValue(r)
+	if err != nil {
+		return nil, err
+	}
+
+	operands := make([][]byte, 0, len(kdItem.operands))
+	for _, ref := range kdItem.operands {
+		r, err := bc.readRecord(ref.fileId, ref.valuePos)
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, r.value)
+	}
+	return bc.options.MergeOperator.Merge(key, existing, operands)
+}
+
+// valueOf returns the value of kdItem, operands are folded if any.
+// valueOf requires bc.rwMutex held
+func (bc *Beecask) valueOf(key []byte, kdItem *KDItem) ([]byte, error) {
+	if kdItem.hasOperands() {
+		return bc.fold(key, kdItem)
+	}
+	r, err := bc.readRecord(kdItem.fileId, kdItem.valuePos)
+	if err != nil {
+		return nil, err
+	}
+	return bc.readValue(r)
+}
@@ -0,0 +1,108 @@
+package beecask
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// concatOperator appends operands to existing value in write order
+type concatOperator struct{}
+
+func (concatOperator) Merge(key []byte, existing []byte, operands [][]byte) ([]byte, error) {
+	value := append([]byte(nil), existing...)
+	for _, operand := range operands {
+		value = append(value, operand...)
+	}
+	return value, nil
+}
+
+func TestIncr(t *testing.T) {
+	opts := testOptions(NewMemFS())
+	opts.MergeOperator = Int64AddOperator{}
+	opts.MaxFileSize = 4096
+	bc := openTest(t, opts)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := bc.Incr("c", 1); err != nil {
+					t.Error(err)
+				}
+				if err := bc.Append("a", encodeInt64(2)); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	check := func(tag string) {
+		t.Helper()
+		for key, expect := range map[string]int64{"a": 1600, "c": 800} {
+			v, err := bc.Get(key)
+			if err != nil {
+				t.Fatalf("%s: get %s failed, err=%v", tag, key, err)
+			}
+			if n, _ := decodeInt64(v); n != expect {
+				t.Fatalf("%s: %s expects %d, got %d", tag, key, expect, n)
+			}
+		}
+		if n, err := bc.Decr("a", 600); err != nil || n != 1000 {
+			t.Fatalf("%s: decr expects 1000, got %d, err=%v", tag, n, err)
+		}
+		bc.Incr("a", 600)
+		bc.Append("a", encodeInt64(0))
+	}
+	check("live")
+	bc.Close()
+	bc = openTest(t, opts)
+	check("reopen")
+	rotateTest(t, bc)
+	mergeTest(t, bc)
+	check("merged")
+	bc.Close()
+	bc = openTest(t, opts)
+	defer bc.Close()
+	check("reopen after merge")
+
+	bc.Set("s", []byte("abc"))
+	if _, err := bc.Incr("s", 1); err != ErrInvalid {
+		t.Fatalf("incr of non counter expects ErrInvalid, err=%v", err)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	bc := openTest(t, testOptions(NewMemFS()))
+	if err := bc.Append("k", []byte("a")); err != ErrInvalid {
+		t.Fatalf("append without merge operator expects ErrInvalid, err=%v", err)
+	}
+	bc.Close()
+
+	opts := testOptions(NewMemFS())
+	opts.MergeOperator = concatOperator{}
+	bc = openTest(t, opts)
+	defer bc.Close()
+
+	bc.SetWithTTL("k", []byte("a"), time.Hour)
+	for _, operand := range []string{"b", "c", "d"} {
+		if err := bc.Append("k", []byte(operand)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectValue(t, bc, "k", "abcd")
+	if ttl, err := bc.TTL("k"); err != nil || ttl <= 0 {
+		t.Fatalf("operands expect ttl kept, got %s, err=%v", ttl, err)
+	}
+	rotateTest(t, bc)
+	mergeTest(t, bc)
+	expectValue(t, bc, "k", "abcd")
+
+	// operands of a deleted key are dropped
+	bc.Delete("k")
+	bc.Append("k", []byte("e"))
+	expectValue(t, bc, "k", "e")
+}
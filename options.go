@@ -1,15 +1,77 @@
 package beecask
 
+import (
+	"time"
+)
+
+// Index mode
+const (
+	INDEX_MODE_MEMORY = iota // keys are kept in memory
+	INDEX_MODE_HASH          // hash table in a mmaped file, for key sets larger than memory
+)
+
+// File access
+const (
+	FILE_ACCESS_MMAP  = iota // map files, falls back to pread if mmap fails
+	FILE_ACCESS_PREAD        // read files by pread, for many or large files
+)
+
+// Placement of new data files on DataDirs
+const (
+	PLACEMENT_ROUND_ROBIN = iota // weighted round robin, dirs emptied by merge are refilled first
+	PLACEMENT_FREE_SPACE         // the dir with most free space times weight
+)
+
+// DataDir is a directory holding data files and their hint files, a
+// dir with weight 2 gets twice as many files as one with weight 1
+type DataDir struct {
+	Path   string
+	Weight int // zero is taken as 1
+}
+
 type options struct {
-	WriteBufferSize int   // active-file write buffer size
-	MaxFileSize     int64 // max file size
-	MaxOpenFiles    int   // max open files
+	WriteBufferSize     int           // active-file write buffer size
+	MaxFileSize         int64         // max file size
+	MaxOpenFiles        int           // max open files
+	ValueCacheSize      int64         // bytes of value cache for hot reads, zero disables it
+	ExpireSweepInterval time.Duration // interval of expiration sweeper, zero (the default) disables it
+	ExpireSweepLimit    int           // max keys dropped by sweeper per interval, zero means no limit
+	CheckpointInterval  time.Duration // interval of key dir checkpoint, zero writes it on Close only
+	ValueThreshold      int           // values larger than it are stored in value log, zero disables it
+	MergeOperator       MergeOperator // folds operands written by Append, nil disables Append
+	Logger              Logger        // nil logs through ylog
+	FS                  FS            // nil uses the file system of the operating system
+	IndexMode           int           // INDEX_MODE_MEMORY or INDEX_MODE_HASH
+	FileAccess          int           // FILE_ACCESS_MMAP or FILE_ACCESS_PREAD
+	ReadaheadSize       int           // bytes read ahead by scans with pread, zero disables it
+	DataDirs            []DataDir     // dirs of data files, empty keeps them in the database dir
+	Placement           int           // PLACEMENT_ROUND_ROBIN or PLACEMENT_FREE_SPACE
+	BlobStore           BlobStore     // store of offloaded data files, nil disables tiering
+	OffloadAfter        int           // data files sealed more than it rotations ago are offloaded, zero disables it
+	BlobCacheLocal      bool          // offloaded files are downloaded while open instead of read by ranges
+
+	// OnExpire is called when an expired record is dropped by sweeper or merge.
+	// OnEvict is called when merge discards a delete record.
+	// Hooks are called outside of the database lock, value is only valid during
+	// the call. Delivery is at-least-once: a record is reported again after
+	// restart until merge has removed the data file holding it.
+	// bucket is the name of bucket holding key and empty out of buckets, key
+	// is relative to it. Metadata of buckets is never reported.
+	OnExpire func(bucket string, key string, value []byte)
+	OnEvict  func(bucket string, key string)
+}
+
+// ReadOptions controls a single read
+type ReadOptions struct {
+	NoCache bool // neither look up nor fill value cache, for reads of cold keys like scans
 }
 
 func NewOptions() *options {
 	return &options{
-		WriteBufferSize: 4 << 20,  // 4M
-		MaxFileSize:     32 << 20, // 32M
-		MaxOpenFiles:    1000,
+		WriteBufferSize:  4 << 20,  // 4M
+		MaxFileSize:      32 << 20, // 32M
+		MaxOpenFiles:     1000,
+		ExpireSweepLimit: 10000,
+		ReadaheadSize:    256 << 10, // 256K
 	}
 }
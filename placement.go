@@ -0,0 +1,304 @@
+package beecask
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var errPlacementInvalid = fmt.Errorf("Placement file is invalid")
+
+// placement maps data files to the dirs holding them, a hint file lives
+// beside its data file. The map is saved in the database dir once data
+// files are spread out of it, so that files on a dir dropped from DataDirs
+// are still found. Merge moves their records to the active file, which is
+// always placed on a configured dir, so that such a dir drains and dirs
+// emptied by merge are refilled.
+//
+// File format: a line of "fileId\tdir" per data file.
+type placement struct {
+	fs      FS
+	dirPath string    // database dir, files not in map are there
+	path    string    // path of placement file
+	dirs    []DataDir // dirs new files are placed on
+	policy  int
+	logger  Logger
+	saved   bool // map is kept in placement file
+
+	mu       sync.RWMutex
+	files    map[uint64]string // dir by file id
+	recorded map[uint64]string // map saved last time, used by scan
+	last     int               // dir placed last, round robin starts after it
+	noFree   bool              // free space is unknown, logged once
+}
+
+func newPlacement(fs FS, dirPath string, dirs []DataDir, policy int, logger Logger) *placement {
+	p := &placement{
+		fs:      fs,
+		dirPath: path.Clean(dirPath),
+		path:    getPlacementFilePath(dirPath),
+		policy:  policy,
+		logger:  logger,
+		files:   make(map[uint64]string),
+		last:    -1,
+	}
+	for _, d := range dirs {
+		d.Path = path.Clean(d.Path)
+		if d.Weight <= 0 {
+			d.Weight = 1
+		}
+		p.dirs = append(p.dirs, d)
+		if d.Path != p.dirPath {
+			p.saved = true
+		}
+	}
+	if len(p.dirs) == 0 {
+		p.dirs = []DataDir{{Path: p.dirPath, Weight: 1}}
+	}
+	return p
+}
+
+// load creates configured dirs and reads the saved map, it returns dirs to
+// be scanned for data files: the database dir, configured dirs and dirs
+// found in the map
+func (p *placement) load() ([]string, error) {
+	dirs := []string{p.dirPath}
+	seen := map[string]bool{p.dirPath: true}
+	add := func(dir string) {
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, d := range p.dirs {
+		if err := p.fs.MkdirAll(d.Path, 0755); err != nil {
+			return nil, err
+		}
+		add(d.Path)
+	}
+
+	recorded, err := p.read()
+	if os.IsNotExist(err) {
+		return dirs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.saved = true
+	p.recorded = recorded
+	for _, dir := range recorded {
+		add(dir)
+	}
+	return dirs, nil
+}
+
+func (p *placement) read() (map[uint64]string, error) {
+	f, err := p.fs.Open(p.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	size, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if _, err = f.ReadAt(buf, 0); err != nil {
+		return nil, err
+	}
+
+	recorded := make(map[uint64]string)
+	for _, line := range strings.Split(string(buf), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) != 2 || fields[1] == "" {
+			return nil, errPlacementInvalid
+		}
+		fileId, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return nil, errPlacementInvalid
+		}
+		recorded[fileId] = fields[1]
+	}
+	return recorded, nil
+}
+
+// found records data file fileId found in dir by scan, the saved map
+// decides if it is found in two dirs
+func (p *placement) found(fileId uint64, dir string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if other, ok := p.files[fileId]; ok && other != dir {
+		switch p.recorded[fileId] {
+		case other:
+			return nil
+		case dir:
+		default:
+			return fmt.Errorf("Data file %d found in both %s and %s", fileId, other, dir)
+		}
+	}
+	p.files[fileId] = dir
+	return nil
+}
+
+// commit saves the map built by scan, entries of removed files are dropped
+func (p *placement) commit() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.recorded = nil
+	if !p.saved {
+		return nil
+	}
+	return p.save()
+}
+
+// dir returns the dir of data file fileId
+func (p *placement) dir(fileId uint64) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if dir, ok := p.files[fileId]; ok {
+		return dir
+	}
+	return p.dirPath
+}
+
+// configured reports whether data file fileId is on a configured dir
+func (p *placement) configured(fileId uint64) bool {
+	dir := p.dir(fileId)
+	for _, d := range p.dirs {
+		if d.Path == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// place picks a configured dir for new data file fileId and saves the map
+// before the file is created, it does nothing if fileId is placed already
+func (p *placement) place(fileId uint64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.files[fileId]; ok {
+		return nil
+	}
+	i := p.choose()
+	p.files[fileId] = p.dirs[i].Path
+	if p.saved {
+		if err := p.save(); err != nil {
+			delete(p.files, fileId)
+			return err
+		}
+	}
+	p.last = i
+	return nil
+}
+
+// remove forgets data file fileId, the map is saved by the next place
+func (p *placement) remove(fileId uint64) {
+	p.mu.Lock()
+	delete(p.files, fileId)
+	p.mu.Unlock()
+}
+
+// choose requires p.mu held
+func (p *placement) choose() int {
+	if len(p.dirs) == 1 {
+		return 0
+	}
+	if p.policy == PLACEMENT_FREE_SPACE {
+		i, err := p.mostFree()
+		if err == nil {
+			return i
+		}
+		if !p.noFree {
+			p.noFree = true
+			p.logger.Errorf("Free space of data dirs unknown, place by round robin, err=%s", err)
+		}
+	}
+	return p.leastFilled()
+}
+
+// mostFree returns the dir with most free space times weight.
+// mostFree requires p.mu held
+func (p *placement) mostFree() (int, error) {
+	best, bestScore := -1, int64(0)
+	for i, d := range p.dirs {
+		free, err := p.fs.FreeSpace(d.Path)
+		if err != nil {
+			return 0, err
+		}
+		if score := free * int64(d.Weight); best < 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best, nil
+}
+
+// leastFilled returns the dir with fewest files relative to its weight
+// once a file is added, ties go round robin after the dir placed last.
+// leastFilled requires p.mu held
+func (p *placement) leastFilled() int {
+	counts := make([]int, len(p.dirs))
+	for _, dir := range p.files {
+		for i, d := range p.dirs {
+			if d.Path == dir {
+				counts[i]++
+				break
+			}
+		}
+	}
+	best := -1
+	for k := 1; k <= len(p.dirs); k++ {
+		i := (p.last + k) % len(p.dirs)
+		// (counts[i]+1)/weight[i] < (counts[best]+1)/weight[best]
+		if best < 0 || (counts[i]+1)*p.dirs[best].Weight < (counts[best]+1)*p.dirs[i].Weight {
+			best = i
+		}
+	}
+	return best
+}
+
+// save writes the map to a temporary file and renames it after synced.
+// save requires p.mu held
+func (p *placement) save() error {
+	fileIds := make([]uint64, 0, len(p.files))
+	for fileId := range p.files {
+		fileIds = append(fileIds, fileId)
+	}
+	sort.Slice(fileIds, func(i, j int) bool { return fileIds[i] < fileIds[j] })
+	var buf bytes.Buffer
+	for _, fileId := range fileIds {
+		fmt.Fprintf(&buf, "%d\t%s\n", fileId, p.files[fileId])
+	}
+
+	tmpPath := p.path + TEMP_FILE_SUFFIX
+	f, err := p.fs.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(buf.Bytes(), 0)
+	if err == nil {
+		err = f.Truncate(int64(buf.Len()))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = p.fs.Rename(tmpPath, p.path)
+	}
+	if err != nil {
+		p.logger.Errorf("Save placement failed, err=%s", err)
+		p.fs.Remove(tmpPath)
+	}
+	return err
+}
@@ -0,0 +1,117 @@
+package beecask
+
+import (
+	"path"
+	"testing"
+)
+
+func TestDataDirs(t *testing.T) {
+	value := func(i int) []byte { return testValue(i, 100) }
+	for _, fs := range []FS{NewMemFS(), OSFS{}} {
+		root := "/"
+		if _, ok := fs.(OSFS); ok {
+			root = t.TempDir()
+		}
+		db, d1, d2, d3 := path.Join(root, "db"), path.Join(root, "d1"), path.Join(root, "d2"), path.Join(root, "d3")
+		for _, policy := range []int{PLACEMENT_ROUND_ROBIN, PLACEMENT_FREE_SPACE} {
+			for _, dir := range []string{db, d1, d2, d3} {
+				names, _ := fs.ReadDir(dir)
+				for _, name := range names {
+					fs.Remove(path.Join(dir, name))
+				}
+			}
+			opts := testOptions(fs)
+			opts.MaxFileSize = 4 << 10
+			opts.Placement = policy
+			opts.DataDirs = []DataDir{{Path: d1, Weight: 2}, {Path: d2}, {Path: d3}}
+			bc, err := NewBeecask(*opts, db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fillKeys(t, bc, 400, func(int) []byte { return []byte("old") })
+			fillKeys(t, bc, 400, value)
+			bc.Close()
+
+			n1, n2, n3 := countFiles(t, fs, d1, ".data"), countFiles(t, fs, d2, ".data"), countFiles(t, fs, d3, ".data")
+			if n := countFiles(t, fs, db, ".data"); n != 0 {
+				t.Fatalf("policy %d: database dir expects no data files, got %d", policy, n)
+			}
+			if n1+n2+n3 == 0 {
+				t.Fatalf("policy %d: data dirs expect data files", policy)
+			}
+			if policy == PLACEMENT_ROUND_ROBIN && (n1 < n2+n3-2 || n1 > n2+n3+2 || n2 == 0 || n3 == 0) {
+				t.Fatalf("round robin expects files spread by weight, got %d %d %d", n1, n2, n3)
+			}
+			if _, err = fs.Stat(getPlacementFilePath(db)); err != nil {
+				t.Fatalf("policy %d: placement file expected, err=%v", policy, err)
+			}
+
+			bc = openDirTest(t, opts, db)
+			checkKeys(t, bc, 400, value, "reopen")
+			bc.Close()
+
+			// files of a dropped dir are still read and drained by merge
+			opts.DataDirs = []DataDir{{Path: d2}, {Path: d3}}
+			bc = openDirTest(t, opts, db)
+			checkKeys(t, bc, 400, value, "dir dropped")
+			rotateTest(t, bc)
+			mergeTest(t, bc)
+			checkKeys(t, bc, 400, value, "dir drained")
+			bc.Close()
+			if n := countFiles(t, fs, d1, ".data"); n != 0 {
+				t.Fatalf("policy %d: dropped dir expects drained, %d files left", policy, n)
+			}
+
+			opts.DataDirs = nil
+			bc = openDirTest(t, opts, db)
+			rotateTest(t, bc)
+			mergeTest(t, bc)
+			bc.Close()
+			bc = openDirTest(t, opts, db)
+			checkKeys(t, bc, 400, value, "no data dirs")
+			bc.Close()
+			if n := countFiles(t, fs, d2, ".data") + countFiles(t, fs, d3, ".data"); n != 0 {
+				t.Fatalf("policy %d: data dirs expect drained into database dir, %d files left", policy, n)
+			}
+		}
+	}
+}
+
+// a data file found in two dirs is taken from the dir saved in placement
+// file, it is ambiguous without placement file
+func TestDataDirsDuplicateFile(t *testing.T) {
+	fs := NewMemFS()
+	opts := testOptions(fs)
+	opts.DataDirs = []DataDir{{Path: "/a"}, {Path: "/b"}}
+	bc := openTest(t, opts)
+	bc.Set("k", []byte("v"))
+	src := bc.dataFilePath(1)
+	bc.Close()
+
+	dst := getDataFilePath("/a", 1)
+	if path.Dir(src) == "/a" {
+		dst = getDataFilePath("/b", 1)
+	}
+	f, err := fs.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, _ := f.Size()
+	data := make([]byte, size)
+	f.ReadAt(data, 0)
+	f.Close()
+	if f, err = fs.Create(dst); err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt(data, 0)
+	f.Close()
+
+	bc = openTest(t, opts)
+	expectValue(t, bc, "k", "v")
+	bc.Close()
+
+	fs.Remove(getPlacementFilePath(TEST_DIR))
+	if _, err = NewBeecask(*opts, TEST_DIR); err == nil {
+		t.Fatalf("duplicate data file without placement file expects error")
+	}
+}
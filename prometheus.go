@@ -0,0 +1,84 @@
+package beecask
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// WritePrometheus writes statistics to w in Prometheus text format
+func (bc *Beecask) WritePrometheus(w io.Writer) error {
+	stats := bc.Stats()
+	bw := bufio.NewWriter(w)
+
+	gauge := func(name, help string, value interface{}) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", name, help, name, name, value)
+	}
+	counter := func(name, help string, value uint64) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+
+	gauge("beecask_keys", "Number of keys out of buckets, expired keys included.", stats.Keys)
+	gauge("beecask_tombstones", "Number of delete records in key dir.", stats.Tombstones)
+	gauge("beecask_expired_keys", "Number of expired keys not dropped yet.", stats.Expired)
+	gauge("beecask_active_file_id", "Id of active data file.", stats.ActiveFileId)
+	gauge("beecask_active_file_bytes", "Size of active data file.", stats.ActiveFileSize)
+	gauge("beecask_data_files", "Number of data files.", len(stats.DataFiles))
+
+	fmt.Fprintf(bw, "# HELP beecask_data_file_bytes Size of data files by liveness.\n# TYPE beecask_data_file_bytes gauge\n")
+	for _, df := range stats.DataFiles {
+		fmt.Fprintf(bw, "beecask_data_file_bytes{file=\"%d\",state=\"live\"} %d\n", df.FileId, df.LiveBytes)
+		fmt.Fprintf(bw, "beecask_data_file_bytes{file=\"%d\",state=\"dead\"} %d\n", df.FileId, df.DeadBytes)
+	}
+
+	counter("beecask_cache_hits_total", "Data file cache hits.", stats.Cache.Hits)
+	counter("beecask_cache_misses_total", "Data file cache misses.", stats.Cache.Misses)
+	counter("beecask_cache_evictions_total", "Data file cache evictions.", stats.Cache.Evictions)
+	gauge("beecask_cache_open_files", "Number of data files in cache.", stats.Cache.Open)
+	counter("beecask_value_cache_hits_total", "Value cache hits.", stats.ValueCache.Hits)
+	counter("beecask_value_cache_misses_total", "Value cache misses.", stats.ValueCache.Misses)
+	counter("beecask_value_cache_evictions_total", "Value cache evictions.", stats.ValueCache.Evictions)
+	gauge("beecask_value_cache_entries", "Number of values in value cache.", stats.ValueCache.Entries)
+	gauge("beecask_value_cache_bytes", "Size of value cache.", stats.ValueCache.Bytes)
+
+	merging := 0
+	if stats.Merging {
+		merging = 1
+	}
+	gauge("beecask_merging", "Whether a merge is running.", merging)
+	if n := len(stats.Merges); n > 0 {
+		last := stats.Merges[n-1]
+		gauge("beecask_last_merge_timestamp_seconds", "Start time of last merge.", last.Start.Unix())
+		gauge("beecask_last_merge_duration_seconds", "Duration of last merge.", last.Duration.Seconds())
+		gauge("beecask_last_merge_files", "Number of data files merged by last merge.", last.Files)
+	}
+
+	fmt.Fprintf(bw, "# HELP beecask_op_errors_total Failed operations.\n# TYPE beecask_op_errors_total counter\n")
+	for _, op := range opNames {
+		fmt.Fprintf(bw, "beecask_op_errors_total{op=%q} %d\n", op, stats.Ops[op].Errors)
+	}
+
+	fmt.Fprintf(bw, "# HELP beecask_op_duration_seconds Latency of operations.\n# TYPE beecask_op_duration_seconds histogram\n")
+	for _, op := range opNames {
+		ops := stats.Ops[op]
+		var cumulative uint64
+		for i, bound := range LatencyBuckets {
+			cumulative += ops.Buckets[i]
+			fmt.Fprintf(bw, "beecask_op_duration_seconds_bucket{op=%q,le=\"%g\"} %d\n", op, bound.Seconds(), cumulative)
+		}
+		fmt.Fprintf(bw, "beecask_op_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", op, ops.Count)
+		fmt.Fprintf(bw, "beecask_op_duration_seconds_sum{op=%q} %g\n", op, ops.Total.Seconds())
+		fmt.Fprintf(bw, "beecask_op_duration_seconds_count{op=%q} %d\n", op, ops.Count)
+	}
+	return bw.Flush()
+}
+
+// PrometheusHandler returns a http handler serving statistics in
+// Prometheus text format
+func (bc *Beecask) PrometheusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		bc.WritePrometheus(w)
+	})
+}
@@ -0,0 +1,286 @@
+package beecask
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// rangeTombstone deletes keys in [start, end) written before it, empty end
+// means no upper bound. A tombstone with bucket flag only deletes keys of
+// buckets, otherwise only keys out of buckets.
+type rangeTombstone struct {
+	fileId   uint64
+	valuePos uint32
+	flag     uint32
+	seq      uint64
+	start    []byte
+	end      []byte
+}
+
+// covers reports whether the item of key is deleted by t
+func (t *rangeTombstone) covers(key string, item *KDItem) bool {
+	if item.seq >= t.seq || (item.flag&RECORD_FLAG_BIT_BUCKET) != (t.flag&RECORD_FLAG_BIT_BUCKET) {
+		return false
+	}
+	return key >= string(t.start) && (len(t.end) == 0 || key < string(t.end))
+}
+
+// DeletePrefix deletes all keys out of buckets beginning with prefix
+func (bc *Beecask) DeletePrefix(prefix string) error {
+	return bc.deleteRange([]byte(prefix), prefixEnd([]byte(prefix)), 0)
+}
+
+// DeleteRange deletes all keys out of buckets in [start, end),
+// empty end means no upper bound
+func (bc *Beecask) DeleteRange(start, end string) error {
+	return bc.deleteRange([]byte(start), []byte(end), 0)
+}
+
+// Truncate deletes all keys out of buckets
+func (bc *Beecask) Truncate() error {
+	return bc.deleteRange(nil, nil, 0)
+}
+
+// DeletePrefix deletes all keys of bucket beginning with prefix
+func (b *Bucket) DeletePrefix(prefix string) error {
+	return b.bc.deleteRange(b.key(prefix), prefixEnd(b.key(prefix)), RECORD_FLAG_BIT_BUCKET)
+}
+
+// DeleteRange deletes all keys of bucket in [start, end),
+// empty end means no upper bound
+func (b *Bucket) DeleteRange(start, end string) error {
+	if end == "" {
+		return b.bc.deleteRange(b.key(start), prefixEnd(b.prefix), RECORD_FLAG_BIT_BUCKET)
+	}
+	return b.bc.deleteRange(b.key(start), b.key(end), RECORD_FLAG_BIT_BUCKET)
+}
+
+// Truncate deletes all keys of bucket
+func (b *Bucket) Truncate() error {
+	return b.bc.deleteRange(b.prefix, prefixEnd(b.prefix), RECORD_FLAG_BIT_BUCKET)
+}
+
+func (bc *Beecask) deleteRange(start, end []byte, flag uint32) (err error) {
+	defer bc.metrics.observe(OP_DELETE, time.Now(), &err)
+	if len(end) > 0 && bytes.Compare(start, end) >= 0 {
+		return ErrInvalid
+	}
+
+	bc.rwMutex.Lock()
+	defer bc.rwMutex.Unlock()
+	return bc.setRecord(newRangeRecord(start, end, flag))
+}
+
+func newRangeRecord(start, end []byte, flag uint32) *Record {
+	r := newRecord(start, end, false, 0)
+	r.flag |= flag | RECORD_FLAG_BIT_RANGE_DELETE
+	return r
+}
+
+// prefixEnd returns the smallest key greater than all keys beginning
+// with prefix, nil if there is no such key
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// rangedIndex hides items covered by range tombstones which are not applied
+// yet, so that a range delete does not walk the whole key dir. Merge deletes
+// covered items it meets and drops a tombstone with the data file holding it,
+// all records the tombstone covers are in data files before it then.
+type rangedIndex struct {
+	index
+	ranges []*rangeTombstone // tombstones not applied yet
+	maxSeq uint64            // max seq of ranges
+}
+
+func newRangedIndex(idx index) *rangedIndex {
+	return &rangedIndex{index: idx}
+}
+
+func (ri *rangedIndex) addRange(t *rangeTombstone) {
+	ri.ranges = append(ri.ranges, t)
+	if t.seq > ri.maxSeq {
+		ri.maxSeq = t.seq
+	}
+}
+
+// dropRange forgets the tombstone at valuePos of data file fileId
+func (ri *rangedIndex) dropRange(fileId uint64, valuePos uint32) {
+	n := 0
+	ri.maxSeq = 0
+	for _, t := range ri.ranges {
+		if t.fileId == fileId && t.valuePos == valuePos {
+			continue
+		}
+		ri.ranges[n] = t
+		n++
+		if t.seq > ri.maxSeq {
+			ri.maxSeq = t.seq
+		}
+	}
+	ri.ranges = ri.ranges[:n]
+}
+
+func (ri *rangedIndex) covered(key string, item *KDItem) bool {
+	if item.seq >= ri.maxSeq {
+		return false
+	}
+	for _, t := range ri.ranges {
+		if t.covers(key, item) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ri *rangedIndex) Get(key string) *KDItem {
+	item := ri.index.Get(key)
+	if item != nil && ri.covered(key, item) {
+		return nil
+	}
+	return item
+}
+
+func (ri *rangedIndex) Lookup(key []byte) (KDItem, bool) {
+	item, ok := ri.index.Lookup(key)
+	if ok && ri.covered(string(key), &item) {
+		return KDItem{}, false
+	}
+	return item, ok
+}
+
+func (ri *rangedIndex) Keys(now int64) []string {
+	if len(ri.ranges) == 0 {
+		return ri.index.Keys(now)
+	}
+	var keys []string
+	ri.ForEach(func(item *KDItem) bool {
+		return item.flag&(RECORD_FLAG_BIT_DELETE|RECORD_FLAG_BIT_BUCKET) == 0 && !item.isExpired(now)
+	}, func(key string, item *KDItem) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+func (ri *rangedIndex) PrefixKeys(prefix string, now int64) []string {
+	if len(ri.ranges) == 0 {
+		return ri.index.PrefixKeys(prefix, now)
+	}
+	var keys []string
+	ri.ForEach(func(item *KDItem) bool {
+		return item.flag&(RECORD_FLAG_BIT_DELETE|RECORD_FLAG_BIT_RANGE_DELETE) == 0 &&
+			item.flag&RECORD_FLAG_BIT_BUCKET != 0 && !item.isExpired(now)
+	}, func(key string, item *KDItem) bool {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key[len(prefix):])
+		}
+		return true
+	})
+	return keys
+}
+
+// Len walks key dir if any tombstone is not applied
+func (ri *rangedIndex) Len() int {
+	return ri.index.Len() - ri.countCovered(func(item *KDItem) bool {
+		return item.flag&(RECORD_FLAG_BIT_DELETE|RECORD_FLAG_BIT_BUCKET) == 0
+	})
+}
+
+// Tombstones walks key dir if any tombstone is not applied
+func (ri *rangedIndex) Tombstones() int {
+	return ri.index.Tombstones() - ri.countCovered(func(item *KDItem) bool {
+		return item.flag&RECORD_FLAG_BIT_DELETE != 0
+	})
+}
+
+func (ri *rangedIndex) countCovered(filter func(item *KDItem) bool) int {
+	if len(ri.ranges) == 0 {
+		return 0
+	}
+	n := 0
+	ri.index.ForEach(func(item *KDItem) bool {
+		return item.seq < ri.maxSeq && filter(item)
+	}, func(key string, item *KDItem) bool {
+		if ri.covered(key, item) {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+func (ri *rangedIndex) ForEach(filter func(item *KDItem) bool, fn func(key string, item *KDItem) bool) {
+	if len(ri.ranges) == 0 {
+		ri.index.ForEach(filter, fn)
+		return
+	}
+	ri.index.ForEach(filter, func(key string, item *KDItem) bool {
+		return ri.covered(key, item) || fn(key, item)
+	})
+}
+
+// visible reports whether key is in key dir and not covered
+func (ri *rangedIndex) visible(key string) bool {
+	return len(ri.ranges) == 0 || ri.Get(key) != nil
+}
+
+// rangeKeyDir hides keys covered by t, t is kept in active key dir
+// to be written to hint file.
+// rangeKeyDir requires bc.rwMutex held
+func (bc *Beecask) rangeKeyDir(t *rangeTombstone) {
+	bc.activeRanges = append(bc.activeRanges, t)
+	bc.keydir.addRange(t)
+}
+
+// applyRanges deletes items covered by tombstones not applied yet from key
+// dir, so that key dir can be saved without the tombstones. It walks the
+// whole key dir.
+// applyRanges requires bc.rwMutex held
+func (bc *Beecask) applyRanges() {
+	ri := bc.keydir
+	if len(ri.ranges) == 0 {
+		return
+	}
+	ri.index.ForEach(func(item *KDItem) bool {
+		return item.seq < ri.maxSeq
+	}, func(key string, item *KDItem) bool {
+		if ri.covered(key, item) {
+			ri.index.Delete(key)
+			bc.expireIndex.Delete(key)
+		}
+		return true
+	})
+	ri.ranges = nil
+	ri.maxSeq = 0
+}
+
+// restoreRange records a range tombstone found by restore, tombstones are
+// added after all data files are restored since hint files do not keep
+// order of records
+func (bc *Beecask) restoreRange(t *rangeTombstone) {
+	bc.restoredRanges = append(bc.restoredRanges, t)
+}
+
+// restoreRanges adds range tombstones found by restore to key dir
+func (bc *Beecask) restoreRanges() {
+	for _, t := range bc.restoredRanges {
+		// ids of dropped buckets must not be reused until tombstones are merged
+		if (t.flag&RECORD_FLAG_BIT_BUCKET) > 0 && len(t.start) > 1 {
+			if id, n := binary.Uvarint(t.start[1:]); n > 0 && id > bc.maxBucketId {
+				bc.maxBucketId = id
+			}
+		}
+		bc.keydir.addRange(t)
+	}
+	bc.restoredRanges = nil
+}
@@ -0,0 +1,115 @@
+package beecask
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDeleteRange(t *testing.T) {
+	for _, mode := range []int{INDEX_MODE_MEMORY, INDEX_MODE_HASH} {
+		fs := NewFaultFS(NewMemFS())
+		opts := testOptions(fs)
+		opts.MaxFileSize = 1024
+		opts.IndexMode = mode
+		bc := openTest(t, opts)
+
+		b, _ := bc.Bucket("b")
+		for i := 0; i < 30; i++ {
+			bc.Set(fmt.Sprintf("t1/%02d", i), []byte("x"))
+			bc.Set(fmt.Sprintf("t2/%02d", i), []byte("x"))
+			b.Set(fmt.Sprintf("t1/%02d", i), []byte("x"))
+		}
+		if err := bc.DeletePrefix("t1/"); err != nil {
+			t.Fatal(err)
+		}
+		bc.Set("t1/new", []byte("y"))
+		if err := bc.DeleteRange("t2/10", "t2/20"); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.DeleteRange("t1/00", "t1/05"); err != nil {
+			t.Fatal(err)
+		}
+		if err := bc.DeleteRange("b", "a"); err != ErrInvalid {
+			t.Fatalf("empty range expects ErrInvalid, err=%v", err)
+		}
+
+		check := func(tag string) {
+			t.Helper()
+			if n := bc.Count(); n != 21 || len(bc.Keys()) != 21 || bc.Stats().Keys != 21 {
+				t.Fatalf("mode %d %s: count expects 21, got %d, keys=%v", mode, tag, n, bc.Keys())
+			}
+			expectValue(t, bc, "t1/new", "y")
+			expectNotExist(t, bc, "t1/00")
+			expectNotExist(t, bc, "t2/15")
+			expectValue(t, bc, "t2/20", "x")
+			b, _ := bc.Bucket("b")
+			if n := len(b.Keys()); n != 25 {
+				t.Fatalf("mode %d %s: keys of bucket expects 25, got %d", mode, tag, n)
+			}
+		}
+		check("live")
+		bc.Close()
+
+		bc = openTest(t, opts)
+		check("reopen")
+		if err := bc.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		bc = crashTest(t, bc, fs, opts)
+		check("crash")
+		rotateTest(t, bc)
+		mergeTest(t, bc)
+		check("merged")
+		if n := len(bc.keydir.ranges); n != 0 {
+			t.Fatalf("mode %d: %d range tombstones are kept after merge", mode, n)
+		}
+		bc.Close()
+
+		bc = openTest(t, opts)
+		check("reopen after merge")
+		if err := bc.Truncate(); err != nil {
+			t.Fatal(err)
+		}
+		b, _ = bc.Bucket("b")
+		if bc.Count() != 0 || len(b.Keys()) != 25 {
+			t.Fatalf("mode %d: truncate deletes %d keys and keys of bucket", mode, bc.Count())
+		}
+		bc.Close()
+	}
+}
+
+// range delete only records the tombstone, covered items are hidden
+func TestDeleteRangeIsLazy(t *testing.T) {
+	var expired []string
+	opts := testOptions(NewMemFS())
+	opts.OnExpire = func(bucket string, key string, value []byte) {
+		expired = append(expired, key)
+	}
+	bc := openTest(t, opts)
+	defer bc.Close()
+
+	for i := 0; i < 10; i++ {
+		bc.SetWithTTL(fmt.Sprint("k", i), []byte("v"), time.Minute)
+	}
+	if err := bc.Truncate(); err != nil {
+		t.Fatal(err)
+	}
+	if n := bc.keydir.index.Len(); n != 10 {
+		t.Fatalf("truncate expects to keep items until merge, %d kept", n)
+	}
+	if n := bc.Count(); n != 0 {
+		t.Fatalf("count expects 0, got %d", n)
+	}
+	if _, err := bc.SetIfAbsent("k1", []byte("new")); err != nil {
+		t.Fatalf("covered key expects absent, err=%v", err)
+	}
+	expectValue(t, bc, "k1", "new")
+	bc.SetWithTTL("k2", []byte("new"), time.Minute)
+
+	// covered keys are not reported as expired
+	bc.expireKeys(time.Now().Add(time.Hour).Unix(), 100)
+	if len(expired) != 1 || expired[0] != "k2" {
+		t.Fatalf("expire hook expects only k2, got %v", expired)
+	}
+}
@@ -0,0 +1,208 @@
+package beecask
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Operations counted by Stats
+const (
+	OP_GET = iota
+	OP_SET
+	OP_DELETE
+	OP_APPEND
+	OP_INCR
+	OP_COMMIT
+	opCount
+)
+
+var opNames = [opCount]string{"get", "set", "delete", "append", "incr", "commit"}
+
+// LatencyBuckets are upper bounds of operation latency histograms
+var LatencyBuckets = []time.Duration{
+	time.Microsecond,
+	4 * time.Microsecond,
+	16 * time.Microsecond,
+	64 * time.Microsecond,
+	256 * time.Microsecond,
+	time.Millisecond,
+	4 * time.Millisecond,
+	16 * time.Millisecond,
+	64 * time.Millisecond,
+	256 * time.Millisecond,
+	time.Second,
+}
+
+const MAX_MERGE_HISTORY = 16
+
+type Stats struct {
+	Keys           int // keys out of buckets, expired keys are included
+	Tombstones     int // delete records still in key dir
+	Expired        int // expired keys not dropped yet
+	ActiveFileId   uint64
+	ActiveFileSize int64
+	DataFiles      []DataFileStats // sorted by file id, active file included
+	Cache          CacheStats
+	ValueCache     ValueCacheStats // zero if value cache is disabled
+	Merging        bool
+	Merges         []MergeStats // latest merges, oldest first
+	Ops            map[string]OpStats
+}
+
+// DataFileStats describes a data file, live bytes are those of records
+// referenced by key dir and the rest are dead bytes to be merged
+type DataFileStats struct {
+	FileId    uint64
+	Size      int64
+	LiveBytes int64
+	DeadBytes int64
+	Offloaded bool // kept in blob store
+}
+
+type MergeStats struct {
+	Start    time.Time
+	Duration time.Duration
+	Files    int    // number of data files merged
+	Err      string // empty if merge succeeded
+}
+
+// OpStats counts an operation, Buckets[i] is the number of operations with
+// latency no more than LatencyBuckets[i] and not in Buckets[i-1], the last
+// one counts the rest
+type OpStats struct {
+	Count   uint64
+	Errors  uint64
+	Total   time.Duration
+	Buckets []uint64
+}
+
+type opCounter struct {
+	count   uint64
+	errors  uint64
+	total   int64
+	buckets []uint64
+}
+
+type metrics struct {
+	ops [opCount]opCounter
+
+	mu     sync.Mutex
+	merges []MergeStats
+}
+
+func newMetrics() *metrics {
+	m := &metrics{}
+	for i := range m.ops {
+		m.ops[i].buckets = make([]uint64, len(LatencyBuckets)+1)
+	}
+	return m
+}
+
+// observe counts an operation begun at begin, it is used with defer:
+//
+//	defer bc.metrics.observe(OP_GET, time.Now(), &err)
+func (m *metrics) observe(op int, begin time.Time, errp *error) {
+	d := time.Since(begin)
+	c := &m.ops[op]
+	atomic.AddUint64(&c.count, 1)
+	atomic.AddInt64(&c.total, int64(d))
+	if errp != nil && *errp != nil && *errp != ErrDataNotExist {
+		atomic.AddUint64(&c.errors, 1)
+	}
+	i := sort.Search(len(LatencyBuckets), func(i int) bool { return d <= LatencyBuckets[i] })
+	atomic.AddUint64(&c.buckets[i], 1)
+}
+
+func writeOp(delete bool) int {
+	if delete {
+		return OP_DELETE
+	}
+	return OP_SET
+}
+
+func (m *metrics) addMerge(ms MergeStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.merges = append(m.merges, ms)
+	if len(m.merges) > MAX_MERGE_HISTORY {
+		m.merges = m.merges[len(m.merges)-MAX_MERGE_HISTORY:]
+	}
+}
+
+func (m *metrics) snapshot(stats *Stats) {
+	m.mu.Lock()
+	stats.Merges = append([]MergeStats(nil), m.merges...)
+	m.mu.Unlock()
+
+	stats.Ops = make(map[string]OpStats, opCount)
+	for i := range m.ops {
+		c := &m.ops[i]
+		ops := OpStats{
+			Count:   atomic.LoadUint64(&c.count),
+			Errors:  atomic.LoadUint64(&c.errors),
+			Total:   time.Duration(atomic.LoadInt64(&c.total)),
+			Buckets: make([]uint64, len(c.buckets)),
+		}
+		for j := range c.buckets {
+			ops.Buckets[j] = atomic.LoadUint64(&c.buckets[j])
+		}
+		stats.Ops[opNames[i]] = ops
+	}
+}
+
+// Stats returns a snapshot of statistics, live bytes of data files are
+// computed by walking key dir, so it should not be called too often
+func (bc *Beecask) Stats() *Stats {
+	stats := &Stats{}
+
+	bc.rwMutex.RLock()
+	now := time.Now().Unix()
+	stats.Keys = bc.keydir.Len()
+	stats.Tombstones = bc.keydir.Tombstones()
+	stats.Expired = bc.countExpired(now)
+	stats.ActiveFileId = bc.activeFile.FileId()
+	stats.ActiveFileSize = bc.activeFile.Size()
+	minDataFileId, maxDataFileId := bc.minDataFileId, bc.maxDataFileId
+
+	live := make(map[uint64]int64)
+	bc.keydir.ForEachItem(func(item *KDItem) {
+		// records are assumed to carry sequence numbers
+		live[item.fileId] += DATA_ITEM_HEADER_SIZE + RECORD_SEQ_SIZE + int64(item.keySize) + int64(item.valueSize)
+		for _, ref := range item.operands {
+			// size of operands is not kept, only count their headers
+			live[ref.fileId] += DATA_ITEM_HEADER_SIZE + RECORD_SEQ_SIZE + int64(item.keySize)
+		}
+	})
+	bc.rwMutex.RUnlock()
+
+	for fileId := minDataFileId; fileId <= maxDataFileId; fileId++ {
+		size, offloaded := stats.ActiveFileSize, false
+		if bc.tier != nil && fileId != stats.ActiveFileId {
+			size, offloaded = bc.tier.offloaded(fileId)
+		}
+		if fileId != stats.ActiveFileId && !offloaded {
+			fi, err := bc.fs.Stat(bc.dataFilePath(fileId))
+			if err != nil {
+				// removed by merge
+				continue
+			}
+			size = fi.Size()
+		}
+		dfs := DataFileStats{FileId: fileId, Size: size, LiveBytes: live[fileId], Offloaded: offloaded}
+		if dfs.LiveBytes > size {
+			dfs.LiveBytes = size
+		}
+		dfs.DeadBytes = size - dfs.LiveBytes
+		stats.DataFiles = append(stats.DataFiles, dfs)
+	}
+
+	stats.Cache = bc.dataFileCache.Stats()
+	if bc.valueCache != nil {
+		stats.ValueCache = bc.valueCache.Stats()
+	}
+	stats.Merging = atomic.LoadInt32(&bc.isMerging) == 1
+	bc.metrics.snapshot(stats)
+	return stats
+}
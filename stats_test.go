@@ -0,0 +1,107 @@
+package beecask
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	opts := testOptions(NewMemFS())
+	opts.MaxFileSize = 1024
+	opts.MergeOperator = Int64AddOperator{}
+	bc := openTest(t, opts)
+	defer bc.Close()
+
+	for i := 0; i < 100; i++ {
+		bc.Set("k", []byte("v"))
+		bc.Get("k")
+	}
+	bc.Get("none")
+	bc.Delete("x")
+	bc.SetWithExpiration("e", []byte("v"), time.Now().Unix()-1)
+	bc.Incr("n", 1)
+
+	stats := bc.Stats()
+	if stats.Keys != 3 || stats.Tombstones != 1 || stats.Expired != 1 {
+		t.Fatalf("stats expects 3 keys, 1 tombstone and 1 expired, got %+v", stats)
+	}
+	var dead int64
+	for _, df := range stats.DataFiles {
+		dead += df.DeadBytes
+	}
+	if dead == 0 {
+		t.Fatalf("stats expects dead bytes of overwritten records")
+	}
+
+	// merge drops tombstone and expired key
+	rotateTest(t, bc)
+	mergeTest(t, bc)
+	stats = bc.Stats()
+	if stats.Keys != 2 || stats.Tombstones != 0 || stats.Expired != 0 {
+		t.Fatalf("stats expects 2 keys after merge, got %+v", stats)
+	}
+	if set := stats.Ops["set"]; set.Count != 101 || set.Errors != 0 {
+		t.Fatalf("stats expects 101 sets, got %+v", set)
+	}
+	if incr := stats.Ops["incr"]; incr.Count != 1 || stats.Ops["append"].Count != 0 {
+		t.Fatalf("stats expects 1 incr and no append, got %+v", stats.Ops)
+	}
+	// absent key is not an error
+	if get := stats.Ops["get"]; get.Count != 101 || get.Errors != 0 {
+		t.Fatalf("stats expects 101 gets, got %+v", get)
+	}
+	if len(stats.Merges) != 1 || stats.Merges[0].Files == 0 {
+		t.Fatalf("stats expects 1 merge, got %+v", stats.Merges)
+	}
+
+	var buf bytes.Buffer
+	if err := bc.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, line := range []string{
+		"beecask_keys 2\n",
+		"beecask_tombstones 0\n",
+		`beecask_op_duration_seconds_count{op="set"} 101` + "\n",
+		`beecask_op_duration_seconds_bucket{op="get",le="+Inf"} 101` + "\n",
+		"beecask_last_merge_files ",
+	} {
+		if !strings.Contains(out, line) {
+			t.Fatalf("prometheus output expects %q, got\n%s", line, out)
+		}
+	}
+}
+
+func TestStatsDuringMerge(t *testing.T) {
+	opts := testOptions(NewMemFS())
+	opts.MaxFileSize = 256
+	bc := openTest(t, opts)
+	defer bc.Close()
+
+	for i := 0; i < 2000; i++ {
+		bc.Set("k"+strconv.Itoa(i%20), []byte("v"))
+	}
+	rotateTest(t, bc)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bc.Merge()
+	}()
+	for merging := true; merging; {
+		select {
+		case <-done:
+			merging = false
+		default:
+		}
+		if stats := bc.Stats(); stats.Keys != 20 {
+			t.Fatalf("stats expects 20 keys during merge, got %d", stats.Keys)
+		}
+	}
+	if merges := bc.Stats().Merges; len(merges) != 1 || merges[0].Err != "" {
+		t.Fatalf("merge failed, stats=%+v", merges)
+	}
+}
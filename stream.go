@@ -0,0 +1,94 @@
+package beecask
+
+import (
+	"bytes"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// randomAccessReader adapts RandomAccessFile to io.ReaderAt
+type randomAccessReader struct {
+	file RandomAccessFile
+}
+
+func (rar randomAccessReader) ReadAt(p []byte, offset int64) (int, error) {
+	data, err := rar.file.ReadAt(offset, int64(len(p)))
+	n := copy(p, data)
+	return n, err
+}
+
+// valueReader streams the value of a record and verifies crc
+// incrementally. If crc mismatches, the read reaching the end of value
+// returns no bytes but ErrDataCorruption, so that io.ReadFull sees it
+type valueReader struct {
+	sr      *io.SectionReader
+	left    int64 // bytes of value not read yet
+	err     error
+	crc     hash.Hash32
+	expect  uint32
+	flag    uint32
+	closeFn func() error
+	closed  bool
+}
+
+// newValueReader creates a valueReader of record(key) at offset of ra,
+// closeFn is called on Close to release ra
+func newValueReader(ra io.ReaderAt, offset int64, key []byte, closeFn func() error) (*valueReader, int64, error) {
+	var r Record
+	header := make([]byte, DATA_ITEM_HEADER_SIZE+RECORD_SEQ_SIZE)
+	if _, err := ra.ReadAt(header[:DATA_ITEM_HEADER_SIZE], offset); err != nil {
+		return nil, 0, err
+	}
+	r.decodeHeader(header)
+	header = header[:r.HeaderSize()]
+	if _, err := ra.ReadAt(header[DATA_ITEM_HEADER_SIZE:], offset+DATA_ITEM_HEADER_SIZE); err != nil {
+		return nil, 0, err
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	rkey := make([]byte, r.keySize)
+	if _, err := ra.ReadAt(rkey, offset+r.HeaderSize()); err != nil {
+		return nil, 0, err
+	}
+	if !bytes.Equal(rkey, key) {
+		return nil, 0, ErrDataCorruption
+	}
+	crc.Write(rkey)
+
+	valueOffset := offset + r.HeaderSize() + int64(r.keySize)
+	return &valueReader{
+		sr:      io.NewSectionReader(ra, valueOffset, int64(r.valueSize)),
+		left:    int64(r.valueSize),
+		crc:     crc,
+		expect:  r.crc,
+		flag:    r.flag,
+		closeFn: closeFn,
+	}, int64(r.valueSize), nil
+}
+
+func (vr *valueReader) Read(p []byte) (int, error) {
+	if vr.closed {
+		return 0, ErrInvalid
+	}
+	if vr.err != nil {
+		return 0, vr.err
+	}
+	n, err := vr.sr.Read(p)
+	vr.crc.Write(p[:n])
+	vr.left -= int64(n)
+	if vr.left == 0 && vr.crc.Sum32() != vr.expect {
+		vr.err = ErrDataCorruption
+		return 0, vr.err
+	}
+	return n, err
+}
+
+func (vr *valueReader) Close() error {
+	if vr.closed {
+		return nil
+	}
+	vr.closed = true
+	return vr.closeFn()
+}
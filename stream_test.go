@@ -0,0 +1,151 @@
+package beecask
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestSetReaderGetReader(t *testing.T) {
+	opts := testOptions(NewMemFS())
+	opts.MaxFileSize = 1 << 20
+	opts.WriteBufferSize = 4096
+	bc := openTest(t, opts)
+
+	big := bytes.Repeat([]byte("abcdefg"), 300000)
+	if err := bc.SetReader("big", bytes.NewReader(big), int64(len(big))); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.SetReader("short", strings.NewReader("abc"), 10); err != io.ErrUnexpectedEOF {
+		t.Fatalf("short reader expects ErrUnexpectedEOF, err=%v", err)
+	}
+	expectNotExist(t, bc, "short")
+
+	rc, size, err := bc.GetReader("big")
+	if err != nil || size != int64(len(big)) {
+		t.Fatalf("get reader failed, size=%d err=%v", size, err)
+	}
+	got, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(got, big) {
+		t.Fatalf("streamed value mismatches, err=%v", err)
+	}
+	bc.Close()
+
+	bc = openTest(t, opts)
+	defer bc.Close()
+	if v, err := bc.Get("big"); err != nil || !bytes.Equal(v, big) {
+		t.Fatalf("value mismatches after restart, err=%v", err)
+	}
+}
+
+// io.ReadFull never reads past the value, corruption must be reported
+// by the read which reaches the end of value
+func TestGetReaderCorruption(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	bc := openTest(t, testOptions(fs))
+	defer bc.Close()
+
+	value := bytes.Repeat([]byte("v"), 1000)
+	if err := bc.Set("k", value); err != nil {
+		t.Fatal(err)
+	}
+	bc.rwMutex.RLock()
+	fileId := bc.activeFile.FileId()
+	bc.rwMutex.RUnlock()
+	rotateTest(t, bc)
+	name := bc.dataFilePath(fileId)
+	fi, err := fs.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Corrupt(name, fi.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, size, err := bc.GetReader("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if _, err = io.ReadFull(rc, make([]byte, size)); err != ErrDataCorruption {
+		t.Fatalf("read of corrupted value expects ErrDataCorruption, err=%v", err)
+	}
+}
+
+// blockingReader returns data of r only after release is closed
+type blockingReader struct {
+	r       io.Reader
+	release chan struct{}
+}
+
+func (br *blockingReader) Read(p []byte) (int, error) {
+	<-br.release
+	return br.r.Read(p)
+}
+
+func TestSetReaderDoesNotBlockWrites(t *testing.T) {
+	opts := testOptions(NewMemFS())
+	opts.WriteBufferSize = 4096
+	bc := openTest(t, opts)
+	defer bc.Close()
+
+	for _, size := range []int{100, 100000} {
+		value := bytes.Repeat([]byte("s"), size)
+		br := &blockingReader{r: bytes.NewReader(value), release: make(chan struct{})}
+		done := make(chan error)
+		go func() {
+			done <- bc.SetReader("slow", br, int64(size))
+		}()
+
+		if err := bc.Set("k", []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		expectValue(t, bc, "k", "v")
+		close(br.release)
+		if err := <-done; err != nil {
+			t.Fatalf("size %d: set reader failed, err=%v", size, err)
+		}
+		expectValue(t, bc, "slow", string(value))
+	}
+}
+
+func TestSetReaderFailureKeepsWritable(t *testing.T) {
+	opts := testOptions(NewMemFS())
+	opts.WriteBufferSize = 4096
+	bc := openTest(t, opts)
+	defer bc.Close()
+
+	for _, size := range []int64{100, 100000} {
+		if err := bc.SetReader("k", strings.NewReader("abc"), size); err != io.ErrUnexpectedEOF {
+			t.Fatalf("size %d: short reader expects ErrUnexpectedEOF, err=%v", size, err)
+		}
+		if err := bc.Degraded(); err != nil {
+			t.Fatalf("size %d: failed reader degrades database, err=%v", size, err)
+		}
+		expectNotExist(t, bc, "k")
+	}
+}
+
+func TestSetReaderSurvivesCrash(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	opts := testOptions(fs)
+	opts.WriteBufferSize = 4096
+	bc := openTest(t, opts)
+
+	big := bytes.Repeat([]byte("b"), 100000)
+	if err := bc.SetReader("big", bytes.NewReader(big), int64(len(big))); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	bc = crashTest(t, bc, fs, opts)
+	defer bc.Close()
+	expectValue(t, bc, "big", string(big))
+
+	// value log gc keeps the streamed value
+	bc.ValueLogGC()
+	expectValue(t, bc, "big", string(big))
+}
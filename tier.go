@@ -0,0 +1,395 @@
+package beecask
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// BlobStore keeps immutable blobs by name, old data files are offloaded to
+// it to save local disk. It is typically an object store, and must be kept
+// for this database only as blobs are named by data file names.
+type BlobStore interface {
+	// Put stores size bytes of r as blob name, replacing a blob of the
+	// same name. The blob must be durable once Put returns.
+	Put(name string, r io.Reader, size int64) error
+	// Get reads len(p) bytes of blob name at offset, like io.ReaderAt,
+	// so that records are read by ranges
+	Get(name string, p []byte, offset int64) (int, error)
+	// Delete removes blob name, it is not an error if it does not exist
+	Delete(name string) error
+}
+
+// DirBlobStore is a BlobStore keeping blobs as files in a dir of fs, it
+// stands in for an object store
+type DirBlobStore struct {
+	fs  FS
+	dir string
+}
+
+func NewDirBlobStore(fs FS, dir string) (*DirBlobStore, error) {
+	if fs == nil {
+		fs = OSFS{}
+	}
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DirBlobStore{fs: fs, dir: dir}, nil
+}
+
+func (store *DirBlobStore) Put(name string, r io.Reader, size int64) error {
+	blobPath := path.Join(store.dir, name)
+	tmpPath := blobPath + TEMP_FILE_SUFFIX
+	f, err := store.fs.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(0)
+	buf := make([]byte, 1<<20)
+	var offset int64
+	for err == nil && offset < size {
+		n := int64(len(buf))
+		if n > size-offset {
+			n = size - offset
+		}
+		if _, err = io.ReadFull(r, buf[:n]); err == nil {
+			_, err = f.WriteAt(buf[:n], offset)
+			offset += n
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = store.fs.Rename(tmpPath, blobPath)
+	}
+	if err != nil {
+		store.fs.Remove(tmpPath)
+	}
+	return err
+}
+
+func (store *DirBlobStore) Get(name string, p []byte, offset int64) (int, error) {
+	f, err := store.fs.Open(path.Join(store.dir, name))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.ReadAt(p, offset)
+}
+
+func (store *DirBlobStore) Delete(name string) error {
+	err := store.fs.Remove(path.Join(store.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// blobReader reads a blob by ranges
+type blobReader struct {
+	store BlobStore
+	name  string
+}
+
+func (r *blobReader) ReadAt(p []byte, offset int64) (int, error) {
+	return r.store.Get(r.name, p, offset)
+}
+
+func (r *blobReader) Close() error {
+	return nil
+}
+
+// localCopy is a downloaded copy of an offloaded data file, it is
+// removed once closed
+type localCopy struct {
+	RandomAccessFile
+	fs   FS
+	path string
+}
+
+func (file *localCopy) Close() error {
+	err := file.RandomAccessFile.Close()
+	file.fs.Remove(file.path)
+	return err
+}
+
+// blobTier keeps track of data files offloaded to a BlobStore. An offloaded
+// data file leaves a stub file with its size beside its hint file, which
+// stays local for restore. Offloaded files are read by ranges, or through
+// a local copy downloaded when DataFileCache opens them if cacheLocal is set.
+type blobTier struct {
+	store      BlobStore
+	fs         FS
+	fa         fileAccess
+	cacheLocal bool
+	pathFn     func(fileId uint64) string // local path of data file
+	logger     Logger
+
+	mu    sync.Mutex
+	sizes map[uint64]int64 // sizes of offloaded data files
+}
+
+func newBlobTier(store BlobStore, fs FS, fa fileAccess, cacheLocal bool, pathFn func(fileId uint64) string, logger Logger) *blobTier {
+	return &blobTier{
+		store:      store,
+		fs:         fs,
+		fa:         fa,
+		cacheLocal: cacheLocal,
+		pathFn:     pathFn,
+		logger:     logger,
+		sizes:      make(map[uint64]int64),
+	}
+}
+
+func blobName(fileId uint64) string {
+	return fmt.Sprintf(DATA_FILE_FORMAT, fileId)
+}
+
+// offloaded returns size of data file fileId if it has been offloaded
+func (t *blobTier) offloaded(fileId uint64) (int64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	size, ok := t.sizes[fileId]
+	return size, ok
+}
+
+func (t *blobTier) add(fileId uint64, size int64) {
+	t.mu.Lock()
+	t.sizes[fileId] = size
+	t.mu.Unlock()
+}
+
+// open opens data file fileId if it has been offloaded, ok is false if
+// the file is local
+func (t *blobTier) open(fileId uint64) (file RandomAccessFile, ok bool, err error) {
+	size, ok := t.offloaded(fileId)
+	if !ok {
+		return nil, false, nil
+	}
+	r := &blobReader{store: t.store, name: blobName(fileId)}
+	if !t.cacheLocal {
+		return newPreadFile(r, size, t.fa.readahead), true, nil
+	}
+
+	// a leftover of a crash is removed by scan as a temporary file
+	copyPath := t.pathFn(fileId) + TEMP_FILE_SUFFIX
+	if err = t.download(r, size, copyPath); err == nil {
+		file, err = t.fa.open(t.fs, copyPath)
+	}
+	if err != nil {
+		t.fs.Remove(copyPath)
+		return nil, true, err
+	}
+	return &localCopy{RandomAccessFile: file, fs: t.fs, path: copyPath}, true, nil
+}
+
+func (t *blobTier) download(r *blobReader, size int64, path string) error {
+	f, err := t.fs.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = io.Copy(&offsetWriter{f: f}, io.NewSectionReader(r, 0, size))
+	return err
+}
+
+// offsetWriter writes to a File sequentially
+type offsetWriter struct {
+	f      File
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+// remove deletes stub at stubPath and blob of data file fileId
+func (t *blobTier) remove(fileId uint64, stubPath string) {
+	t.mu.Lock()
+	_, ok := t.sizes[fileId]
+	delete(t.sizes, fileId)
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+	// stub goes first, a blob without stub is only garbage
+	t.fs.Remove(stubPath)
+	if err := t.store.Delete(blobName(fileId)); err != nil {
+		t.logger.Errorf("Delete blob of datafile[%d] failed, err=%s", fileId, err)
+	}
+}
+
+func readBlobStub(fs FS, path string) (int64, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	buf := make([]byte, 32)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(buf[:n])), 10, 64)
+}
+
+// writeBlobStub writes stub to a temporary file and renames it after synced
+func writeBlobStub(fs FS, path string, size int64) error {
+	tmpPath := path + TEMP_FILE_SUFFIX
+	f, err := fs.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	data := []byte(strconv.FormatInt(size, 10) + "\n")
+	_, err = f.WriteAt(data, 0)
+	if err == nil {
+		err = f.Truncate(int64(len(data)))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = fs.Rename(tmpPath, path)
+	}
+	if err != nil {
+		fs.Remove(tmpPath)
+	}
+	return err
+}
+
+func (bc *Beecask) blobStubPath(fileId uint64) string {
+	return getBlobStubPath(bc.placement.dir(fileId), fileId)
+}
+
+// dataFileExists reports whether data file fileId is kept locally or in
+// blob store, it is false once merge removed it
+func (bc *Beecask) dataFileExists(fileId uint64) bool {
+	if bc.tier != nil {
+		if _, ok := bc.tier.offloaded(fileId); ok {
+			return true
+		}
+	}
+	_, err := bc.fs.Stat(bc.dataFilePath(fileId))
+	return err == nil
+}
+
+// dropLocalCopy removes the local copy of data file fileId left by a crash
+// during offload, if a stub is found beside it
+func (bc *Beecask) dropLocalCopy(fileId uint64) {
+	if bc.tier == nil {
+		return
+	}
+	if _, ok := bc.tier.offloaded(fileId); ok {
+		bc.fs.Remove(bc.dataFilePath(fileId))
+	}
+}
+
+// maybeOffload starts offloading data files sealed more than OffloadAfter
+// rotations ago, unless an offload is running.
+// maybeOffload requires bc.rwMutex held
+func (bc *Beecask) maybeOffload() {
+	if bc.tier == nil || bc.options.OffloadAfter <= 0 {
+		return
+	}
+	// the active file is not sealed
+	if bc.maxDataFileId <= uint64(bc.options.OffloadAfter)+1 {
+		return
+	}
+	// a running offload goes on to the new end
+	atomic.StoreUint64(&bc.offloadEnd, bc.maxDataFileId-uint64(bc.options.OffloadAfter)-1)
+	if !atomic.CompareAndSwapInt32(&bc.isOffloading, 0, 1) {
+		return
+	}
+	bc.wg.Add(1)
+	go bc.offload(bc.minDataFileId)
+}
+
+// offload offloads local data files from begin to bc.offloadEnd, it does
+// not hold bc.rwMutex as Close waits for it with the lock held
+func (bc *Beecask) offload(begin uint64) {
+	defer bc.wg.Done()
+	fileId := begin
+	for {
+		for ; fileId <= atomic.LoadUint64(&bc.offloadEnd); fileId++ {
+			if _, ok := bc.tier.offloaded(fileId); ok {
+				continue
+			}
+			if err := bc.offloadDataFile(fileId); err != nil {
+				bc.logger.Errorf("Offload datafile[%d] failed, err=%s", fileId, err)
+				atomic.StoreInt32(&bc.isOffloading, 0)
+				return
+			}
+		}
+		atomic.StoreInt32(&bc.isOffloading, 0)
+		// the end may have moved after it was checked
+		if fileId > atomic.LoadUint64(&bc.offloadEnd) || !atomic.CompareAndSwapInt32(&bc.isOffloading, 0, 1) {
+			return
+		}
+	}
+}
+
+// offloadDataFile uploads data file fileId, then replaces it with a stub.
+// A crash before the stub is written leaves the data file local, one after
+// leaves both, and scan removes the data file then.
+func (bc *Beecask) offloadDataFile(fileId uint64) error {
+	path := bc.dataFilePath(fileId)
+	// merge removes data files with hookMutex held
+	bc.hookMutex.Lock()
+	f, err := bc.fs.Open(path)
+	if fileId < bc.minDataFileId {
+		if err == nil {
+			f.Close()
+		}
+		err = os.ErrNotExist
+	}
+	bc.hookMutex.Unlock()
+	if err != nil {
+		if os.IsNotExist(err) {
+			// removed by merge
+			return nil
+		}
+		return err
+	}
+	size, err := f.Size()
+	if err == nil {
+		err = bc.tier.store.Put(blobName(fileId), io.NewSectionReader(f, 0, size), size)
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	bc.hookMutex.Lock()
+	defer bc.hookMutex.Unlock()
+	// data file may have been removed by merge meanwhile
+	if _, err = bc.fs.Stat(path); err != nil {
+		bc.tier.store.Delete(blobName(fileId))
+		return nil
+	}
+	if err = writeBlobStub(bc.fs, bc.blobStubPath(fileId), size); err != nil {
+		return err
+	}
+	bc.tier.add(fileId, size)
+	// files opened already keep reading the local one until closed
+	bc.dataFileCache.Evict(fileId)
+	bc.fs.Remove(path)
+	bc.logger.Infof("Offload datafile[%d] succ.", fileId)
+	return nil
+}
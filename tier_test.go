@@ -0,0 +1,116 @@
+package beecask
+
+import (
+	"bytes"
+	"path"
+	"testing"
+)
+
+const TIER_TEST_KEYS = 600
+
+// tierValues returns values of keys written in round
+func tierValues(round int) func(i int) []byte {
+	return func(i int) []byte { return testValue(i+round, 50+i%300) }
+}
+
+func TestOffload(t *testing.T) {
+	for _, cacheLocal := range []bool{false, true} {
+		fs := NewMemFS()
+		store, err := NewDirBlobStore(fs, "/blobs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := testOptions(fs)
+		opts.MaxFileSize = 8 << 10
+		opts.BlobStore = store
+		opts.OffloadAfter = 2
+		opts.BlobCacheLocal = cacheLocal
+		opts.MaxOpenFiles = 4
+		bc := openTest(t, opts)
+
+		for round := 0; round < 2; round++ {
+			fillKeys(t, bc, TIER_TEST_KEYS, tierValues(round))
+		}
+		bc.wg.Wait()
+		checkKeys(t, bc, TIER_TEST_KEYS, tierValues(1), "offloaded")
+		offloaded := 0
+		stats := bc.Stats()
+		for _, df := range stats.DataFiles {
+			if df.Offloaded {
+				offloaded++
+			}
+		}
+		data, stubs := countFiles(t, fs, TEST_DIR, ".data"), countFiles(t, fs, TEST_DIR, ".blob")
+		if offloaded == 0 || stubs != offloaded || data+stubs != len(stats.DataFiles) {
+			t.Fatalf("cache local %v: offloaded %d files, %d stubs and %d local files", cacheLocal, offloaded, stubs, data)
+		}
+		bc.Close()
+
+		bc = openTest(t, opts)
+		checkKeys(t, bc, TIER_TEST_KEYS, tierValues(1), "reopen")
+		bc.Close()
+
+		// without hint files, offloaded data files are read from blob store
+		names, _ := fs.ReadDir(TEST_DIR)
+		for _, name := range names {
+			if path.Ext(name) == ".hint" {
+				fs.Remove(path.Join(TEST_DIR, name))
+			}
+		}
+		bc = openTest(t, opts)
+		checkKeys(t, bc, TIER_TEST_KEYS, tierValues(1), "no hint files")
+		rotateTest(t, bc)
+		mergeTest(t, bc)
+		bc.wg.Wait()
+		checkKeys(t, bc, TIER_TEST_KEYS, tierValues(1), "merged")
+		bc.Close()
+		if stubs, blobs := countFiles(t, fs, TEST_DIR, ".blob"), countFiles(t, fs, "/blobs", ".data"); stubs != blobs {
+			t.Fatalf("cache local %v: merge expects blobs removed with stubs, %d stubs and %d blobs", cacheLocal, stubs, blobs)
+		}
+
+		bc = openTest(t, opts)
+		checkKeys(t, bc, TIER_TEST_KEYS, tierValues(1), "reopen after merge")
+		bc.Close()
+
+		if countFiles(t, fs, TEST_DIR, ".blob") > 0 {
+			opts.BlobStore = nil
+			if _, err = NewBeecask(*opts, TEST_DIR); err == nil {
+				t.Fatalf("offloaded files without blob store expects error")
+			}
+		}
+	}
+}
+
+// a crash after stub is written leaves both copies, the local one is dropped
+func TestOffloadBothCopies(t *testing.T) {
+	fs := NewMemFS()
+	store, _ := NewDirBlobStore(fs, "/blobs")
+	opts := testOptions(fs)
+	opts.MaxFileSize = 4 << 10
+	opts.BlobStore = store
+	bc := openTest(t, opts)
+	fillKeys(t, bc, TIER_TEST_KEYS, tierValues(0))
+
+	f, err := fs.Open(getDataFilePath(TEST_DIR, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, _ := f.Size()
+	data := make([]byte, size)
+	f.ReadAt(data, 0)
+	f.Close()
+	if err = store.Put(blobName(1), bytes.NewReader(data), size); err != nil {
+		t.Fatal(err)
+	}
+	if err = writeBlobStub(fs, getBlobStubPath(TEST_DIR, 1), size); err != nil {
+		t.Fatal(err)
+	}
+	bc.Close()
+
+	bc = openTest(t, opts)
+	defer bc.Close()
+	checkKeys(t, bc, TIER_TEST_KEYS, tierValues(0), "both copies")
+	if _, err = fs.Stat(getDataFilePath(TEST_DIR, 1)); err == nil {
+		t.Fatalf("local copy of offloaded file expects removed")
+	}
+}
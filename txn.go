@@ -0,0 +1,164 @@
+package beecask
+
+import (
+	"fmt"
+	"time"
+)
+
+var (
+	ErrConflict    = fmt.Errorf("Transaction conflict")
+	ErrTxnReadOnly = fmt.Errorf("Transaction is read-only")
+	ErrTxnDone     = fmt.Errorf("Transaction has been done")
+)
+
+// Txn is an optimistic transaction. Reads are tracked and writes are buffered
+// until commit, the commit fails with ErrConflict if any key read by the
+// transaction has been changed since the transaction started.
+type Txn struct {
+	bc       *Beecask
+	update   bool
+	done     bool
+	startSeq uint64
+	reads    map[string]uint64  // key -> version observed
+	writes   map[string]*Record // pending writes
+	order    []string           // keys of pending writes in write order
+}
+
+// Update runs fn in a read-write transaction and commits it if fn returns nil.
+// ErrConflict is returned if the transaction conflicts with other writes,
+// the caller may retry the whole transaction then.
+func (bc *Beecask) Update(fn func(tx *Txn) error) error {
+	tx := bc.newTxn(true)
+	defer tx.Discard()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// View runs fn in a read-only transaction. Reads are validated after fn
+// returns nil, ErrConflict is returned if any key read by the transaction has
+// been changed since it started. What fn has read must not be used unless View
+// returns nil, the caller may retry the whole transaction then.
+func (bc *Beecask) View(fn func(tx *Txn) error) error {
+	tx := bc.newTxn(false)
+	defer tx.Discard()
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	bc.rwMutex.RLock()
+	defer bc.rwMutex.RUnlock()
+	return tx.validate()
+}
+
+func (bc *Beecask) newTxn(update bool) *Txn {
+	bc.rwMutex.RLock()
+	startSeq := bc.seq
+	bc.rwMutex.RUnlock()
+	return &Txn{
+		bc:       bc,
+		update:   update,
+		startSeq: startSeq,
+		reads:    make(map[string]uint64),
+		writes:   make(map[string]*Record),
+	}
+}
+
+// Get returns value of key, pending writes of tx are visible
+func (tx *Txn) Get(key string) ([]byte, error) {
+	if tx.done {
+		return nil, ErrTxnDone
+	}
+	if r, ok := tx.writes[key]; ok {
+		if (r.flag & RECORD_FLAG_BIT_DELETE) > 0 {
+			return nil, ErrDataNotExist
+		}
+		return append([]byte(nil), r.value...), nil
+	}
+
+	value, version, err := tx.bc.GetWithVersion(key)
+	if err != nil && err != ErrDataNotExist {
+		return nil, err
+	}
+	if _, ok := tx.reads[key]; !ok {
+		tx.reads[key] = version
+	}
+	return value, err
+}
+
+func (tx *Txn) Set(key string, value []byte) error {
+	return tx.SetWithExpiration(key, value, 0)
+}
+
+func (tx *Txn) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	return tx.SetWithExpiration(key, value, expirationAfter(ttl))
+}
+
+func (tx *Txn) SetWithExpiration(key string, value []byte, expiration int64) error {
+	// value is copied, caller may reuse it before commit
+	return tx.write(key, newRecord([]byte(key), append([]byte(nil), value...), false, expiration))
+}
+
+func (tx *Txn) Delete(key string) error {
+	return tx.write(key, newRecord([]byte(key), nil, true, 0))
+}
+
+func (tx *Txn) write(key string, r *Record) error {
+	if tx.done {
+		return ErrTxnDone
+	}
+	if !tx.update {
+		return ErrTxnReadOnly
+	}
+	if _, ok := tx.writes[key]; !ok {
+		tx.order = append(tx.order, key)
+	}
+	tx.writes[key] = r
+	return nil
+}
+
+// Commit checks conflicts and writes pending writes atomically
+func (tx *Txn) Commit() (err error) {
+	if tx.done {
+		return ErrTxnDone
+	}
+	tx.done = true
+	if len(tx.writes) == 0 {
+		return nil
+	}
+
+	bc := tx.bc
+	defer bc.metrics.observe(OP_COMMIT, time.Now(), &err)
+	bc.rwMutex.Lock()
+	defer bc.rwMutex.Unlock()
+
+	if err := tx.validate(); err != nil {
+		return err
+	}
+
+	records := make([]*Record, 0, len(tx.order))
+	for _, key := range tx.order {
+		records = append(records, tx.writes[key])
+	}
+	return bc.writeBatch(records)
+}
+
+// validate returns ErrConflict if any key read by tx has been changed since
+// tx started, so that all reads of tx see the state when it started.
+// validate requires bc.rwMutex held
+func (tx *Txn) validate() error {
+	bc := tx.bc
+	for key, version := range tx.reads {
+		kdItem, ok := bc.keydir.Lookup([]byte(key))
+		if (ok && kdItem.seq > tx.startSeq) || bc.versionOf([]byte(key)) != version {
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
+// Discard drops pending writes, it is a no-op after commit
+func (tx *Txn) Discard() {
+	tx.done = true
+}
@@ -0,0 +1,111 @@
+package beecask
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestUpdate(t *testing.T) {
+	opts := testOptions(NewMemFS())
+	opts.MaxFileSize = 400
+	bc := openTest(t, opts)
+
+	bc.Set("a", []byte("0"))
+	for i := 1; i <= 5; i++ {
+		err := bc.Update(func(tx *Txn) error {
+			v, err := tx.Get("a")
+			if err != nil {
+				return err
+			}
+			tx.Set("b", v)
+			tx.Set(fmt.Sprint("c", i), v)
+			tx.Delete("a")
+			if _, err = tx.Get("a"); err != ErrDataNotExist {
+				t.Fatalf("pending delete expects visible, err=%v", err)
+			}
+			return tx.Set("a", []byte(fmt.Sprint(i)))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func() {
+		t.Helper()
+		expectValue(t, bc, "a", "5")
+		expectValue(t, bc, "b", "4")
+		expectValue(t, bc, "c5", "4")
+	}
+	check()
+	bc.Close()
+
+	bc = openTest(t, opts)
+	check()
+	mergeTest(t, bc)
+	check()
+	bc.Close()
+}
+
+func TestUpdateConflict(t *testing.T) {
+	bc := openTest(t, testOptions(NewMemFS()))
+	defer bc.Close()
+
+	bc.Set("a", []byte("1"))
+	err := bc.Update(func(tx *Txn) error {
+		v, _ := tx.Get("a")
+		bc.Set("a", []byte("x"))
+		return tx.Set("b", v)
+	})
+	if err != ErrConflict {
+		t.Fatalf("update expects ErrConflict, err=%v", err)
+	}
+	expectNotExist(t, bc, "b")
+
+	// key created after read of an absent key
+	err = bc.Update(func(tx *Txn) error {
+		if _, err := tx.Get("c"); err != ErrDataNotExist {
+			return err
+		}
+		bc.Set("c", []byte("x"))
+		return tx.Set("c", []byte("y"))
+	})
+	if err != ErrConflict {
+		t.Fatalf("update expects ErrConflict, err=%v", err)
+	}
+	expectValue(t, bc, "c", "x")
+}
+
+func TestView(t *testing.T) {
+	bc := openTest(t, testOptions(NewMemFS()))
+	defer bc.Close()
+
+	bc.Set("a", []byte("1"))
+	bc.Set("b", []byte("1"))
+	err := bc.View(func(tx *Txn) error {
+		if err := tx.Set("a", nil); err != ErrTxnReadOnly {
+			t.Fatalf("write of view expects ErrTxnReadOnly, err=%v", err)
+		}
+		a, _ := tx.Get("a")
+		b, _ := tx.Get("b")
+		if string(a) != "1" || string(b) != "1" {
+			t.Fatalf("view reads %q and %q", a, b)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a commit between two reads is seen only half
+	err = bc.View(func(tx *Txn) error {
+		tx.Get("a")
+		bc.Update(func(tx *Txn) error {
+			tx.Set("a", []byte("2"))
+			return tx.Set("b", []byte("2"))
+		})
+		tx.Get("b")
+		return nil
+	})
+	if err != ErrConflict {
+		t.Fatalf("view expects ErrConflict, err=%v", err)
+	}
+}
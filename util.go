@@ -4,11 +4,20 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"time"
 )
 
 const (
-	DATA_FILE_FORMAT = "%08d.data"
-	HINT_FILE_FORMAT = "%08d.hint"
+	DATA_FILE_FORMAT     = "%08d.data"
+	HINT_FILE_FORMAT     = "%08d.hint"
+	VLOG_FILE_FORMAT     = "%08d.vlog"
+	BLOB_STUB_FORMAT     = "%08d.blob"
+	STREAM_FILE_FORMAT   = "%08d.stream"
+	LOCK_FILE_NAME       = "LOCK"
+	INDEX_FILE_NAME      = "INDEX"
+	PLACEMENT_FILE_NAME  = "PLACEMENT"
+	CHECKPOINT_FILE_NAME = "CHECKPOINT"
+	TEMP_FILE_SUFFIX     = ".tmp"
 )
 
 func getDataFilePath(dir string, fileId uint64) string {
@@ -19,6 +28,48 @@ func getHintFilePath(dir string, fileId uint64) string {
 	return path.Join(dir, fmt.Sprintf(HINT_FILE_FORMAT, fileId))
 }
 
+func getBlobStubPath(dir string, fileId uint64) string {
+	return path.Join(dir, fmt.Sprintf(BLOB_STUB_FORMAT, fileId))
+}
+
+func getLockFilePath(dir string) string {
+	return path.Join(dir, LOCK_FILE_NAME)
+}
+
+func getIndexFilePath(dir string) string {
+	return path.Join(dir, INDEX_FILE_NAME)
+}
+
+func getCheckpointFilePath(dir string) string {
+	return path.Join(dir, CHECKPOINT_FILE_NAME)
+}
+
+func getPlacementFilePath(dir string) string {
+	return path.Join(dir, PLACEMENT_FILE_NAME)
+}
+
+func getValueLogPath(dir string, fileId uint64) string {
+	return path.Join(dir, fmt.Sprintf(VLOG_FILE_FORMAT, fileId))
+}
+
+func getStreamFilePath(dir string, streamId uint64) string {
+	return path.Join(dir, fmt.Sprintf(STREAM_FILE_FORMAT, streamId))
+}
+
+// expirationAfter converts ttl to an absolute expiration in unix seconds.
+// It rounds up so that a record never expires before ttl elapses.
+func expirationAfter(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	t := time.Now().Add(ttl)
+	expiration := t.Unix()
+	if t.Nanosecond() > 0 {
+		expiration++
+	}
+	return expiration
+}
+
 // absInt64 is a simple abs function for int64
 func absInt64(x int64) int64 {
 	if x < 0 {
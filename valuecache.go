@@ -0,0 +1,126 @@
+package beecask
+
+import (
+	"container/list"
+	"sync"
+)
+
+const (
+	VALUE_CACHE_SHARD_BITS     = 4
+	VALUE_CACHE_SHARDS         = 1 << VALUE_CACHE_SHARD_BITS
+	VALUE_CACHE_ENTRY_OVERHEAD = 64 // approximate bytes of an entry besides its value
+)
+
+// valueCacheKey is the location of a record. Records are never rewritten in
+// place, a rewrite of key moves it to a new location, so cached values need
+// no invalidation and stale ones are evicted as they get cold.
+type valueCacheKey struct {
+	fileId   uint64
+	valuePos uint32
+}
+
+type valueCacheEntry struct {
+	key   valueCacheKey
+	value []byte
+}
+
+type valueCacheShard struct {
+	mu       sync.Mutex
+	l        *list.List
+	hash     map[valueCacheKey]*list.Element
+	size     int64
+	capacity int64
+
+	// counters, require mu held
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// ValueCache is a sharded LRU cache of values bounded by total bytes
+type ValueCache struct {
+	shards [VALUE_CACHE_SHARDS]valueCacheShard
+}
+
+// ValueCacheStats is a snapshot of counters of ValueCache
+type ValueCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Bytes     int64 // values and overhead of entries
+}
+
+func NewValueCache(capacity int64) *ValueCache {
+	cache := &ValueCache{}
+	for i := range cache.shards {
+		cache.shards[i].l = list.New()
+		cache.shards[i].hash = make(map[valueCacheKey]*list.Element)
+		cache.shards[i].capacity = capacity / VALUE_CACHE_SHARDS
+	}
+	return cache
+}
+
+func (cache *ValueCache) shard(key valueCacheKey) *valueCacheShard {
+	h := (key.fileId<<32 ^ uint64(key.valuePos)) * 0x9e3779b97f4a7c15
+	return &cache.shards[h>>(64-VALUE_CACHE_SHARD_BITS)]
+}
+
+// Get returns the value of record at valuePos of data file fileId,
+// the value is shared and must not be modified
+func (cache *ValueCache) Get(fileId uint64, valuePos uint32) ([]byte, bool) {
+	key := valueCacheKey{fileId: fileId, valuePos: valuePos}
+	s := cache.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ele, ok := s.hash[key]
+	if !ok {
+		s.misses++
+		return nil, false
+	}
+	s.hits++
+	s.l.MoveToFront(ele)
+	return ele.Value.(*valueCacheEntry).value, true
+}
+
+// Set adds a copy of value, values larger than a shard are not cached
+func (cache *ValueCache) Set(fileId uint64, valuePos uint32, value []byte) {
+	key := valueCacheKey{fileId: fileId, valuePos: valuePos}
+	s := cache.shard(key)
+	charge := int64(len(value)) + VALUE_CACHE_ENTRY_OVERHEAD
+	if charge > s.capacity {
+		return
+	}
+	value = append([]byte(nil), value...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ele, ok := s.hash[key]; ok {
+		// filled by a concurrent read of the same record
+		s.l.MoveToFront(ele)
+		return
+	}
+	s.hash[key] = s.l.PushFront(&valueCacheEntry{key: key, value: value})
+	s.size += charge
+	for s.size > s.capacity {
+		entry := s.l.Remove(s.l.Back()).(*valueCacheEntry)
+		delete(s.hash, entry.key)
+		s.size -= int64(len(entry.value)) + VALUE_CACHE_ENTRY_OVERHEAD
+		s.evictions++
+	}
+}
+
+func (cache *ValueCache) Stats() ValueCacheStats {
+	var stats ValueCacheStats
+	for i := range cache.shards {
+		s := &cache.shards[i]
+		s.mu.Lock()
+		stats.Hits += s.hits
+		stats.Misses += s.misses
+		stats.Evictions += s.evictions
+		stats.Entries += s.l.Len()
+		stats.Bytes += s.size
+		s.mu.Unlock()
+	}
+	return stats
+}
@@ -0,0 +1,59 @@
+package beecask
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestValueCache(t *testing.T) {
+	opts := testOptions(NewMemFS())
+	opts.ValueCacheSize = 64 * (VALUE_CACHE_ENTRY_OVERHEAD + 40)
+	opts.ValueThreshold = 50
+	opts.MaxFileSize = 4096
+	bc := openTest(t, opts)
+	defer bc.Close()
+
+	bc.Set("a", []byte("1"))
+	for i := 0; i < 3; i++ {
+		expectValue(t, bc, "a", "1")
+	}
+	stats := bc.Stats().ValueCache
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Fatalf("value cache expects 2 hits and 1 miss, got %+v", stats)
+	}
+	// writes invalidate cached values
+	bc.Set("a", []byte("2"))
+	expectValue(t, bc, "a", "2")
+	bc.Delete("a")
+	expectNotExist(t, bc, "a")
+
+	// values in value log are cached too
+	big := bytes.Repeat([]byte("x"), 80)
+	bc.Set("big", big)
+	for i := 0; i < 2; i++ {
+		expectValue(t, bc, "big", string(big))
+	}
+
+	stats = bc.Stats().ValueCache
+	bc.GetWithOptions("big", ReadOptions{NoCache: true})
+	bc.ForEach(func(key string, value []byte) error { return nil })
+	if s := bc.Stats().ValueCache; s.Hits != stats.Hits || s.Misses != stats.Misses {
+		t.Fatalf("reads without cache expect value cache untouched, got %+v", s)
+	}
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("k%d", i)
+		bc.Set(key, bytes.Repeat([]byte{byte(i)}, 40))
+		bc.Get(key)
+	}
+	rotateTest(t, bc)
+	mergeTest(t, bc)
+	for i := 0; i < 1000; i++ {
+		expectValue(t, bc, fmt.Sprintf("k%d", i), string(bytes.Repeat([]byte{byte(i)}, 40)))
+	}
+	stats = bc.Stats().ValueCache
+	if stats.Bytes > opts.ValueCacheSize || stats.Evictions == 0 {
+		t.Fatalf("value cache expects bounded, got %+v", stats)
+	}
+}
@@ -0,0 +1,451 @@
+package beecask
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	VALUE_POINTER_SIZE = 20
+)
+
+// valuePointer locates a value record in value log
+type valuePointer struct {
+	fileId    uint64
+	offset    uint64
+	valueSize uint32
+}
+
+func (ptr *valuePointer) Encode() []byte {
+	buff := make([]byte, VALUE_POINTER_SIZE)
+	binary.LittleEndian.PutUint64(buff[0:8], ptr.fileId)
+	binary.LittleEndian.PutUint64(buff[8:16], ptr.offset)
+	binary.LittleEndian.PutUint32(buff[16:20], ptr.valueSize)
+	return buff
+}
+
+func decodeValuePointer(buff []byte) (valuePointer, error) {
+	if len(buff) != VALUE_POINTER_SIZE {
+		return valuePointer{}, ErrDataCorruption
+	}
+	return valuePointer{
+		fileId:    binary.LittleEndian.Uint64(buff[0:8]),
+		offset:    binary.LittleEndian.Uint64(buff[8:16]),
+		valueSize: binary.LittleEndian.Uint32(buff[16:20]),
+	}, nil
+}
+
+// errValueLogGone indicates value log file has been removed by gc
+// after the pointer was read, the read should be retried
+var errValueLogGone = fmt.Errorf("Value log gone")
+
+func (bc *Beecask) valueLogPath(fileId uint64) string {
+	return getValueLogPath(bc.dirPath, fileId)
+}
+
+// openValueLog opens the active value log file.
+// openValueLog requires bc.rwMutex held
+func (bc *Beecask) openValueLog() (err error) {
+	if bc.maxVlogId == 0 {
+		bc.minVlogId++
+		bc.maxVlogId++
+	}
+	fileId := bc.maxVlogId
+
+	// Evict value log from cache if exist to prevent opening active one twice
+	bc.vlogCache.Evict(fileId)
+
+	bc.vlogFile, err = NewActiveFile(bc.fs, bc.valueLogPath(fileId), fileId, bc.options.WriteBufferSize)
+	return err
+}
+
+// syncValueLog makes values written to value log durable, it is called
+// before records of active file are written out. A crash may keep any part
+// of active file written since last sync, pointers in it must never refer
+// to values which are lost.
+// syncValueLog requires bc.rwMutex held
+func (bc *Beecask) syncValueLog() error {
+	if bc.vlogFile == nil || !bc.vlogFile.Dirty() {
+		return nil
+	}
+	if err := bc.vlogFile.Sync(); err != nil {
+		bc.logger.Errorf("Sync value log[%d] failed, err=%s", bc.vlogFile.FileId(), err)
+		return err
+	}
+	return nil
+}
+
+// rotateValueLog requires bc.rwMutex held
+func (bc *Beecask) rotateValueLog() error {
+	// pointers to values of a sealed value log are synced without it
+	if err := bc.vlogFile.Sync(); err != nil {
+		bc.logger.Errorf("Sync value log[%d] failed, err=%s", bc.vlogFile.FileId(), err)
+		return err
+	}
+	fileId := bc.maxVlogId + 1
+	vlogFile, err := NewActiveFile(bc.fs, bc.valueLogPath(fileId), fileId, bc.options.WriteBufferSize)
+	if err != nil {
+		bc.logger.Errorf("New value log[%d] failed, err=%s", fileId, err)
+		return err
+	}
+
+	bc.vlogFile.Close()
+	bc.vlogFile = vlogFile
+	bc.maxVlogId = fileId
+	bc.logger.Infof("Rotate to new value log[%d]", fileId)
+	return nil
+}
+
+// separateValue writes value of r to value log, and turns r into a record
+// holding the value pointer.
+// separateValue requires bc.rwMutex held
+func (bc *Beecask) separateValue(r *Record) (err error) {
+	if bc.vlogFile == nil {
+		if err = bc.openValueLog(); err != nil {
+			bc.logger.Errorf("Open value log failed, err=%s", err)
+			bc.degrade(err)
+			return err
+		}
+	}
+	if bc.vlogFile.Size()+r.Size() >= bc.options.MaxFileSize {
+		if err = bc.rotateValueLog(); err != nil {
+			bc.degrade(err)
+			return err
+		}
+	}
+
+	vr := &Record{
+		expiration: r.expiration,
+		keySize:    r.keySize,
+		valueSize:  r.valueSize,
+		key:        r.key,
+		value:      r.value,
+	}
+	offset, err := bc.vlogFile.WriteRecord(vr)
+	if err != nil {
+		bc.logger.Errorf("Write record to value log[%d] failed, err=%s", bc.vlogFile.FileId(), err)
+		bc.degrade(err)
+		return err
+	}
+
+	ptr := valuePointer{fileId: bc.vlogFile.FileId(), offset: uint64(offset), valueSize: r.valueSize}
+	r.flag |= RECORD_FLAG_BIT_VALUE_POINTER
+	r.value = ptr.Encode()
+	r.valueSize = VALUE_POINTER_SIZE
+	return nil
+}
+
+// streamValue writes a value log record(key) whose size bytes of value are
+// read from reader into a temporary file, it is called without the lock held.
+// The file is synced and its path is returned.
+func (bc *Beecask) streamValue(key string, reader io.Reader, size int64) (string, error) {
+	tmpPath := getStreamFilePath(bc.dirPath, atomic.AddUint64(&bc.streamId, 1)) + TEMP_FILE_SUFFIX
+	af, err := NewActiveFile(bc.fs, tmpPath, 0, bc.options.WriteBufferSize)
+	if err != nil {
+		bc.logger.Errorf("Create stream file[%s] failed, err=%s", tmpPath, err)
+		return "", err
+	}
+	_, err = af.WriteRecordFrom(&Record{
+		keySize:   uint32(len(key)),
+		valueSize: uint32(size),
+		key:       []byte(key),
+	}, reader)
+	if err == nil {
+		err = af.Sync()
+	}
+	if cerr := af.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		bc.fs.Remove(tmpPath)
+		return "", err
+	}
+	return tmpPath, nil
+}
+
+// setStreamedValue installs the file written by streamValue as a sealed value
+// log, and sets a record(key) holding the pointer to its value.
+// setStreamedValue requires bc.rwMutex held
+func (bc *Beecask) setStreamedValue(key string, tmpPath string, size int64) error {
+	if bc.degraded != nil {
+		return ErrDegraded
+	}
+	// value log gc only runs with an active value log
+	if bc.vlogFile == nil {
+		if err := bc.openValueLog(); err != nil {
+			bc.logger.Errorf("Open value log failed, err=%s", err)
+			bc.degrade(err)
+			return err
+		}
+	}
+
+	fileId := bc.maxVlogId + 1
+	if err := bc.fs.Rename(tmpPath, bc.valueLogPath(fileId)); err != nil {
+		bc.logger.Errorf("Rename %s to value log[%d] failed, err=%s", tmpPath, fileId, err)
+		return err
+	}
+	bc.maxVlogId = fileId
+
+	ptr := valuePointer{fileId: fileId, offset: 0, valueSize: uint32(size)}
+	value := ptr.Encode()
+	return bc.setRecord(&Record{
+		flag:      RECORD_FLAG_BIT_VALUE_POINTER,
+		keySize:   uint32(len(key)),
+		valueSize: uint32(len(value)),
+		key:       []byte(key),
+		value:     value,
+	})
+}
+
+// shouldSeparate reports whether value of r should be stored in value log
+func (bc *Beecask) shouldSeparate(r *Record) bool {
+	const mask = RECORD_FLAG_BIT_DELETE | RECORD_FLAG_BIT_TOUCH | RECORD_FLAG_BIT_VALUE_POINTER | RECORD_FLAG_BIT_OPERAND |
+		RECORD_FLAG_BIT_RANGE_DELETE
+	return bc.options.ValueThreshold > 0 && (r.flag&mask) == 0 && int(r.valueSize) > bc.options.ValueThreshold
+}
+
+// viewValueLog calls fn with the value pointed by ptr
+func (bc *Beecask) viewValueLog(key []byte, ptr valuePointer, fn func(value []byte) error) error {
+	var r Record
+	var err error
+	bc.rwMutex.RLock()
+	if bc.vlogFile != nil && ptr.fileId == bc.vlogFile.FileId() {
+		err = bc.vlogFile.ReadRecordInto(int64(ptr.offset), &r)
+		bc.rwMutex.RUnlock()
+	} else {
+		var entry *CacheEntry
+		entry, err = bc.vlogCache.Ref(ptr.fileId)
+		bc.rwMutex.RUnlock()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return errValueLogGone
+			}
+			bc.logger.Errorf("Ref value log[%d] failed, err=%s", ptr.fileId, err)
+			return err
+		}
+		defer bc.vlogCache.Unref(entry)
+		err = entry.df.ReadRecordInto(int64(ptr.offset), &r)
+	}
+	if err != nil {
+		bc.logger.Errorf("Read record at value log[%d] @ [%d] failed, err=%s", ptr.fileId, ptr.offset, err)
+		return err
+	}
+	if !bytes.Equal(r.key, key) || r.valueSize != ptr.valueSize {
+		bc.logger.Errorf("Record[%s] is not expected %s in value log[%d] @ [%d]",
+			string(r.key), string(key), ptr.fileId, ptr.offset)
+		return ErrDataCorruption
+	}
+	return fn(r.value)
+}
+
+// resolveValue returns a copy of the value of r,
+// following value pointer if r holds one
+func (bc *Beecask) resolveValue(r *Record) ([]byte, error) {
+	if (r.flag & RECORD_FLAG_BIT_VALUE_POINTER) == 0 {
+		return r.value, nil
+	}
+	ptr, err := decodeValuePointer(r.value)
+	if err != nil {
+		return nil, err
+	}
+	var value []byte
+	err = bc.viewValueLog(r.key, ptr, func(v []byte) error {
+		value = append(value, v...)
+		return nil
+	})
+	return value, err
+}
+
+// readValue returns the value of r, following value pointer if r holds one.
+// readValue requires bc.rwMutex held
+func (bc *Beecask) readValue(r *Record) ([]byte, error) {
+	if (r.flag & RECORD_FLAG_BIT_VALUE_POINTER) == 0 {
+		return r.value, nil
+	}
+	ptr, err := decodeValuePointer(r.value)
+	if err != nil {
+		return nil, err
+	}
+
+	var vr *Record
+	if bc.vlogFile != nil && ptr.fileId == bc.vlogFile.FileId() {
+		vr, err = bc.vlogFile.ReadRecordAt(int64(ptr.offset))
+	} else {
+		var entry *CacheEntry
+		if entry, err = bc.vlogCache.Ref(ptr.fileId); err == nil {
+			if vr, err = entry.df.ReadRecordAt(int64(ptr.offset)); err == nil {
+				vr.key = append([]byte(nil), vr.key...)
+				vr.value = append([]byte(nil), vr.value...)
+			}
+			bc.vlogCache.Unref(entry)
+		}
+	}
+	if err != nil {
+		bc.logger.Errorf("Read record at value log[%d] @ [%d] failed, err=%s", ptr.fileId, ptr.offset, err)
+		return nil, err
+	}
+	if !bytes.Equal(vr.key, r.key) || vr.valueSize != ptr.valueSize {
+		return nil, ErrDataCorruption
+	}
+	return vr.value, nil
+}
+
+// getValueLogReader streams the value pointed by ptr
+func (bc *Beecask) getValueLogReader(key string, ptr valuePointer) (io.ReadCloser, int64, error) {
+	bc.rwMutex.Lock()
+	defer bc.rwMutex.Unlock()
+
+	if bc.vlogFile != nil && ptr.fileId == bc.vlogFile.FileId() {
+		// stream through another file descriptor so that writes are not blocked
+		if err := bc.vlogFile.Flush(); err != nil {
+			return nil, 0, err
+		}
+		f, err := bc.fs.Open(bc.valueLogPath(ptr.fileId))
+		if err != nil {
+			return nil, 0, err
+		}
+		vr, size, err := newValueReader(f, int64(ptr.offset), []byte(key), f.Close)
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		return vr, size, nil
+	}
+
+	entry, err := bc.vlogCache.Ref(ptr.fileId)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, errValueLogGone
+		}
+		return nil, 0, err
+	}
+	vr, size, err := newValueReader(randomAccessReader{entry.df.file}, int64(ptr.offset), []byte(key), func() error {
+		bc.vlogCache.Unref(entry)
+		return nil
+	})
+	if err != nil {
+		bc.vlogCache.Unref(entry)
+		return nil, 0, err
+	}
+	return vr, size, nil
+}
+
+// ValueLogGC rewrites live values of sealed value log files and removes them
+func (bc *Beecask) ValueLogGC() {
+	// make sure only one gc running
+	if !atomic.CompareAndSwapInt32(&bc.isVlogGC, 0, 1) {
+		bc.logger.Infof("There is a value log gc process running.")
+		return
+	}
+	defer atomic.CompareAndSwapInt32(&bc.isVlogGC, 1, 0)
+
+	bc.rwMutex.Lock()
+	if bc.vlogFile == nil {
+		bc.rwMutex.Unlock()
+		return
+	}
+	end := bc.vlogFile.FileId()
+	bc.rwMutex.Unlock()
+
+	for begin := &bc.minVlogId; *begin < end; *begin++ {
+		err := bc.gcValueLogFile(*begin)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			bc.logger.Errorf("GC value log[%d] failed, err=%s", *begin, err)
+			return
+		}
+	}
+}
+
+func (bc *Beecask) gcValueLogFile(fileId uint64) error {
+	entry, err := bc.vlogCache.Ref(fileId)
+	if err != nil {
+		return err
+	}
+	defer bc.vlogCache.Unref(entry)
+
+	begin := time.Now()
+	live := 0
+	err = entry.df.ForEachRecord(func(r *Record, fileId uint64, offset int64) error {
+		bc.rwMutex.Lock()
+		defer bc.rwMutex.Unlock()
+
+		// expired values are kept for OnExpire hook, sweeper or merge reports
+		// and drops them later
+		kdItem, ok := bc.keydir.Lookup(r.key)
+		if !ok || (kdItem.flag&RECORD_FLAG_BIT_VALUE_POINTER) == 0 ||
+			(kdItem.isExpired(begin.Unix()) && bc.options.OnExpire == nil) {
+			return nil
+		}
+
+		// check the pointer of key still refers to this record
+		var pr *Record
+		var err error
+		if kdItem.fileId == bc.activeFile.FileId() {
+			pr, err = bc.activeFile.ReadRecordAt(int64(kdItem.valuePos))
+		} else {
+			var dentry *CacheEntry
+			if dentry, err = bc.dataFileCache.Ref(kdItem.fileId); err == nil {
+				pr, err = dentry.df.ReadRecordAt(int64(kdItem.valuePos))
+				bc.dataFileCache.Unref(dentry)
+			}
+		}
+		if err != nil {
+			bc.logger.Errorf("Read pointer of key[%s] failed, err=%s", string(r.key), err)
+			return err
+		}
+		ptr, err := decodeValuePointer(pr.value)
+		if err != nil || ptr.fileId != fileId || ptr.offset != uint64(offset) {
+			return err
+		}
+
+		live++
+		if kdItem.hasOperands() {
+			// fold operands as well, the new record replaces all of them
+			value, err := bc.fold(r.key, &kdItem)
+			if err != nil {
+				return err
+			}
+			nr := newRecord(r.key, value, false, kdItem.expiration)
+			nr.seq = kdItem.seq
+			return bc.setRecord(nr)
+		}
+		return bc.setRecord(&Record{
+			flag:       kdItem.flag & RECORD_FLAG_BIT_BUCKET,
+			expiration: kdItem.expiration,
+			seq:        kdItem.seq,
+			keySize:    r.keySize,
+			valueSize:  r.valueSize,
+			key:        r.key,
+			value:      r.value,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// new pointers must be durable before the old values disappear
+	bc.rwMutex.Lock()
+	if err = bc.vlogFile.Sync(); err == nil {
+		err = bc.activeFile.Sync()
+	}
+	bc.rwMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// expire hooks pending may still read values of dropped keys
+	bc.hookMutex.Lock()
+	bc.vlogCache.Evict(fileId)
+	bc.fs.Remove(bc.valueLogPath(fileId))
+	bc.hookMutex.Unlock()
+	bc.logger.Tracef("GC value log[%d](live records:%d) succ in %fs.", fileId, live, time.Since(begin).Seconds())
+	return nil
+}
@@ -0,0 +1,156 @@
+package beecask
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func countValueLogs(t *testing.T, fs FS) int {
+	t.Helper()
+	names, err := fs.ReadDir(TEST_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, name := range names {
+		if strings.HasSuffix(name, ".vlog") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestValueLog(t *testing.T) {
+	fs := NewMemFS()
+	opts := testOptions(fs)
+	opts.MaxFileSize = 64 << 10
+	opts.ValueThreshold = 100
+	bc := openTest(t, opts)
+
+	value := func(i, g int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%d-%d;", i, g)), 500)
+	}
+	for g := 0; g < 5; g++ {
+		for i := 0; i < 30; i++ {
+			if err := bc.Set(fmt.Sprint("k", i), value(i, g)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	bc.Set("small", []byte("s"))
+	check := func() {
+		t.Helper()
+		for i := 0; i < 30; i++ {
+			expectValue(t, bc, fmt.Sprint("k", i), string(value(i, 4)))
+		}
+		expectValue(t, bc, "small", "s")
+		rc, size, err := bc.GetReader("k3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil || int64(len(got)) != size || !bytes.Equal(got, value(3, 4)) {
+			t.Fatalf("streamed value mismatches, err=%v", err)
+		}
+	}
+	check()
+
+	before := countValueLogs(t, fs)
+	bc.ValueLogGC()
+	if after := countValueLogs(t, fs); after >= before {
+		t.Fatalf("value log gc removes nothing, %d files before and %d after", before, after)
+	}
+	check()
+	mergeTest(t, bc)
+	check()
+	bc.Close()
+
+	bc = openTest(t, opts)
+	defer bc.Close()
+	check()
+}
+
+// value log gc must not drop expired values before OnExpire hook is called
+func TestValueLogGCKeepsExpiredValues(t *testing.T) {
+	for _, sweep := range []bool{true, false} {
+		var mu sync.Mutex
+		expired := map[string]string{}
+		opts := testOptions(NewMemFS())
+		opts.ValueThreshold = 10
+		opts.OnExpire = func(bucket string, key string, value []byte) {
+			mu.Lock()
+			expired[key] = string(value)
+			mu.Unlock()
+		}
+		bc := openTest(t, opts)
+
+		value := strings.Repeat("v", 100)
+		if err := bc.SetWithExpiration("k", []byte(value), time.Now().Unix()-1); err != nil {
+			t.Fatal(err)
+		}
+		bc.rwMutex.Lock()
+		err := bc.rotateValueLog()
+		bc.rwMutex.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bc.ValueLogGC()
+
+		if sweep {
+			bc.expireKeys(time.Now().Unix(), 10)
+		} else {
+			rotateTest(t, bc)
+			mergeTest(t, bc)
+		}
+		mu.Lock()
+		if expired["k"] != value {
+			t.Fatalf("sweep %v: expire hook expects value, got %q", sweep, expired["k"])
+		}
+		mu.Unlock()
+		bc.Close()
+	}
+}
+
+func TestValueLogGCKeepsBucketKeys(t *testing.T) {
+	opts := testOptions(NewMemFS())
+	opts.ValueThreshold = 50
+	opts.MaxFileSize = 1024
+	bc := openTest(t, opts)
+
+	b, err := bc.Bucket("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := bytes.Repeat([]byte("v"), 100)
+	b.Set("x", value)
+	for i := 0; i < 30; i++ {
+		bc.Set("k", value)
+	}
+	bc.ValueLogGC()
+	check := func(tag string) {
+		t.Helper()
+		if keys := bc.Keys(); len(keys) != 1 || keys[0] != "k" {
+			t.Fatalf("%s: keys expect k only, got %q", tag, keys)
+		}
+		if keys := b.Keys(); len(keys) != 1 || keys[0] != "x" {
+			t.Fatalf("%s: keys of bucket expect x, got %q", tag, keys)
+		}
+		if v, err := b.Get("x"); err != nil || !bytes.Equal(v, value) {
+			t.Fatalf("%s: value of bucket key mismatches, err=%v", tag, err)
+		}
+	}
+	check("gc")
+	bc.Close()
+	bc = openTest(t, opts)
+	defer bc.Close()
+	if b, err = bc.Bucket("b"); err != nil {
+		t.Fatal(err)
+	}
+	check("reopen")
+}
@@ -0,0 +1,116 @@
+package beecask
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompareAndSwap(t *testing.T) {
+	bc := openTest(t, testOptions(NewMemFS()))
+	defer bc.Close()
+
+	v1, err := bc.SetIfAbsent("k", []byte("a"))
+	if err != nil || v1 == 0 {
+		t.Fatalf("set if absent failed, version=%d err=%v", v1, err)
+	}
+	if _, err = bc.SetIfAbsent("k", []byte("b")); err != ErrDataExist {
+		t.Fatalf("set if absent on existing key, err=%v", err)
+	}
+	v2, err := bc.CompareAndSwap("k", v1, []byte("b"))
+	if err != nil || v2 <= v1 {
+		t.Fatalf("cas failed, version=%d err=%v", v2, err)
+	}
+	if _, err = bc.CompareAndSwap("k", v1, []byte("c")); err != ErrVersionMismatch {
+		t.Fatalf("cas with stale version, err=%v", err)
+	}
+	expectValue(t, bc, "k", "b")
+
+	if err = bc.DeleteIfVersion("k", v1); err != ErrVersionMismatch {
+		t.Fatalf("delete with stale version, err=%v", err)
+	}
+	if err = bc.DeleteIfVersion("k", v2); err != nil {
+		t.Fatalf("delete if version failed, err=%v", err)
+	}
+	expectNotExist(t, bc, "k")
+	if _, err = bc.CompareAndSwap("k", 0, []byte("d")); err != nil {
+		t.Fatalf("cas of absent key failed, err=%v", err)
+	}
+	expectValue(t, bc, "k", "d")
+}
+
+func TestCompareAndSwapKeepsExpiration(t *testing.T) {
+	bc := openTest(t, testOptions(NewMemFS()))
+	defer bc.Close()
+
+	if err := bc.SetWithTTL("k", []byte("a"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	_, version, err := bc.GetWithVersion("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bc.CompareAndSwap("k", version, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := bc.TTL("k"); err != nil || ttl <= 0 {
+		t.Fatalf("ttl expects kept, got %s, err=%v", ttl, err)
+	}
+}
+
+func TestVersionSurvivesRestart(t *testing.T) {
+	opts := testOptions(NewMemFS())
+	bc := openTest(t, opts)
+	version, err := bc.SetIfAbsent("k", []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotateTest(t, bc)
+	bc.Merge()
+	bc.Close()
+
+	bc = openTest(t, opts)
+	defer bc.Close()
+	if _, v, err := bc.GetWithVersion("k"); err != nil || v != version {
+		t.Fatalf("version expects %d, got %d, err=%v", version, v, err)
+	}
+}
+
+// versions of keys dropped by merge must not be handed out again after an
+// unclean restart, a stale version would match a key set again
+func TestVersionNotReusedAfterMerge(t *testing.T) {
+	for _, mode := range []int{INDEX_MODE_MEMORY, INDEX_MODE_HASH} {
+		fs := NewFaultFS(NewMemFS())
+		opts := testOptions(fs)
+		opts.IndexMode = mode
+		bc := openTest(t, opts)
+
+		if err := bc.Set("a", []byte("a")); err != nil {
+			t.Fatal(err)
+		}
+		old, err := bc.SetIfAbsent("b", []byte("b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = bc.Delete("b"); err != nil {
+			t.Fatal(err)
+		}
+		rotateTest(t, bc)
+		bc.Merge()
+		if err = bc.Sync(); err != nil {
+			t.Fatal(err)
+		}
+
+		bc = crashTest(t, bc, fs, opts)
+		version, err := bc.SetIfAbsent("b", []byte("c"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version <= old {
+			t.Fatalf("index mode %d: version %d is handed out again, old version %d", mode, version, old)
+		}
+		if _, err = bc.CompareAndSwap("b", old, []byte("d")); err != ErrVersionMismatch {
+			t.Fatalf("index mode %d: cas with stale version, err=%v", mode, err)
+		}
+		bc.Close()
+	}
+}